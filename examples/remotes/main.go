@@ -27,6 +27,7 @@ func realMain() error {
 	logger := stdr.New(log.Default())
 	ctx = logr.NewContext(ctx, logger)
 
+	metrics := gateway.NewPrometheusMetrics()
 	gw, err := gateway.NewGateway(ctx, &gateway.GatewayConfig{
 		ServiceDefinitions: []*gateway.ServiceDefinition{
 			{
@@ -46,6 +47,7 @@ func realMain() error {
 				URL:  "http://localhost:4004/graphql",
 			},
 		},
+		Metrics: metrics,
 	})
 	if err != nil {
 		logger.Error(err, "failed to execute NewGateway")
@@ -56,6 +58,7 @@ func realMain() error {
 	mux := http.NewServeMux()
 	mux.Handle("/", playground.Handler("fedeway - remotes", "/query"))
 	mux.Handle("/query", srv)
+	mux.Handle("/metrics", metrics)
 
 	port := os.Getenv("PORT")
 	if port == "" {
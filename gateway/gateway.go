@@ -1,28 +1,190 @@
 package gateway
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/99designs/gqlgen/graphql"
+	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/formatter"
 	"github.com/vektah/gqlparser/v2/gqlerror"
 	"github.com/vektah/gqlparser/v2/parser"
 	"github.com/vektah/gqlparser/v2/validator"
 	"github.com/vvakame/fedeway/internal/engine"
 	"github.com/vvakame/fedeway/internal/federation"
+	"github.com/vvakame/fedeway/internal/log"
+	"github.com/vvakame/fedeway/internal/plan"
 	"github.com/vvakame/fedeway/internal/planner"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var _ graphql.ExecutableSchema = (*gatewayImpl)(nil)
+const defaultQueryPlanCacheSize = 1000
+
+// TimeoutBudgetHeader is sent to subgraphs with the remaining time budget in milliseconds
+// when ServiceDefinition.Timeout or GatewayConfig.OperationTimeout is given.
+const TimeoutBudgetHeader = engine.TimeoutBudgetHeader
+
+// QueryPlanHeader is the request header to get the query plan in extensions.queryPlan.
+// any value includes the query plan, QueryPlanOnly and QueryPlanAnalyze change the execution.
+// see GatewayConfig.QueryPlanExposure.
+const QueryPlanHeader = "Fedeway-Query-Plan"
+
+const (
+	// QueryPlanOnly is the value of QueryPlanHeader for tools that need the query plan but not the result.
+	QueryPlanOnly = "plan-only"
+	// QueryPlanAnalyze is the value of QueryPlanHeader to also get extensions.fetches.
+	// it records every request to subgraphs with the path, sizes, duration and error count. see FetchDiagnostic.
+	QueryPlanAnalyze = "analyze"
+)
+
+// FetchDiagnostic is the record of a request to the subgraph in extensions.fetches.
+type FetchDiagnostic = engine.FetchDiagnostic
+
+var _ Gateway = (*gatewayImpl)(nil)
 var _ engine.DataSource = (DataSource)(nil)
 
 type GatewayConfig struct {
-	ServiceDefinitions []*ServiceDefinition
+	ServiceDefinitions []*ServiceDefinition // optional when SupergraphSDL or SupergraphSDLFile is given
+
+	// SupergraphSDL is a precomposed supergraph SDL.
+	// the gateway uses it as is instead of fetching SDLs from subgraphs and composing them.
+	SupergraphSDL string // optional
+	// SupergraphSDLFile is a path to the file that contains a precomposed supergraph SDL.
+	SupergraphSDLFile string // optional
+
+	// PollInterval enables periodic refetching of subgraph SDLs when it is greater than 0.
+	// when SupergraphSDLFile is given, the file is reloaded instead.
+	// polling stops when the context passed to NewGateway is done.
+	PollInterval time.Duration
+	// OnSchemaUpdateError is called when a refetched supergraph can't be composed.
+	// the gateway keeps serving the last good schema in that case.
+	OnSchemaUpdateError func(ctx context.Context, err error) // optional
+
+	// QueryPlanCacheSize is the max number of query plans kept in the LRU cache.
+	// default is 1000. negative value disables the cache.
+	QueryPlanCacheSize int
+
+	// ErrorPresenter is applied once by the gateway to all errors in the response. e.g. masking internal messages, attaching error codes.
+	// it isn't set to data sources on purpose, errors from them are presented by the gateway after the fetch.
+	// ErrorPresenter of a data source is applied before it, so usually data sources should keep the default one.
+	ErrorPresenter graphql.ErrorPresenterFunc // optional
+	// RecoverFunc is used by the gateway when the panic occurred while executing the query plan.
+	// it isn't set to data sources. RemoteDataSource without its own one uses it by the OperationContext of each fetch.
+	RecoverFunc graphql.RecoverFunc // optional
+
+	// OperationTimeout is the deadline for executing the whole query plan. it isn't applied to subscriptions.
+	// fetches that exceed it become DOWNSTREAM_SERVICE_ERROR and the data fetched so far is kept.
+	OperationTimeout time.Duration // optional
+
+	// CircuitBreaker enables the circuit breaker for each subgraph.
+	// while it is open, fetches to the subgraph fail fast with CIRCUIT_BREAKER_OPEN error.
+	CircuitBreaker *CircuitBreakerConfig // optional
+
+	// RequestCoalescing enables sharing one in-flight response among identical query fetches to the same subgraph.
+	// mutations are never coalesced.
+	RequestCoalescing *RequestCoalescingConfig // optional
+
+	// QueryPlanExposure includes the query plan in extensions.queryPlan of responses for debugging.
+	// the query plan reveals subgraphs and their operations, don't expose it to untrusted clients.
+	QueryPlanExposure QueryPlanExposure
+
+	// TracerProvider is used for spans of planning and executing operations. the global one is used when it is nil.
+	// RemoteDataSource sends the trace context to subgraphs by W3C Trace Context headers.
+	TracerProvider trace.TracerProvider // optional
+
+	// FederatedTraceSink receives the trace of each operation. subgraphs are asked to return their traces (ftv1)
+	// by FederatedTraceHeader, and they are stitched into the query plan of the trace. subscriptions aren't traced.
+	// it is called on the request path. it must not block.
+	FederatedTraceSink FederatedTraceSink // optional
+
+	// Metrics records operations, planning and fetches to subgraphs. see PrometheusMetrics.
+	Metrics Metrics // optional
+}
+
+type QueryPlanExposure int
+
+const (
+	// QueryPlanExposureNone never includes the query plan. it is the default.
+	QueryPlanExposureNone QueryPlanExposure = iota
+	// QueryPlanExposureOnRequest includes the query plan when the request has QueryPlanHeader.
+	QueryPlanExposureOnRequest
+	// QueryPlanExposureAlways includes the query plan in all responses.
+	QueryPlanExposureAlways
+)
+
+type RequestCoalescingConfig struct {
+	// KeyHeaders are headers of the inbound request that affect responses of subgraphs. e.g. Authorization.
+	// fetches are coalesced only when they have the same values. all headers are compared when it is nil.
+	KeyHeaders []string
+}
+
+type Gateway interface {
+	graphql.ExecutableSchema
+
+	// QueryPlanCacheStats returns the statistics of the query plan cache.
+	QueryPlanCacheStats() QueryPlanCacheStats
+	// CircuitBreakerStates returns the state of the circuit breaker for each subgraph.
+	// it is empty when GatewayConfig.CircuitBreaker isn't given.
+	CircuitBreakerStates() map[string]CircuitState
+}
+
+type QueryPlanCacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Len    int // number of cached query plans for the current schema
 }
 
+type CircuitBreakerConfig = engine.CircuitBreakerConfig
+
+// Metrics records numbers of the gateway. it is called by concurrent requests.
+type Metrics interface {
+	FetchMetrics
+
+	// ObserveOperation is called for every operation. operationName is empty for anonymous operations.
+	// errors is the number of errors in the response. errors in events of subscriptions aren't counted.
+	ObserveOperation(operationName string, operationType string, errors int)
+	// ObservePlanning is called for every planning. cacheHit is true when the query plan cache is used.
+	ObservePlanning(duration time.Duration, cacheHit bool)
+}
+
+type FetchMetrics = engine.FetchMetrics
+
+// FederatedTraceHeader is sent to subgraphs when GatewayConfig.FederatedTraceSink is given.
+const FederatedTraceHeader = engine.FederatedTraceHeader
+
+type FederatedTrace = engine.FederatedTrace
+
+type FederatedTraceSink = engine.FederatedTraceSink
+
+// FileTraceSink appends traces to the file as JSON lines by another goroutine. traces are dropped when its buffer is full.
+// it is for testing and debugging.
+type FileTraceSink = engine.FileTraceSink
+
+// NewFileTraceSink opens the file to append traces. the file is created if it doesn't exist.
+func NewFileTraceSink(path string) (*FileTraceSink, error) {
+	return engine.NewFileTraceSink(path)
+}
+
+type CircuitState = engine.CircuitState
+
+const (
+	CircuitClosed   = engine.CircuitClosed
+	CircuitOpen     = engine.CircuitOpen
+	CircuitHalfOpen = engine.CircuitHalfOpen
+)
+
 type DataSource interface {
 	Process(ctx context.Context, oc *graphql.OperationContext) *graphql.Response
 }
@@ -31,19 +193,96 @@ type ServiceDefinition struct {
 	Name       string
 	URL        string // optional
 	DataSource DataSource
+
+	// Timeout is the timeout of each fetch to the subgraph.
+	// a fetch that exceeds it becomes DOWNSTREAM_SERVICE_ERROR and the rest of the plan continues.
+	Timeout time.Duration // optional
+	// MaxBatchSize is the max number of representations in an `_entities` request to the subgraph.
+	// representations over it are split into batches and sent concurrently.
+	MaxBatchSize int // optional
+	// Retry enables retries of query fetches to the subgraph for transient errors. it is used by RemoteDataSource.
+	Retry *RetryPolicy // optional
+
+	// HeaderRules is the declarative header policy for the subgraph. it is used by RemoteDataSource.
+	HeaderRules *HeaderRules // optional
+	// WillSendRequest is called just before sending the request to the subgraph, after HeaderRules are applied.
+	// it is used by RemoteDataSource. e.g. propagating the inbound headers by RequestHeaders(ctx).
+	WillSendRequest WillSendRequestFunc // optional
+}
+
+// RetryPolicy is the retry settings for a subgraph.
+// backoff is exponential from InitialBackoff up to MaxBackoff with full jitter.
+type RetryPolicy = engine.RetryPolicy
+
+// WillSendRequestFunc can modify the request to the subgraph. oc is the operation for the subgraph.
+type WillSendRequestFunc func(ctx context.Context, req *http.Request, oc *graphql.OperationContext)
+
+// RequestHeaders returns the headers of the inbound request to the gateway.
+// it returns nil when the transport doesn't provide headers. e.g. websocket.
+func RequestHeaders(ctx context.Context) http.Header {
+	return engine.RequestHeaders(ctx)
 }
 
 type gatewayImpl struct {
 	sync.RWMutex
 
-	serviceDefinitions []*ServiceDefinition
-	composedSchema     *planner.ComposedSchema
-	serviceMap         engine.ServiceMap
+	serviceDefinitions  []*ServiceDefinition
+	supergraphSDLSource string
+	supergraphSDLFile   string
+	onSchemaUpdateError func(ctx context.Context, err error)
+	queryPlanCacheSize  int
+	errorPresenter      graphql.ErrorPresenterFunc
+	recoverFunc         graphql.RecoverFunc
+	operationTimeout    time.Duration
+	fetchTimeouts       map[string]time.Duration
+	maxBatchSizes       map[string]int
+	circuitBreaker      *CircuitBreakerConfig
+	coalescer           *engine.RequestCoalescer
+	queryPlanExposure   QueryPlanExposure
+	tracerProvider      trace.TracerProvider
+	tracer              trace.Tracer
+	traceSink           FederatedTraceSink
+	metrics             Metrics
+
+	supergraphSDL     string
+	composedSchema    *planner.ComposedSchema
+	serviceMap        engine.ServiceMap
+	remoteDataSources map[string]*engine.RemoteDataSource
+	// dataSources are data sources of service definitions owned by the gateway.
+	// NOTE RemoteDataSource given by users is copied to configure it without modifying the user's one.
+	dataSources map[string]engine.DataSource
+	// breakers are kept over schema swaps. nil means disabled.
+	breakers map[string]*engine.CircuitBreaker
+	// queryPlanCache is recreated on every schema swap. nil means disabled.
+	queryPlanCache *lru.Cache[string, *plan.QueryPlan]
+
+	queryPlanCacheHits   uint64
+	queryPlanCacheMisses uint64
 }
 
-func NewGateway(ctx context.Context, cfg *GatewayConfig) (graphql.ExecutableSchema, error) {
+func NewGateway(ctx context.Context, cfg *GatewayConfig) (Gateway, error) {
 	g := &gatewayImpl{
-		serviceDefinitions: cfg.ServiceDefinitions,
+		serviceDefinitions:  cfg.ServiceDefinitions,
+		supergraphSDLSource: cfg.SupergraphSDL,
+		supergraphSDLFile:   cfg.SupergraphSDLFile,
+		onSchemaUpdateError: cfg.OnSchemaUpdateError,
+		queryPlanCacheSize:  cfg.QueryPlanCacheSize,
+		errorPresenter:      cfg.ErrorPresenter,
+		recoverFunc:         cfg.RecoverFunc,
+		operationTimeout:    cfg.OperationTimeout,
+		circuitBreaker:      cfg.CircuitBreaker,
+		queryPlanExposure:   cfg.QueryPlanExposure,
+		tracerProvider:      cfg.TracerProvider,
+		tracer:              engine.NewTracer(cfg.TracerProvider),
+		traceSink:           cfg.FederatedTraceSink,
+		metrics:             cfg.Metrics,
+		fetchTimeouts:       make(map[string]time.Duration),
+		maxBatchSizes:       make(map[string]int),
+		remoteDataSources:   make(map[string]*engine.RemoteDataSource),
+		dataSources:         make(map[string]engine.DataSource),
+	}
+	if cfg.RequestCoalescing != nil {
+		g.coalescer = engine.NewRequestCoalescer(cfg.RequestCoalescing.KeyHeaders)
 	}
 	err := g.validate()
 	if err != nil {
@@ -52,50 +291,149 @@ func NewGateway(ctx context.Context, cfg *GatewayConfig) (graphql.ExecutableSche
 
 	// TODO make async
 
-	err = g.fetchSDLs(ctx)
+	err = g.updateSchema(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	if cfg.PollInterval > 0 && g.supergraphSDLSource == "" {
+		go g.pollSchema(ctx, cfg.PollInterval)
+	}
+
 	return g, nil
 }
 
 func (g *gatewayImpl) validate() error {
-	if len(g.serviceDefinitions) == 0 {
+	if g.supergraphSDLSource != "" && g.supergraphSDLFile != "" {
+		return fmt.Errorf("SupergraphSDL and SupergraphSDLFile are mutually exclusive")
+	}
+	if len(g.serviceDefinitions) == 0 && g.supergraphSDLSource == "" && g.supergraphSDLFile == "" {
 		return fmt.Errorf("service definitions are must required")
 	}
+	if g.queryPlanCacheSize == 0 {
+		g.queryPlanCacheSize = defaultQueryPlanCacheSize
+	}
 
 	for _, serviceDef := range g.serviceDefinitions {
-		if serviceDef.DataSource == nil {
-			serviceDef.DataSource = &engine.RemoteDataSource{
+		if serviceDef.Timeout > 0 {
+			g.fetchTimeouts[serviceDef.Name] = serviceDef.Timeout
+		}
+		if serviceDef.MaxBatchSize > 0 {
+			g.maxBatchSizes[serviceDef.Name] = serviceDef.MaxBatchSize
+		}
+
+		var ds engine.DataSource = serviceDef.DataSource
+		if ds == nil {
+			ds = &engine.RemoteDataSource{
 				URL: serviceDef.URL,
 			}
+		} else if rds, ok := ds.(*engine.RemoteDataSource); ok {
+			copied := *rds
+			ds = &copied
+		}
+
+		if rds, ok := ds.(*engine.RemoteDataSource); ok {
+			if rds.Retry == nil {
+				rds.Retry = serviceDef.Retry
+			}
+			err := configureHeaderRules(rds, serviceDef.HeaderRules, serviceDef.WillSendRequest)
+			if err != nil {
+				return fmt.Errorf(`service "%s": %w`, serviceDef.Name, err)
+			}
 		}
+		g.dataSources[serviceDef.Name] = ds
 	}
 
 	return nil
 }
 
-func (g *gatewayImpl) fetchSDLs(ctx context.Context) error {
+func (g *gatewayImpl) updateSchema(ctx context.Context) error {
+	var sdl string
+	var err error
+	if g.supergraphSDLSource != "" {
+		sdl = g.supergraphSDLSource
+	} else if g.supergraphSDLFile != "" {
+		sdl, err = g.readSupergraphSDLFile()
+	} else {
+		sdl, err = g.composeSupergraphSDL(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
 	g.RLock()
-	serviceDefinitions := g.serviceDefinitions
+	unchanged := g.supergraphSDL == sdl
 	g.RUnlock()
+	if unchanged {
+		return nil
+	}
 
-	// TODO make parallel
+	schemaDoc, gErr := parser.ParseSchemas(
+		validator.Prelude,
+		&ast.Source{
+			Input:   sdl,
+			BuiltIn: false,
+		},
+	)
+	if gErr != nil {
+		return gErr
+	}
 
-	serviceMap := make(engine.ServiceMap)
-	services := make([]*federation.ServiceDefinition, 0, len(serviceDefinitions))
-	for _, serviceDef := range serviceDefinitions {
-		sdl, err := g.fetchSDL(ctx, serviceDef.DataSource)
+	cs, err := planner.BuildComposedSchema(ctx, schemaDoc)
+	if err != nil {
+		return err
+	}
+
+	serviceMap, err := g.buildServiceMap(cs)
+	if err != nil {
+		return err
+	}
+	breakers := g.buildCircuitBreakers(serviceMap)
+
+	// query plans built for the old schema must not be used anymore.
+	var queryPlanCache *lru.Cache[string, *plan.QueryPlan]
+	if g.queryPlanCacheSize > 0 {
+		queryPlanCache, err = lru.New[string, *plan.QueryPlan](g.queryPlanCacheSize)
 		if err != nil {
 			return err
 		}
+	}
+
+	g.Lock()
+	g.supergraphSDL = sdl
+	g.composedSchema = cs
+	g.serviceMap = serviceMap
+	g.breakers = breakers
+	g.queryPlanCache = queryPlanCache
+	g.Unlock()
+
+	return nil
+}
+
+func (g *gatewayImpl) readSupergraphSDLFile() (string, error) {
+	b, err := os.ReadFile(g.supergraphSDLFile)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func (g *gatewayImpl) composeSupergraphSDL(ctx context.Context) (string, error) {
+	// TODO make parallel
+
+	services := make([]*federation.ServiceDefinition, 0, len(g.serviceDefinitions))
+	for _, serviceDef := range g.serviceDefinitions {
+		sdl, err := g.fetchSDL(ctx, g.dataSources[serviceDef.Name])
+		if err != nil {
+			return "", err
+		}
 
 		schemaDoc, gErr := parser.ParseSchema(&ast.Source{
 			Input: sdl,
 		})
 		if gErr != nil {
-			return gErr
+			return "", gErr
 		}
 
 		services = append(services, &federation.ServiceDefinition{
@@ -103,36 +441,106 @@ func (g *gatewayImpl) fetchSDLs(ctx context.Context) error {
 			Name:     serviceDef.Name,
 			URL:      serviceDef.URL,
 		})
-		serviceMap[serviceDef.Name] = serviceDef.DataSource
 	}
 
 	_, sdl, _, err := federation.ComposeAndValidate(ctx, services)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	schemaDoc, gErr := parser.ParseSchemas(
-		validator.Prelude,
-		&ast.Source{
-			Input:   sdl,
-			BuiltIn: false,
-		},
-	)
-	if gErr != nil {
-		return err
+	return sdl, nil
+}
+
+// buildServiceMap maps each join__Graph value to a data source.
+// a ServiceDefinition that has the same name is used first, otherwise a RemoteDataSource for the graph url is used.
+func (g *gatewayImpl) buildServiceMap(cs *planner.ComposedSchema) (engine.ServiceMap, error) {
+	g.Lock()
+	defer g.Unlock()
+
+	serviceMap := make(engine.ServiceMap)
+	for _, serviceDef := range g.serviceDefinitions {
+		serviceMap[serviceDef.Name] = g.dataSources[serviceDef.Name]
 	}
 
-	cs, err := planner.BuildComposedSchema(ctx, schemaDoc)
-	if err != nil {
-		return err
+	for enumName, graph := range cs.SchemaMetadata.Graphs {
+		if _, ok := serviceMap[graph.Name]; ok {
+			continue
+		}
+		if graph.URL == "" {
+			return nil, fmt.Errorf(`graph "%s" (%s) doesn't have url and no service definition is given`, graph.Name, enumName)
+		}
+
+		rds := g.remoteDataSources[graph.Name]
+		if rds == nil || rds.URL != graph.URL {
+			rds = &engine.RemoteDataSource{
+				URL: graph.URL,
+			}
+			g.remoteDataSources[graph.Name] = rds
+		}
+		serviceMap[graph.Name] = rds
 	}
 
-	g.Lock()
-	g.composedSchema = cs
-	g.serviceMap = serviceMap
-	g.Unlock()
+	return serviceMap, nil
+}
 
-	return nil
+// buildCircuitBreakers makes a circuit breaker for each service. existing ones are reused to keep their states.
+func (g *gatewayImpl) buildCircuitBreakers(serviceMap engine.ServiceMap) map[string]*engine.CircuitBreaker {
+	if g.circuitBreaker == nil {
+		return nil
+	}
+
+	g.RLock()
+	defer g.RUnlock()
+
+	breakers := make(map[string]*engine.CircuitBreaker, len(serviceMap))
+	for serviceName := range serviceMap {
+		breaker := g.breakers[serviceName]
+		if breaker == nil {
+			breaker = engine.NewCircuitBreaker(g.circuitBreaker)
+		}
+		breakers[serviceName] = breaker
+	}
+
+	return breakers
+}
+
+func (g *gatewayImpl) pollSchema(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := g.pollUpdateSchema(ctx)
+		if err != nil {
+			g.schemaUpdateError(ctx, err)
+		}
+	}
+}
+
+// pollUpdateSchema updates the schema in the polling goroutine.
+// NOTE a panic while composing SDLs of subgraphs must not take down the gateway that serves the last good schema.
+func (g *gatewayImpl) pollUpdateSchema(ctx context.Context) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while updating supergraph: %v", r)
+		}
+	}()
+
+	return g.updateSchema(ctx)
+}
+
+func (g *gatewayImpl) schemaUpdateError(ctx context.Context, err error) {
+	if g.onSchemaUpdateError != nil {
+		g.onSchemaUpdateError(ctx, err)
+		return
+	}
+
+	log.FromContext(ctx).Error(err, "failed to update supergraph, keep using the last good schema")
 }
 
 func (g *gatewayImpl) fetchSDL(ctx context.Context, datasource engine.DataSource) (string, error) {
@@ -177,7 +585,8 @@ func (g *gatewayImpl) Schema() *ast.Schema {
 	if g.composedSchema == nil {
 		panic("gateway doesn't have composed schema")
 	}
-	schema := g.composedSchema.Schema
+	// clients only see the API schema. e.g. @inaccessible elements are removed.
+	schema := g.composedSchema.APISchema
 	g.RUnlock()
 
 	return schema
@@ -190,30 +599,308 @@ func (g *gatewayImpl) Complexity(typeName, fieldName string, childComplexity int
 
 func (g *gatewayImpl) Exec(ctx context.Context) graphql.ResponseHandler {
 	g.RLock()
-	schema := g.composedSchema.Schema
+	composedSchema := g.composedSchema
 	serviceMap := g.serviceMap
+	breakers := g.breakers
+	queryPlanCache := g.queryPlanCache
 	g.RUnlock()
 
 	oc := graphql.GetOperationContext(ctx)
 
-	opctx, err := planner.BuildOperationContext(ctx, g.composedSchema, oc.Doc, oc.OperationName)
+	ctx, span := g.startRequestSpan(ctx, oc)
+	// NOTE the span of the subscription ends when the subscription finishes
+	endSpan := true
+	defer func() {
+		if endSpan {
+			span.End()
+		}
+	}()
+
+	plan, err := g.getQueryPlan(ctx, composedSchema, queryPlanCache, oc)
 	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		if g.errorPresenter != nil {
+			err = g.errorPresenter(ctx, err)
+		}
 		graphql.AddError(ctx, err)
+		g.observeOperation(oc, 1)
 		return func(ctx context.Context) *graphql.Response {
 			return &graphql.Response{Errors: graphql.GetErrors(ctx)}
 		}
 	}
 
-	plan, err := planner.BuildQueryPlan(ctx, opctx)
-	if err != nil {
-		graphql.AddError(ctx, err)
-		return func(ctx context.Context) *graphql.Response {
-			return &graphql.Response{Errors: graphql.GetErrors(ctx)}
+	queryPlanMode := g.queryPlanMode(oc)
+	var queryPlanExt *queryPlanExtension
+	if queryPlanMode != queryPlanModeNone {
+		queryPlanExt, err = newQueryPlanExtension(plan)
+		if err != nil {
+			graphql.AddError(ctx, err)
+			g.observeOperation(oc, 1)
+			return func(ctx context.Context) *graphql.Response {
+				return &graphql.Response{Errors: graphql.GetErrors(ctx)}
+			}
+		}
+	}
+	if queryPlanMode == queryPlanModePlanOnly {
+		// NOTE data is null because nothing is executed
+		g.observeOperation(oc, 0)
+		return withQueryPlanExtension(graphql.OneShot(&graphql.Response{}), queryPlanExt)
+	}
+
+	opts := []engine.ExecuteOption{
+		engine.WithErrorPresenter(g.errorPresenter),
+		engine.WithRecoverFunc(g.recoverFunc),
+		engine.WithFetchTimeouts(g.fetchTimeouts),
+		engine.WithCircuitBreakers(breakers),
+		engine.WithMaxBatchSizes(g.maxBatchSizes),
+		engine.WithRequestCoalescer(g.coalescer),
+		engine.WithFetchDiagnostics(queryPlanMode == queryPlanModeAnalyze),
+		engine.WithTracerProvider(g.tracerProvider),
+	}
+	if g.traceSink != nil {
+		opts = append(opts, engine.WithFederatedTraceSink(g.traceSink))
+	}
+	if g.metrics != nil {
+		opts = append(opts, engine.WithFetchMetrics(g.metrics))
+	}
+
+	if oc.Operation.Operation == ast.Subscription {
+		g.observeOperation(oc, 0)
+		handler := withEngineExtensions(engine.ExecuteSubscriptionPlan(ctx, plan, serviceMap, composedSchema, oc, opts...))
+		if queryPlanExt != nil {
+			handler = withQueryPlanExtension(handler, queryPlanExt)
+		}
+		endSpan = false
+		return withRequestSpan(handler, span)
+	}
+
+	if g.operationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.operationTimeout)
+		defer cancel()
+	}
+
+	resp := engine.ExecuteQueryPlan(ctx, plan, serviceMap, composedSchema, oc, opts...)
+	g.observeOperation(oc, len(resp.Errors))
+	handler := withEngineExtensions(func(ctx context.Context) *graphql.Response {
+		return resp
+	})
+	if queryPlanExt != nil {
+		return withQueryPlanExtension(handler, queryPlanExt)
+	}
+	return handler
+}
+
+func (g *gatewayImpl) observeOperation(oc *graphql.OperationContext, errors int) {
+	if g.metrics == nil {
+		return
+	}
+
+	g.metrics.ObserveOperation(oc.Operation.Name, string(oc.Operation.Operation), errors)
+}
+
+// withEngineExtensions moves extensions made by the engine to the response context.
+// NOTE gqlgen's executor replaces extensions of the response with the ones registered to the context.
+func withEngineExtensions(handler graphql.ResponseHandler) graphql.ResponseHandler {
+	return func(ctx context.Context) *graphql.Response {
+		resp := handler(ctx)
+		if resp == nil {
+			return nil
+		}
+		for key, value := range resp.Extensions {
+			graphql.RegisterExtension(ctx, key, value)
 		}
+		return resp
 	}
+}
 
-	resp := engine.ExecuteQueryPlan(ctx, plan, serviceMap, schema, oc)
+// withRequestSpan traces events of the subscription under the request span and ends it when the subscription finishes.
+func withRequestSpan(handler graphql.ResponseHandler, span trace.Span) graphql.ResponseHandler {
 	return func(ctx context.Context) *graphql.Response {
+		resp := handler(trace.ContextWithSpan(ctx, span))
+		if resp == nil {
+			span.End()
+		}
 		return resp
 	}
 }
+
+type queryPlanMode int
+
+const (
+	queryPlanModeNone queryPlanMode = iota
+	queryPlanModeInclude
+	queryPlanModePlanOnly
+	queryPlanModeAnalyze
+)
+
+// queryPlanMode decides what is exposed by GatewayConfig.QueryPlanExposure and QueryPlanHeader.
+func (g *gatewayImpl) queryPlanMode(oc *graphql.OperationContext) queryPlanMode {
+	// NOTE oc.Headers is nil for websocket
+	value := oc.Headers.Get(QueryPlanHeader)
+
+	switch g.queryPlanExposure {
+	case QueryPlanExposureAlways:
+	case QueryPlanExposureOnRequest:
+		if value == "" {
+			return queryPlanModeNone
+		}
+	default:
+		return queryPlanModeNone
+	}
+
+	switch value {
+	case QueryPlanOnly:
+		return queryPlanModePlanOnly
+	case QueryPlanAnalyze:
+		return queryPlanModeAnalyze
+	default:
+		return queryPlanModeInclude
+	}
+}
+
+// queryPlanExtension is the value of extensions.queryPlan. it has the same shape as Apollo Router's one.
+type queryPlanExtension struct {
+	Text   string          `json:"text"`
+	Object json.RawMessage `json:"object"`
+}
+
+func newQueryPlanExtension(qp *plan.QueryPlan) (*queryPlanExtension, error) {
+	object, err := json.Marshal(qp)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	plan.NewFormatter(&buf).FormatQueryPlan(qp)
+
+	return &queryPlanExtension{
+		Text:   buf.String(),
+		Object: object,
+	}, nil
+}
+
+// withQueryPlanExtension adds the query plan to the first response of the handler.
+func withQueryPlanExtension(handler graphql.ResponseHandler, ext *queryPlanExtension) graphql.ResponseHandler {
+	var added int32
+	return func(ctx context.Context) *graphql.Response {
+		resp := handler(ctx)
+		if resp != nil && atomic.CompareAndSwapInt32(&added, 0, 1) {
+			graphql.RegisterExtension(ctx, "queryPlan", ext)
+		}
+		return resp
+	}
+}
+
+// startRequestSpan starts the root span of the operation.
+// parsing and validation are already done by gqlgen, their spans are made from oc.Stats.
+func (g *gatewayImpl) startRequestSpan(ctx context.Context, oc *graphql.OperationContext) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("graphql.operation.type", string(oc.Operation.Operation)),
+	}
+	if oc.Operation.Name != "" {
+		attrs = append(attrs, attribute.String("graphql.operation.name", oc.Operation.Name))
+	}
+	opts := []trace.SpanStartOption{trace.WithAttributes(attrs...)}
+	if !oc.Stats.OperationStart.IsZero() {
+		opts = append(opts, trace.WithTimestamp(oc.Stats.OperationStart))
+	}
+
+	ctx, span := g.tracer.Start(ctx, "gateway.request", opts...)
+	g.recordTimingSpan(ctx, "gateway.parse", oc.Stats.Parsing)
+	g.recordTimingSpan(ctx, "gateway.validate", oc.Stats.Validation)
+
+	return ctx, span
+}
+
+func (g *gatewayImpl) recordTimingSpan(ctx context.Context, name string, timing graphql.TraceTiming) {
+	if timing.Start.IsZero() {
+		return
+	}
+
+	_, span := g.tracer.Start(ctx, name, trace.WithTimestamp(timing.Start))
+	span.End(trace.WithTimestamp(timing.End))
+}
+
+func (g *gatewayImpl) getQueryPlan(ctx context.Context, composedSchema *planner.ComposedSchema, queryPlanCache *lru.Cache[string, *plan.QueryPlan], oc *graphql.OperationContext) (*plan.QueryPlan, error) {
+	ctx, span := g.tracer.Start(ctx, "gateway.plan")
+	defer span.End()
+
+	var cacheHit bool
+	if g.metrics != nil {
+		start := time.Now()
+		defer func() {
+			g.metrics.ObservePlanning(time.Since(start), cacheHit)
+		}()
+	}
+
+	var cacheKey string
+	if queryPlanCache != nil {
+		cacheKey = queryPlanCacheKey(oc.Doc, oc.OperationName)
+		qp, ok := queryPlanCache.Get(cacheKey)
+		span.SetAttributes(attribute.Bool("fedeway.query_plan_cache.hit", ok))
+		if ok {
+			cacheHit = true
+			atomic.AddUint64(&g.queryPlanCacheHits, 1)
+			return qp, nil
+		}
+		atomic.AddUint64(&g.queryPlanCacheMisses, 1)
+	}
+
+	opctx, err := planner.BuildOperationContext(ctx, composedSchema, oc.Doc, oc.OperationName)
+	if err != nil {
+		return nil, err
+	}
+
+	qp, err := planner.BuildQueryPlan(ctx, opctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if queryPlanCache != nil {
+		queryPlanCache.Add(cacheKey, qp)
+	}
+
+	return qp, nil
+}
+
+// queryPlanCacheKey makes a key from the normalized document.
+// whitespaces and comments in the original query string are not affected to the key.
+func queryPlanCacheKey(doc *ast.QueryDocument, operationName string) string {
+	var buf bytes.Buffer
+	buf.WriteString(operationName)
+	buf.WriteString("\n")
+	formatter.NewFormatter(&buf).FormatQueryDocument(doc)
+
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+func (g *gatewayImpl) QueryPlanCacheStats() QueryPlanCacheStats {
+	g.RLock()
+	queryPlanCache := g.queryPlanCache
+	g.RUnlock()
+
+	stats := QueryPlanCacheStats{
+		Hits:   atomic.LoadUint64(&g.queryPlanCacheHits),
+		Misses: atomic.LoadUint64(&g.queryPlanCacheMisses),
+	}
+	if queryPlanCache != nil {
+		stats.Len = queryPlanCache.Len()
+	}
+
+	return stats
+}
+
+func (g *gatewayImpl) CircuitBreakerStates() map[string]CircuitState {
+	g.RLock()
+	breakers := g.breakers
+	g.RUnlock()
+
+	states := make(map[string]CircuitState, len(breakers))
+	for serviceName, breaker := range breakers {
+		states[serviceName] = breaker.State()
+	}
+
+	return states
+}
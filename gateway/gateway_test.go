@@ -0,0 +1,1231 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/executor"
+	"github.com/go-logr/logr/funcr"
+	testlogr "github.com/go-logr/logr/testing"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"github.com/vvakame/fedeway/internal/engine"
+	"github.com/vvakame/fedeway/internal/log"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var _ DataSource = (*sdlDataSource)(nil)
+
+// sdlDataSource responds to `{ _service { sdl } }`.
+// other operations get `{ "hello": "world" }`.
+type sdlDataSource struct {
+	mu  sync.Mutex
+	sdl string
+	err error
+}
+
+func (ds *sdlDataSource) set(sdl string, err error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	ds.sdl = sdl
+	ds.err = err
+}
+
+func (ds *sdlDataSource) Process(ctx context.Context, oc *graphql.OperationContext) *graphql.Response {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.err != nil {
+		return &graphql.Response{Errors: gqlerror.List{gqlerror.Errorf("%s", ds.err.Error())}}
+	}
+
+	var data interface{} = map[string]interface{}{
+		"hello": "world",
+	}
+	if oc.Operation.SelectionSet[0].(*ast.Field).Name == "_service" {
+		data = map[string]interface{}{
+			"_service": map[string]interface{}{
+				"sdl": ds.sdl,
+			},
+		}
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+
+	return &graphql.Response{Data: b}
+}
+
+var _ DataSource = (*faultyDataSource)(nil)
+
+// faultyDataSource returns an error for `secret` and panics for `boom`.
+type faultyDataSource struct {
+	sdlDataSource
+}
+
+func (ds *faultyDataSource) Process(ctx context.Context, oc *graphql.OperationContext) *graphql.Response {
+	switch oc.Operation.SelectionSet[0].(*ast.Field).Name {
+	case "secret":
+		return &graphql.Response{Errors: gqlerror.List{gqlerror.Errorf("password is hunter2")}}
+	case "boom":
+		panic("boom")
+	}
+
+	return ds.sdlDataSource.Process(ctx, oc)
+}
+
+func TestNewGatewayPollInterval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	ds := &sdlDataSource{}
+	ds.set(`type Query { hello: String }`, nil)
+
+	updateErrs := make(chan error, 10)
+	gw, err := NewGateway(ctx, &GatewayConfig{
+		ServiceDefinitions: []*ServiceDefinition{
+			{
+				Name:       "hello",
+				DataSource: ds,
+			},
+		},
+		PollInterval: 10 * time.Millisecond,
+		OnSchemaUpdateError: func(ctx context.Context, err error) {
+			select {
+			case updateErrs <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor := func(cond func() bool) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if gw.Schema().Query.Fields.ForName("hello") == nil {
+		t.Fatal("Query.hello is not found")
+	}
+
+	ds.set(`type Query { hello: String world: String }`, nil)
+	waitFor(func() bool {
+		return gw.Schema().Query.Fields.ForName("world") != nil
+	})
+
+	ds.set("", errors.New("subgraph is unavailable"))
+	select {
+	case err := <-updateErrs:
+		t.Log(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnSchemaUpdateError is not called")
+	}
+
+	if gw.Schema().Query.Fields.ForName("world") == nil {
+		t.Fatal("last good schema is not kept")
+	}
+}
+
+func TestNewGatewayPollCompositionFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// NOTE OnSchemaUpdateError isn't given, the failure goes to the logger
+	logged := make(chan string, 10)
+	ctx = log.WithLogger(ctx, funcr.New(func(prefix, args string) {
+		t.Log(prefix, args)
+		select {
+		case logged <- args:
+		default:
+		}
+	}, funcr.Options{}))
+
+	ds := &sdlDataSource{}
+	ds.set(`type Query { hello: String }`, nil)
+
+	gw, err := NewGateway(ctx, &GatewayConfig{
+		ServiceDefinitions: []*ServiceDefinition{
+			{
+				Name:       "hello",
+				DataSource: ds,
+			},
+		},
+		PollInterval:       10 * time.Millisecond,
+		QueryPlanCacheSize: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exec := executor.New(gw)
+	execQuery := func(query string) {
+		t.Helper()
+
+		ctx := graphql.StartOperationTrace(ctx)
+		oc, gErrs := exec.CreateOperationContext(ctx, &graphql.RawParams{Query: query})
+		if len(gErrs) != 0 {
+			t.Fatal(gErrs)
+		}
+		handler, ctx := exec.DispatchOperation(ctx, oc)
+		resp := handler(ctx)
+		if len(resp.Errors) != 0 {
+			t.Fatal(resp.Errors)
+		}
+		if v := string(resp.Data); v != `{"hello":"world"}` {
+			t.Errorf("unexpected response: %s", v)
+		}
+	}
+
+	execQuery(`{ hello }`)
+
+	// the SDL is fetched but can't be composed
+	ds.set(`type Query { hello: Unknown }`, nil)
+	deadline := time.After(5 * time.Second)
+	for found := false; !found; {
+		select {
+		case args := <-logged:
+			found = strings.Contains(args, "failed to update supergraph")
+		case <-deadline:
+			t.Fatal("the composition failure is not logged")
+		}
+	}
+
+	if gw.Schema().Query.Fields.ForName("hello") == nil {
+		t.Fatal("last good schema is not kept")
+	}
+	execQuery(`{ hello }`)
+	if v := gw.QueryPlanCacheStats(); v.Hits != 1 || v.Len != 1 {
+		t.Errorf("query plan cache is not kept: %+v", v)
+	}
+}
+
+func TestNewGatewaySupergraphSDL(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	ds := &sdlDataSource{}
+	ds.set(`type Query { hello: String }`, nil)
+
+	gw, err := NewGateway(ctx, &GatewayConfig{
+		ServiceDefinitions: []*ServiceDefinition{
+			{
+				Name:       "hello",
+				URL:        "http://hello.example.com/graphql",
+				DataSource: ds,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	supergraphSDL := gw.(*gatewayImpl).supergraphSDL
+
+	supergraphSDLFile := filepath.Join(t.TempDir(), "supergraph.graphql")
+	err = os.WriteFile(supergraphSDLFile, []byte(supergraphSDL), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfgs := map[string]*GatewayConfig{
+		"SupergraphSDL": {
+			SupergraphSDL: supergraphSDL,
+		},
+		"SupergraphSDLFile": {
+			SupergraphSDLFile: supergraphSDLFile,
+		},
+	}
+	for name, cfg := range cfgs {
+		t.Run(name, func(t *testing.T) {
+			gw, err := NewGateway(ctx, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if gw.Schema().Query.Fields.ForName("hello") == nil {
+				t.Fatal("Query.hello is not found")
+			}
+
+			rds, ok := gw.(*gatewayImpl).serviceMap["hello"].(*engine.RemoteDataSource)
+			if !ok {
+				t.Fatalf("unexpected data source type: %T", gw.(*gatewayImpl).serviceMap["hello"])
+			}
+			if v := rds.URL; v != "http://hello.example.com/graphql" {
+				t.Errorf("unexpected url: %s", v)
+			}
+		})
+	}
+
+	t.Run("ServiceDefinitions are preferred", func(t *testing.T) {
+		gw, err := NewGateway(ctx, &GatewayConfig{
+			ServiceDefinitions: []*ServiceDefinition{
+				{
+					Name:       "hello",
+					DataSource: ds,
+				},
+			},
+			SupergraphSDL: supergraphSDL,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v := gw.(*gatewayImpl).serviceMap["hello"]; v != ds {
+			t.Errorf("unexpected data source: %T", v)
+		}
+	})
+}
+
+func TestGatewayQueryPlanCache(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	ds := &sdlDataSource{}
+	ds.set(`type Query { hello: String }`, nil)
+
+	gw, err := NewGateway(ctx, &GatewayConfig{
+		ServiceDefinitions: []*ServiceDefinition{
+			{
+				Name:       "hello",
+				DataSource: ds,
+			},
+		},
+		QueryPlanCacheSize: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exec := executor.New(gw)
+	execQuery := func(query string) {
+		t.Helper()
+
+		ctx := graphql.StartOperationTrace(ctx)
+		oc, gErrs := exec.CreateOperationContext(ctx, &graphql.RawParams{Query: query})
+		if len(gErrs) != 0 {
+			t.Fatal(gErrs)
+		}
+		handler, ctx := exec.DispatchOperation(ctx, oc)
+		resp := handler(ctx)
+		if len(resp.Errors) != 0 {
+			t.Fatal(resp.Errors)
+		}
+		if v := string(resp.Data); v != `{"hello":"world"}` {
+			t.Errorf("unexpected response: %s", v)
+		}
+	}
+	checkStats := func(expected QueryPlanCacheStats) {
+		t.Helper()
+
+		if v := gw.QueryPlanCacheStats(); v != expected {
+			t.Errorf("unexpected stats: %+v, expected: %+v", v, expected)
+		}
+	}
+
+	execQuery(`{ hello }`)
+	checkStats(QueryPlanCacheStats{Hits: 0, Misses: 1, Len: 1})
+
+	// same document after normalization
+	execQuery("query {\n  # comment\n  hello\n}")
+	checkStats(QueryPlanCacheStats{Hits: 1, Misses: 1, Len: 1})
+
+	execQuery(`query Hello { hello }`)
+	checkStats(QueryPlanCacheStats{Hits: 1, Misses: 2, Len: 2})
+
+	// schema swap invalidates the cache
+	ds.set(`type Query { hello: String world: String }`, nil)
+	err = gw.(*gatewayImpl).updateSchema(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStats(QueryPlanCacheStats{Hits: 1, Misses: 2, Len: 0})
+
+	execQuery(`{ hello }`)
+	checkStats(QueryPlanCacheStats{Hits: 1, Misses: 3, Len: 1})
+}
+
+func TestGatewayErrorPresenterAndRecoverFunc(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	ds := &faultyDataSource{}
+	ds.set(`type Query { hello: String secret: String boom: String }`, nil)
+
+	var mu sync.Mutex
+	var recovered []interface{}
+	cfg := &GatewayConfig{
+		ServiceDefinitions: []*ServiceDefinition{
+			{
+				Name:       "faulty",
+				URL:        "http://faulty.example.com/graphql",
+				DataSource: ds,
+			},
+		},
+		ErrorPresenter: func(ctx context.Context, err error) *gqlerror.Error {
+			return &gqlerror.Error{
+				Message:    "internal error",
+				Extensions: map[string]interface{}{"code": "INTERNAL_SERVER_ERROR"},
+			}
+		},
+		RecoverFunc: func(ctx context.Context, err interface{}) error {
+			mu.Lock()
+			defer mu.Unlock()
+			recovered = append(recovered, err)
+			return fmt.Errorf("panic: %v", err)
+		},
+	}
+	gw, err := NewGateway(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exec := executor.New(gw)
+	execQuery := func(query string) *graphql.Response {
+		t.Helper()
+
+		ctx := graphql.StartOperationTrace(ctx)
+		oc, gErrs := exec.CreateOperationContext(ctx, &graphql.RawParams{Query: query})
+		if len(gErrs) != 0 {
+			t.Fatal(gErrs)
+		}
+		handler, ctx := exec.DispatchOperation(ctx, oc)
+		return handler(ctx)
+	}
+	checkMasked := func(resp *graphql.Response) {
+		t.Helper()
+
+		if len(resp.Errors) != 1 {
+			t.Fatalf("unexpected errors: %v", resp.Errors)
+		}
+		if v := resp.Errors[0].Message; v != "internal error" {
+			t.Errorf("unexpected message: %s", v)
+		}
+		if v := resp.Errors[0].Extensions["code"]; v != "INTERNAL_SERVER_ERROR" {
+			t.Errorf("unexpected code: %v", v)
+		}
+	}
+
+	checkMasked(execQuery(`{ secret }`))
+
+	checkMasked(execQuery(`{ boom }`))
+	if len(recovered) != 1 || recovered[0] != "boom" {
+		t.Errorf("unexpected recovered values: %v", recovered)
+	}
+
+	t.Run("data sources are not modified", func(t *testing.T) {
+		rds := &engine.RemoteDataSource{URL: "http://faulty.example.com/graphql"}
+		_, err := NewGateway(ctx, &GatewayConfig{
+			SupergraphSDL: gw.(*gatewayImpl).supergraphSDL,
+			ServiceDefinitions: []*ServiceDefinition{
+				{
+					Name:       "faulty",
+					DataSource: rds,
+				},
+			},
+			ErrorPresenter: cfg.ErrorPresenter,
+			RecoverFunc:    cfg.RecoverFunc,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rds.ErrorPresenter != nil {
+			t.Error("ErrorPresenter is set")
+		}
+		if rds.RecoverFunc != nil {
+			t.Error("RecoverFunc is set")
+		}
+	})
+
+	t.Run("network errors are presented once", func(t *testing.T) {
+		s := httptest.NewServer(http.NotFoundHandler())
+		s.Close()
+
+		var mu sync.Mutex
+		var presented int
+		gw, err := NewGateway(ctx, &GatewayConfig{
+			SupergraphSDL: strings.ReplaceAll(gw.(*gatewayImpl).supergraphSDL, "http://faulty.example.com/graphql", s.URL),
+			ErrorPresenter: func(ctx context.Context, err error) *gqlerror.Error {
+				mu.Lock()
+				defer mu.Unlock()
+				presented++
+				return &gqlerror.Error{Message: "masked: " + err.Error()}
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exec := executor.New(gw)
+		ctx := graphql.StartOperationTrace(ctx)
+		oc, gErrs := exec.CreateOperationContext(ctx, &graphql.RawParams{Query: `{ hello }`})
+		if len(gErrs) != 0 {
+			t.Fatal(gErrs)
+		}
+		handler, ctx := exec.DispatchOperation(ctx, oc)
+		resp := handler(ctx)
+		if len(resp.Errors) != 1 {
+			t.Fatalf("unexpected errors: %v", resp.Errors)
+		}
+		if v := resp.Errors[0].Message; strings.Count(v, "masked: ") != 1 {
+			t.Errorf("unexpected message: %s", v)
+		}
+		if presented != 1 {
+			t.Errorf("unexpected presented count: %d", presented)
+		}
+	})
+}
+
+func TestGatewayWillSendRequest(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	receivedHeaders := make(chan http.Header, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := &graphql.RawParams{}
+		err := json.NewDecoder(r.Body).Decode(params)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		var data interface{} = map[string]interface{}{
+			"hello": "world",
+		}
+		if strings.Contains(params.Query, "_service") {
+			data = map[string]interface{}{
+				"_service": map[string]interface{}{
+					"sdl": `type Query { hello: String }`,
+				},
+			}
+		} else {
+			receivedHeaders <- r.Header.Clone()
+		}
+		err = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	defer s.Close()
+
+	gw, err := NewGateway(ctx, &GatewayConfig{
+		ServiceDefinitions: []*ServiceDefinition{
+			{
+				Name: "hello",
+				URL:  s.URL,
+				WillSendRequest: func(ctx context.Context, req *http.Request, oc *graphql.OperationContext) {
+					// propagates only the needed one
+					if v := RequestHeaders(ctx).Get("Authorization"); v != "" {
+						req.Header.Set("Authorization", v)
+					}
+					req.Header.Set("X-Operation", oc.Operation.SelectionSet[0].(*ast.Field).Name)
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exec := executor.New(gw)
+	ctx = graphql.StartOperationTrace(ctx)
+	oc, gErrs := exec.CreateOperationContext(ctx, &graphql.RawParams{
+		Query: `{ hello }`,
+		Headers: http.Header{
+			"Authorization": []string{"Bearer token"},
+			"Cookie":        []string{"secret=1"},
+		},
+	})
+	if len(gErrs) != 0 {
+		t.Fatal(gErrs)
+	}
+	handler, ctx := exec.DispatchOperation(ctx, oc)
+	resp := handler(ctx)
+	if len(resp.Errors) != 0 {
+		t.Fatal(resp.Errors)
+	}
+
+	header := <-receivedHeaders
+	if v := header.Get("Authorization"); v != "Bearer token" {
+		t.Errorf("unexpected Authorization: %s", v)
+	}
+	if v := header.Get("Cookie"); v != "" {
+		t.Errorf("unexpected Cookie: %s", v)
+	}
+	if v := header.Get("X-Operation"); v != "hello" {
+		t.Errorf("unexpected X-Operation: %s", v)
+	}
+}
+
+func TestGatewayRetry(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	var mu sync.Mutex
+	var requests int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := &graphql.RawParams{}
+		err := json.NewDecoder(r.Body).Decode(params)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		var data interface{} = map[string]interface{}{
+			"hello": "world",
+		}
+		if strings.Contains(params.Query, "_service") {
+			data = map[string]interface{}{
+				"_service": map[string]interface{}{
+					"sdl": `type Query { hello: String }`,
+				},
+			}
+		} else {
+			mu.Lock()
+			requests++
+			first := requests == 1
+			mu.Unlock()
+			if first {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		err = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	defer s.Close()
+
+	rds := &engine.RemoteDataSource{URL: s.URL}
+	gw, err := NewGateway(ctx, &GatewayConfig{
+		ServiceDefinitions: []*ServiceDefinition{
+			{
+				Name:       "hello",
+				DataSource: rds,
+				Retry: &RetryPolicy{
+					InitialBackoff: time.Millisecond,
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NOTE the retry is configured to the copy owned by the gateway
+	if rds.Retry != nil {
+		t.Errorf("the data source of the config is modified: %+v", rds.Retry)
+	}
+
+	exec := executor.New(gw)
+	ctx = graphql.StartOperationTrace(ctx)
+	oc, gErrs := exec.CreateOperationContext(ctx, &graphql.RawParams{
+		Query: `{ hello }`,
+	})
+	if len(gErrs) != 0 {
+		t.Fatal(gErrs)
+	}
+	handler, ctx := exec.DispatchOperation(ctx, oc)
+	resp := handler(ctx)
+	if len(resp.Errors) != 0 {
+		t.Fatal(resp.Errors)
+	}
+	if v := string(resp.Data); v != `{"hello":"world"}` {
+		t.Errorf("unexpected data: %s", v)
+	}
+	mu.Lock()
+	if requests != 2 {
+		t.Errorf("unexpected requests: %d", requests)
+	}
+	mu.Unlock()
+}
+
+func TestGatewayCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	ds := &faultyDataSource{}
+	ds.set(`type Query { hello: String secret: String boom: String }`, nil)
+
+	gw, err := NewGateway(ctx, &GatewayConfig{
+		ServiceDefinitions: []*ServiceDefinition{
+			{
+				Name:       "faulty",
+				DataSource: ds,
+			},
+		},
+		CircuitBreaker: &CircuitBreakerConfig{
+			FailureThreshold: 2,
+			OpenDuration:     time.Hour,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exec := executor.New(gw)
+	execQuery := func(query string) *graphql.Response {
+		t.Helper()
+
+		ctx := graphql.StartOperationTrace(ctx)
+		oc, gErrs := exec.CreateOperationContext(ctx, &graphql.RawParams{Query: query})
+		if len(gErrs) != 0 {
+			t.Fatal(gErrs)
+		}
+		handler, ctx := exec.DispatchOperation(ctx, oc)
+		return handler(ctx)
+	}
+	checkState := func(expected CircuitState) {
+		t.Helper()
+
+		if v := gw.CircuitBreakerStates()["faulty"]; v != expected {
+			t.Errorf("unexpected state: %s, expected: %s", v, expected)
+		}
+	}
+
+	execQuery(`{ hello }`)
+	checkState(CircuitClosed)
+
+	for i := 0; i < 2; i++ {
+		resp := execQuery(`{ secret }`)
+		if v := resp.Errors[0].Extensions["code"]; v != "DOWNSTREAM_SERVICE_ERROR" {
+			t.Errorf("unexpected code: %v", v)
+		}
+	}
+	checkState(CircuitOpen)
+
+	// fails fast even for the healthy field
+	resp := execQuery(`{ hello }`)
+	if len(resp.Errors) != 1 {
+		t.Fatalf("unexpected errors: %v", resp.Errors)
+	}
+	if v := resp.Errors[0].Extensions["code"]; v != "CIRCUIT_BREAKER_OPEN" {
+		t.Errorf("unexpected code: %v", v)
+	}
+
+	// the state is kept over schema swaps
+	ds.set(`type Query { hello: String secret: String boom: String world: String }`, nil)
+	err = gw.(*gatewayImpl).updateSchema(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkState(CircuitOpen)
+}
+
+func TestGatewayQueryPlanExposure(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	tests := []struct {
+		name            string
+		exposure        QueryPlanExposure
+		header          string
+		expectQueryPlan bool
+		expectFetches   bool
+		expectedData    string
+	}{
+		{
+			name:         "default",
+			header:       "include",
+			expectedData: `{"hello":"world"}`,
+		},
+		{
+			name:         "on request without header",
+			exposure:     QueryPlanExposureOnRequest,
+			expectedData: `{"hello":"world"}`,
+		},
+		{
+			name:            "on request with header",
+			exposure:        QueryPlanExposureOnRequest,
+			header:          "include",
+			expectQueryPlan: true,
+			expectedData:    `{"hello":"world"}`,
+		},
+		{
+			name:            "plan only",
+			exposure:        QueryPlanExposureOnRequest,
+			header:          QueryPlanOnly,
+			expectQueryPlan: true,
+			expectedData:    `null`,
+		},
+		{
+			name:            "analyze",
+			exposure:        QueryPlanExposureOnRequest,
+			header:          QueryPlanAnalyze,
+			expectQueryPlan: true,
+			expectFetches:   true,
+			expectedData:    `{"hello":"world"}`,
+		},
+		{
+			name:            "always",
+			exposure:        QueryPlanExposureAlways,
+			expectQueryPlan: true,
+			expectedData:    `{"hello":"world"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &sdlDataSource{}
+			ds.set(`type Query { hello: String }`, nil)
+
+			gw, err := NewGateway(ctx, &GatewayConfig{
+				ServiceDefinitions: []*ServiceDefinition{
+					{
+						Name:       "hello",
+						DataSource: ds,
+					},
+				},
+				QueryPlanExposure: tt.exposure,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			header := http.Header{}
+			if tt.header != "" {
+				header.Set(QueryPlanHeader, tt.header)
+			}
+
+			exec := executor.New(gw)
+			ctx := graphql.StartOperationTrace(ctx)
+			oc, gErrs := exec.CreateOperationContext(ctx, &graphql.RawParams{
+				Query:   `{ hello }`,
+				Headers: header,
+			})
+			if len(gErrs) != 0 {
+				t.Fatal(gErrs)
+			}
+			handler, ctx := exec.DispatchOperation(ctx, oc)
+			resp := handler(ctx)
+			if len(resp.Errors) != 0 {
+				t.Fatal(resp.Errors)
+			}
+
+			b, err := json.Marshal(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var v struct {
+				Data       json.RawMessage `json:"data"`
+				Extensions struct {
+					QueryPlan *struct {
+						Text   string          `json:"text"`
+						Object json.RawMessage `json:"object"`
+					} `json:"queryPlan"`
+					Fetches []*FetchDiagnostic `json:"fetches"`
+				} `json:"extensions"`
+			}
+			err = json.Unmarshal(b, &v)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if v := string(v.Data); v != tt.expectedData {
+				t.Errorf("unexpected data: %s", v)
+			}
+			if tt.expectFetches {
+				if len(v.Extensions.Fetches) != 1 || v.Extensions.Fetches[0].ServiceName != "hello" {
+					t.Errorf("unexpected fetches: %s", b)
+				}
+			} else if v.Extensions.Fetches != nil {
+				t.Errorf("unexpected fetches: %s", b)
+			}
+			if !tt.expectQueryPlan {
+				if v.Extensions.QueryPlan != nil {
+					t.Errorf("unexpected query plan: %s", b)
+				}
+				return
+			}
+			if v.Extensions.QueryPlan == nil {
+				t.Fatalf("query plan is missing: %s", b)
+			}
+			if v := v.Extensions.QueryPlan.Text; !strings.Contains(v, `Fetch(service: "hello")`) {
+				t.Errorf("unexpected text: %s", v)
+			}
+			if v := string(v.Extensions.QueryPlan.Object); v != `{"kind":"QueryPlan","node":{"kind":"Fetch","serviceName":"hello","variableUsages":[],"operation":"query {\n\thello\n}\n"}}` {
+				t.Errorf("unexpected object: %s", v)
+			}
+		})
+	}
+}
+
+var _ engine.SubscriptionDataSource = (*subscriptionDataSource)(nil)
+
+// subscriptionDataSource sends `{ "count": n }` for each n up to events.
+type subscriptionDataSource struct {
+	sdlDataSource
+	events int
+}
+
+func (ds *subscriptionDataSource) Subscribe(ctx context.Context, oc *graphql.OperationContext) graphql.ResponseHandler {
+	var n int
+	return func(ctx context.Context) *graphql.Response {
+		if n >= ds.events {
+			return nil
+		}
+		n++
+		return &graphql.Response{Data: []byte(fmt.Sprintf(`{"count":%d}`, n))}
+	}
+}
+
+func TestGatewaySubscription(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	ds := &subscriptionDataSource{events: 2}
+	ds.set(`type Query { hello: String } type Subscription { count: Int }`, nil)
+
+	gw, err := NewGateway(ctx, &GatewayConfig{
+		ServiceDefinitions: []*ServiceDefinition{
+			{
+				Name:       "counter",
+				DataSource: ds,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exec := executor.New(gw)
+	ctx = graphql.StartOperationTrace(ctx)
+	oc, gErrs := exec.CreateOperationContext(ctx, &graphql.RawParams{Query: `subscription { count }`})
+	if len(gErrs) != 0 {
+		t.Fatal(gErrs)
+	}
+	handler, ctx := exec.DispatchOperation(ctx, oc)
+
+	for i := 1; i <= ds.events; i++ {
+		resp := handler(ctx)
+		if resp == nil {
+			t.Fatalf("event %d is missing", i)
+		}
+		if len(resp.Errors) != 0 {
+			t.Fatal(resp.Errors)
+		}
+		if v := string(resp.Data); v != fmt.Sprintf(`{"count":%d}`, i) {
+			t.Errorf("unexpected data: %s", v)
+		}
+	}
+	if resp := handler(ctx); resp != nil {
+		t.Errorf("unexpected response: %v", resp)
+	}
+}
+
+func TestGatewayTracing(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	ds := &sdlDataSource{}
+	ds.set(`type Query { hello: String }`, nil)
+
+	recorder := tracetest.NewSpanRecorder()
+	gw, err := NewGateway(ctx, &GatewayConfig{
+		ServiceDefinitions: []*ServiceDefinition{
+			{
+				Name:       "hello",
+				DataSource: ds,
+			},
+		},
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exec := executor.New(gw)
+	ctx = graphql.StartOperationTrace(ctx)
+	oc, gErrs := exec.CreateOperationContext(ctx, &graphql.RawParams{Query: `query Hello { hello }`})
+	if len(gErrs) != 0 {
+		t.Fatal(gErrs)
+	}
+	handler, ctx := exec.DispatchOperation(ctx, oc)
+	resp := handler(ctx)
+	if len(resp.Errors) != 0 {
+		t.Fatal(resp.Errors)
+	}
+
+	// span name -> parent span name
+	spans := recorder.Ended()
+	names := make(map[string]string, len(spans))
+	for _, span := range spans {
+		names[span.SpanContext().SpanID().String()] = span.Name()
+	}
+	parents := make(map[string]string, len(spans))
+	for _, span := range spans {
+		parents[span.Name()] = names[span.Parent().SpanID().String()]
+	}
+	expected := map[string]string{
+		"gateway.request":        "",
+		"gateway.parse":          "gateway.request",
+		"gateway.validate":       "gateway.request",
+		"gateway.plan":           "gateway.request",
+		"gateway.execute":        "gateway.request",
+		"gateway.fetch":          "gateway.execute",
+		"gateway.postprocessing": "gateway.execute",
+	}
+	if !reflect.DeepEqual(parents, expected) {
+		t.Errorf("unexpected spans: %v", parents)
+	}
+
+	for _, span := range spans {
+		if span.Name() != "gateway.request" {
+			continue
+		}
+		if v := span.StartTime(); !v.Equal(oc.Stats.OperationStart) {
+			t.Errorf("unexpected start time: %v", v)
+		}
+		attrs := make(map[string]string)
+		for _, attr := range span.Attributes() {
+			attrs[string(attr.Key)] = attr.Value.Emit()
+		}
+		if !reflect.DeepEqual(attrs, map[string]string{"graphql.operation.type": "query", "graphql.operation.name": "Hello"}) {
+			t.Errorf("unexpected attributes: %v", attrs)
+		}
+	}
+}
+
+func TestGatewayTracingSubscription(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	ds := &subscriptionDataSource{events: 2}
+	ds.set(`type Query { hello: String } type Subscription { count: Int }`, nil)
+
+	recorder := tracetest.NewSpanRecorder()
+	gw, err := NewGateway(ctx, &GatewayConfig{
+		ServiceDefinitions: []*ServiceDefinition{
+			{
+				Name:       "counter",
+				DataSource: ds,
+			},
+		},
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exec := executor.New(gw)
+	ctx = graphql.StartOperationTrace(ctx)
+	oc, gErrs := exec.CreateOperationContext(ctx, &graphql.RawParams{Query: `subscription { count }`})
+	if len(gErrs) != 0 {
+		t.Fatal(gErrs)
+	}
+	handler, ctx := exec.DispatchOperation(ctx, oc)
+
+	spanNames := func() []string {
+		var names []string
+		for _, span := range recorder.Ended() {
+			names = append(names, span.Name())
+		}
+		return names
+	}
+
+	for i := 1; i <= ds.events; i++ {
+		resp := handler(ctx)
+		if resp == nil {
+			t.Fatalf("event %d is missing", i)
+		}
+		if v := string(resp.Data); v != fmt.Sprintf(`{"count":%d}`, i) {
+			t.Errorf("unexpected data: %s", v)
+		}
+		for _, name := range spanNames() {
+			if name == "gateway.request" {
+				t.Fatalf("request span ends before the subscription finishes")
+			}
+		}
+	}
+	if resp := handler(ctx); resp != nil {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+
+	spans := recorder.Ended()
+	var requestSpan sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		if span.Name() == "gateway.request" {
+			requestSpan = span
+		}
+	}
+	if requestSpan == nil {
+		t.Fatalf("request span isn't ended: %v", spanNames())
+	}
+	var executeSpans int
+	for _, span := range spans {
+		if span.Name() != "gateway.execute" {
+			continue
+		}
+		executeSpans++
+		if v := span.Parent().SpanID(); v != requestSpan.SpanContext().SpanID() {
+			t.Errorf("unexpected parent of event: %s", v)
+		}
+		if span.EndTime().After(requestSpan.EndTime()) {
+			t.Errorf("event ends after the request span")
+		}
+	}
+	if executeSpans != ds.events {
+		t.Errorf("unexpected spans: %v", spanNames())
+	}
+}
+
+func TestGatewayFederatedTraceSink(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	ds := &sdlDataSource{}
+	ds.set(`type Query { hello: String }`, nil)
+
+	file := filepath.Join(t.TempDir(), "traces.jsonl")
+	sink, err := NewFileTraceSink(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := NewGateway(ctx, &GatewayConfig{
+		ServiceDefinitions: []*ServiceDefinition{
+			{
+				Name:       "hello",
+				DataSource: ds,
+			},
+		},
+		FederatedTraceSink: sink,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exec := executor.New(gw)
+	ctx = graphql.StartOperationTrace(ctx)
+	oc, gErrs := exec.CreateOperationContext(ctx, &graphql.RawParams{Query: `query Hello { hello }`})
+	if len(gErrs) != 0 {
+		t.Fatal(gErrs)
+	}
+	handler, ctx := exec.DispatchOperation(ctx, oc)
+	resp := handler(ctx)
+	if len(resp.Errors) != 0 {
+		t.Fatal(resp.Errors)
+	}
+	err = sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v struct {
+		OperationName string `json:"operationName"`
+		Trace         struct {
+			QueryPlan struct {
+				Fetch struct {
+					ServiceName string `json:"serviceName"`
+				} `json:"fetch"`
+			} `json:"queryPlan"`
+		} `json:"trace"`
+	}
+	err = json.Unmarshal(b, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.OperationName != "Hello" || v.Trace.QueryPlan.Fetch.ServiceName != "hello" {
+		t.Errorf("unexpected trace: %s", b)
+	}
+}
+
+var _ Metrics = (*testMetrics)(nil)
+
+type testMetrics struct {
+	mu         sync.Mutex
+	operations []string
+	planning   []bool
+	fetches    []string
+}
+
+func (m *testMetrics) ObserveOperation(operationName string, operationType string, errors int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.operations = append(m.operations, fmt.Sprintf("%s %s errors=%d", operationType, operationName, errors))
+}
+
+func (m *testMetrics) ObservePlanning(duration time.Duration, cacheHit bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.planning = append(m.planning, cacheHit)
+}
+
+func (m *testMetrics) ObserveFetch(serviceName string, duration time.Duration, entities int, errors int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.fetches = append(m.fetches, fmt.Sprintf("%s entities=%d errors=%d", serviceName, entities, errors))
+}
+
+func TestGatewayMetrics(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	ds := &faultyDataSource{}
+	ds.set(`type Query { hello: String secret: String }`, nil)
+
+	metrics := &testMetrics{}
+	gw, err := NewGateway(ctx, &GatewayConfig{
+		ServiceDefinitions: []*ServiceDefinition{
+			{
+				Name:       "hello",
+				DataSource: ds,
+			},
+		},
+		QueryPlanCacheSize: 10,
+		Metrics:            metrics,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exec := executor.New(gw)
+	for _, query := range []string{`query Hello { hello }`, `query Hello { hello }`, `{ secret }`} {
+		ctx := graphql.StartOperationTrace(ctx)
+		oc, gErrs := exec.CreateOperationContext(ctx, &graphql.RawParams{Query: query})
+		if len(gErrs) != 0 {
+			t.Fatal(gErrs)
+		}
+		handler, ctx := exec.DispatchOperation(ctx, oc)
+		handler(ctx)
+	}
+
+	if expected := []string{"query Hello errors=0", "query Hello errors=0", "query  errors=1"}; !reflect.DeepEqual(metrics.operations, expected) {
+		t.Errorf("unexpected operations: %v", metrics.operations)
+	}
+	if expected := []bool{false, true, false}; !reflect.DeepEqual(metrics.planning, expected) {
+		t.Errorf("unexpected planning: %v", metrics.planning)
+	}
+	if expected := []string{"hello entities=0 errors=0", "hello entities=0 errors=0", "hello entities=0 errors=1"}; !reflect.DeepEqual(metrics.fetches, expected) {
+		t.Errorf("unexpected fetches: %v", metrics.fetches)
+	}
+}
@@ -0,0 +1,288 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vvakame/fedeway/internal/engine"
+)
+
+type HeaderAction string
+
+const (
+	// HeaderActionPropagate copies headers specified by Named or Matching. Rename is available with Named.
+	HeaderActionPropagate HeaderAction = "propagate"
+	// HeaderActionInsert sets Value to the header specified by Named.
+	HeaderActionInsert HeaderAction = "insert"
+	// HeaderActionRemove removes headers specified by Named or Matching.
+	HeaderActionRemove HeaderAction = "remove"
+)
+
+// HeaderRules is the header policy for a subgraph. rules are applied in order.
+//
+// Request rules copy headers from the inbound request to the request to the subgraph.
+// Response rules copy headers from the response of the subgraph to the response of the gateway. responses discarded by retries are ignored.
+// the response of the gateway gets them only when the handler is wrapped by ResponseHeaderMiddleware.
+// both are used only by RemoteDataSource.
+type HeaderRules struct {
+	Request  []*HeaderRule `json:"request,omitempty"`
+	Response []*HeaderRule `json:"response,omitempty"`
+}
+
+type HeaderRule struct {
+	Action   HeaderAction `json:"action"`
+	Named    string       `json:"named,omitempty"`
+	Matching string       `json:"matching,omitempty"` // regexp for header names. e.g. "^X-Tenant-"
+	Rename   string       `json:"rename,omitempty"`
+	Value    string       `json:"value,omitempty"`
+}
+
+// reservedHeaders are never propagated. they are about the connection or the body of each side.
+var reservedHeaders = map[string]bool{
+	"Accept":              true,
+	"Accept-Encoding":     true,
+	"Connection":          true,
+	"Content-Encoding":    true,
+	"Content-Length":      true,
+	"Content-Type":        true,
+	"Host":                true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+type compiledHeaderRule struct {
+	action   HeaderAction
+	named    string
+	matching *regexp.Regexp
+	rename   string
+	value    string
+}
+
+func compileHeaderRules(rules []*HeaderRule) ([]*compiledHeaderRule, error) {
+	compiled := make([]*compiledHeaderRule, 0, len(rules))
+	for idx, rule := range rules {
+		c := &compiledHeaderRule{
+			action: rule.Action,
+			named:  http.CanonicalHeaderKey(rule.Named),
+			rename: http.CanonicalHeaderKey(rule.Rename),
+			value:  rule.Value,
+		}
+		if rule.Matching != "" {
+			re, err := regexp.Compile(rule.Matching)
+			if err != nil {
+				return nil, fmt.Errorf("header rule #%d: %w", idx, err)
+			}
+			c.matching = re
+		}
+
+		switch {
+		case rule.Action != HeaderActionPropagate && rule.Action != HeaderActionInsert && rule.Action != HeaderActionRemove:
+			return nil, fmt.Errorf(`header rule #%d: unknown action "%s"`, idx, rule.Action)
+		case (c.named == "") == (c.matching == nil) && rule.Action != HeaderActionInsert:
+			return nil, fmt.Errorf("header rule #%d: either named or matching is required", idx)
+		case rule.Action == HeaderActionInsert && (c.named == "" || c.matching != nil):
+			return nil, fmt.Errorf("header rule #%d: insert requires named only", idx)
+		case c.rename != "" && (rule.Action != HeaderActionPropagate || c.named == ""):
+			return nil, fmt.Errorf("header rule #%d: rename is available only with propagate and named", idx)
+		}
+
+		compiled = append(compiled, c)
+	}
+
+	return compiled, nil
+}
+
+// applyHeaderRules applies rules from src to dst. src may be nil.
+func applyHeaderRules(rules []*compiledHeaderRule, src, dst http.Header) {
+	for _, rule := range rules {
+		switch rule.action {
+		case HeaderActionPropagate:
+			if rule.named != "" {
+				if reservedHeaders[rule.named] {
+					continue
+				}
+				values := src.Values(rule.named)
+				if len(values) == 0 {
+					continue
+				}
+				name := rule.named
+				if rule.rename != "" {
+					name = rule.rename
+				}
+				dst[name] = append([]string(nil), values...)
+				continue
+			}
+			for name, values := range src {
+				if reservedHeaders[name] || !rule.matching.MatchString(name) {
+					continue
+				}
+				dst[name] = append([]string(nil), values...)
+			}
+		case HeaderActionInsert:
+			dst.Set(rule.named, rule.value)
+		case HeaderActionRemove:
+			if rule.named != "" {
+				dst.Del(rule.named)
+				continue
+			}
+			for name := range dst {
+				if rule.matching.MatchString(name) {
+					delete(dst, name)
+				}
+			}
+		}
+	}
+}
+
+// configureHeaderRules sets hooks to the RemoteDataSource to apply the rules. rds must be the copy owned by the gateway.
+// WillSendRequest of the service definition is called after the rules, and hooks the data source already has are called at last.
+func configureHeaderRules(rds *engine.RemoteDataSource, headers *HeaderRules, willSendRequest WillSendRequestFunc) error {
+	var requestRules, responseRules []*compiledHeaderRule
+	if headers != nil {
+		var err error
+		requestRules, err = compileHeaderRules(headers.Request)
+		if err != nil {
+			return fmt.Errorf("request: %w", err)
+		}
+		responseRules, err = compileHeaderRules(headers.Response)
+		if err != nil {
+			return fmt.Errorf("response: %w", err)
+		}
+	}
+
+	if len(requestRules) != 0 || willSendRequest != nil {
+		dsWillSendRequest := rds.WillSendRequest
+		rds.WillSendRequest = func(ctx context.Context, req *http.Request, oc *graphql.OperationContext) {
+			applyHeaderRules(requestRules, RequestHeaders(ctx), req.Header)
+			if willSendRequest != nil {
+				willSendRequest(ctx, req, oc)
+			}
+			if dsWillSendRequest != nil {
+				dsWillSendRequest(ctx, req, oc)
+			}
+		}
+	}
+	if len(responseRules) != 0 {
+		dsDidReceiveResponse := rds.DidReceiveResponse
+		rds.DidReceiveResponse = func(ctx context.Context, resp *http.Response, oc *graphql.OperationContext) {
+			if dsDidReceiveResponse != nil {
+				dsDidReceiveResponse(ctx, resp, oc)
+			}
+			collector := responseHeaderCollectorFromContext(ctx)
+			if collector == nil {
+				return
+			}
+			header := make(http.Header)
+			applyHeaderRules(responseRules, resp.Header, header)
+			collector.merge(header)
+		}
+	}
+
+	return nil
+}
+
+type responseHeaderCollectorKey struct{}
+
+// responseHeaderCollector collects headers from the responses of subgraphs. fetches may run in parallel.
+type responseHeaderCollector struct {
+	sync.Mutex
+	header http.Header
+}
+
+func responseHeaderCollectorFromContext(ctx context.Context) *responseHeaderCollector {
+	collector, _ := ctx.Value(responseHeaderCollectorKey{}).(*responseHeaderCollector)
+	return collector
+}
+
+func (c *responseHeaderCollector) merge(header http.Header) {
+	c.Lock()
+	defer c.Unlock()
+
+	for name, values := range header {
+	outer:
+		for _, value := range values {
+			// NOTE same header from multiple subgraphs is merged
+			for _, existing := range c.header[name] {
+				if existing == value {
+					continue outer
+				}
+			}
+			c.header[name] = append(c.header[name], value)
+		}
+	}
+}
+
+func (c *responseHeaderCollector) writeTo(header http.Header) {
+	c.Lock()
+	defer c.Unlock()
+
+	for name, values := range c.header {
+		header[name] = append(header[name], values...)
+	}
+}
+
+// ResponseHeaderMiddleware copies headers selected by the response rules of HeaderRules to the response of the gateway.
+// wrap the handler that serves the gateway.
+func ResponseHeaderMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		collector := &responseHeaderCollector{header: make(http.Header)}
+		ctx := context.WithValue(r.Context(), responseHeaderCollectorKey{}, collector)
+		next.ServeHTTP(&responseHeaderWriter{ResponseWriter: w, collector: collector}, r.WithContext(ctx))
+	})
+}
+
+// responseHeaderWriter writes the collected headers just before the response is started.
+type responseHeaderWriter struct {
+	http.ResponseWriter
+	collector   *responseHeaderCollector
+	wroteHeader bool
+}
+
+func (w *responseHeaderWriter) writeCollectedHeader() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.collector.writeTo(w.ResponseWriter.Header())
+}
+
+func (w *responseHeaderWriter) WriteHeader(statusCode int) {
+	w.writeCollectedHeader()
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *responseHeaderWriter) Write(b []byte) (int, error) {
+	w.writeCollectedHeader()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseHeaderWriter) Flush() {
+	w.writeCollectedHeader()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack is required by the websocket transport.
+func (w *responseHeaderWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T doesn't implement http.Hijacker", w.ResponseWriter)
+	}
+	return h.Hijack()
+}
+
+func (w *responseHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,361 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/handler"
+	testlogr "github.com/go-logr/logr/testing"
+	"github.com/vvakame/fedeway/internal/engine"
+	"github.com/vvakame/fedeway/internal/log"
+)
+
+func TestApplyHeaderRules(t *testing.T) {
+	src := http.Header{
+		"Authorization":  []string{"Bearer token"},
+		"X-Tenant-Id":    []string{"tenant"},
+		"X-Tenant-Group": []string{"a", "b"},
+		"Cookie":         []string{"secret=1"},
+		"Content-Type":   []string{"text/plain"},
+	}
+
+	tests := []struct {
+		name     string
+		rules    []*HeaderRule
+		expected http.Header
+	}{
+		{
+			name: "propagate named",
+			rules: []*HeaderRule{
+				{Action: HeaderActionPropagate, Named: "authorization"},
+				{Action: HeaderActionPropagate, Named: "X-Missing"},
+			},
+			expected: http.Header{
+				"Authorization": []string{"Bearer token"},
+			},
+		},
+		{
+			name: "propagate matching",
+			rules: []*HeaderRule{
+				{Action: HeaderActionPropagate, Matching: "^X-Tenant-"},
+			},
+			expected: http.Header{
+				"X-Tenant-Id":    []string{"tenant"},
+				"X-Tenant-Group": []string{"a", "b"},
+			},
+		},
+		{
+			name: "rename",
+			rules: []*HeaderRule{
+				{Action: HeaderActionPropagate, Named: "X-Tenant-Id", Rename: "X-Org-Id"},
+			},
+			expected: http.Header{
+				"X-Org-Id": []string{"tenant"},
+			},
+		},
+		{
+			name: "insert and remove",
+			rules: []*HeaderRule{
+				{Action: HeaderActionPropagate, Matching: ".*"},
+				{Action: HeaderActionInsert, Named: "X-Gateway", Value: "fedeway"},
+				{Action: HeaderActionRemove, Named: "Cookie"},
+				{Action: HeaderActionRemove, Matching: "^X-Tenant-G"},
+			},
+			expected: http.Header{
+				"Authorization": []string{"Bearer token"},
+				"X-Tenant-Id":   []string{"tenant"},
+				"X-Gateway":     []string{"fedeway"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := compileHeaderRules(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dst := make(http.Header)
+			applyHeaderRules(rules, src, dst)
+			if !reflect.DeepEqual(dst, tt.expected) {
+				t.Errorf("unexpected headers: %v", dst)
+			}
+		})
+	}
+}
+
+func TestCompileHeaderRulesError(t *testing.T) {
+	tests := []*HeaderRule{
+		{Action: "copy", Named: "X-Foo"},
+		{Action: HeaderActionPropagate},
+		{Action: HeaderActionPropagate, Named: "X-Foo", Matching: "^X-"},
+		{Action: HeaderActionPropagate, Matching: "("},
+		{Action: HeaderActionPropagate, Matching: "^X-", Rename: "X-Bar"},
+		{Action: HeaderActionInsert, Matching: "^X-", Value: "foo"},
+		{Action: HeaderActionRemove, Named: "X-Foo", Rename: "X-Bar"},
+	}
+	for _, rule := range tests {
+		_, err := compileHeaderRules([]*HeaderRule{rule})
+		if err == nil {
+			t.Errorf("error is expected: %+v", rule)
+		}
+	}
+}
+
+// newHeaderSubgraph serves `type Query { hello: String }` and sends headers of query requests to receivedHeaders.
+// responses have X-Cache and X-Internal headers.
+func newHeaderSubgraph(t *testing.T, receivedHeaders chan<- http.Header) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := &graphql.RawParams{}
+		err := json.NewDecoder(r.Body).Decode(params)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		var data interface{} = map[string]interface{}{
+			"hello": "world",
+		}
+		if strings.Contains(params.Query, "_service") {
+			data = map[string]interface{}{
+				"_service": map[string]interface{}{
+					"sdl": `type Query { hello: String }`,
+				},
+			}
+		} else {
+			receivedHeaders <- r.Header.Clone()
+		}
+		w.Header().Set("X-Cache", "HIT")
+		w.Header().Set("X-Internal", "secret")
+		err = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+}
+
+// postQuery sends `{ hello }` with the headers to the gateway behind ResponseHeaderMiddleware.
+func postQuery(t *testing.T, gw Gateway, header http.Header) *http.Response {
+	t.Helper()
+
+	s := httptest.NewServer(ResponseHeaderMiddleware(handler.NewDefaultServer(gw)))
+	t.Cleanup(s.Close)
+
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewBufferString(`{"query":"{ hello }"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header.Clone()
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = resp.Body.Close()
+	})
+	if v := resp.StatusCode; v != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", v)
+	}
+
+	return resp
+}
+
+func TestGatewayHeaderRules(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	receivedHeaders := make(chan http.Header, 10)
+	subgraph := newHeaderSubgraph(t, receivedHeaders)
+	defer subgraph.Close()
+
+	// NOTE rules are given as data
+	var headerRules *HeaderRules
+	err := json.Unmarshal([]byte(`{
+		"request": [
+			{ "action": "propagate", "named": "Authorization" },
+			{ "action": "propagate", "named": "X-Tenant", "rename": "X-Tenant-Id" },
+			{ "action": "insert", "named": "X-Source", "value": "gateway" }
+		],
+		"response": [
+			{ "action": "propagate", "matching": "^X-" },
+			{ "action": "remove", "named": "X-Internal" }
+		]
+	}`), &headerRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gw, err := NewGateway(ctx, &GatewayConfig{
+		ServiceDefinitions: []*ServiceDefinition{
+			{
+				Name:        "hello",
+				URL:         subgraph.URL,
+				HeaderRules: headerRules,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := postQuery(t, gw, http.Header{
+		"Authorization": {"Bearer token"},
+		"X-Tenant":      {"tenant"},
+		"Cookie":        {"secret=1"},
+	})
+	if v := resp.Header.Get("X-Cache"); v != "HIT" {
+		t.Errorf("unexpected X-Cache: %s", v)
+	}
+	if v := resp.Header.Get("X-Internal"); v != "" {
+		t.Errorf("unexpected X-Internal: %s", v)
+	}
+
+	header := <-receivedHeaders
+	expected := map[string]string{
+		"Authorization": "Bearer token",
+		"X-Tenant-Id":   "tenant",
+		"X-Tenant":      "",
+		"X-Source":      "gateway",
+		"Cookie":        "",
+		"Content-Type":  "application/json",
+	}
+	for name, value := range expected {
+		if v := header.Get(name); v != value {
+			t.Errorf("unexpected %s: %s", name, v)
+		}
+	}
+}
+
+func TestGatewayHeaderRulesWithDataSourceHooks(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	receivedHeaders := make(chan http.Header, 10)
+	subgraph := newHeaderSubgraph(t, receivedHeaders)
+	defer subgraph.Close()
+
+	var mu sync.Mutex
+	var receivedCaches []string
+	gw, err := NewGateway(ctx, &GatewayConfig{
+		ServiceDefinitions: []*ServiceDefinition{
+			{
+				Name: "hello",
+				DataSource: &engine.RemoteDataSource{
+					URL: subgraph.URL,
+					WillSendRequest: func(ctx context.Context, req *http.Request, oc *graphql.OperationContext) {
+						req.Header.Set("X-Data-Source", req.Header.Get("X-Source"))
+					},
+					DidReceiveResponse: func(ctx context.Context, resp *http.Response, oc *graphql.OperationContext) {
+						mu.Lock()
+						defer mu.Unlock()
+						receivedCaches = append(receivedCaches, resp.Header.Get("X-Cache"))
+					},
+				},
+				HeaderRules: &HeaderRules{
+					Request: []*HeaderRule{
+						{Action: HeaderActionPropagate, Named: "Authorization"},
+						{Action: HeaderActionInsert, Named: "X-Source", Value: "gateway"},
+					},
+					Response: []*HeaderRule{
+						{Action: HeaderActionPropagate, Named: "X-Cache"},
+					},
+				},
+				WillSendRequest: func(ctx context.Context, req *http.Request, oc *graphql.OperationContext) {
+					req.Header.Set("X-Service-Definition", "called")
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := postQuery(t, gw, http.Header{"Authorization": {"Bearer token"}})
+	if v := resp.Header.Get("X-Cache"); v != "HIT" {
+		t.Errorf("unexpected X-Cache: %s", v)
+	}
+
+	// NOTE _service requests for the composition are also observed
+	mu.Lock()
+	if len(receivedCaches) == 0 || receivedCaches[len(receivedCaches)-1] != "HIT" {
+		t.Errorf("DidReceiveResponse of the data source is not called: %v", receivedCaches)
+	}
+	mu.Unlock()
+
+	header := <-receivedHeaders
+	expected := map[string]string{
+		"Authorization":        "Bearer token",
+		"X-Source":             "gateway",
+		"X-Service-Definition": "called",
+		"X-Data-Source":        "gateway", // called after the rules
+	}
+	for name, value := range expected {
+		if v := header.Get(name); v != value {
+			t.Errorf("unexpected %s: %s", name, v)
+		}
+	}
+}
+
+func TestGatewayHeaderRulesWithSharedConfig(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	receivedHeaders := make(chan http.Header, 10)
+	subgraph := newHeaderSubgraph(t, receivedHeaders)
+	defer subgraph.Close()
+
+	cfg := &GatewayConfig{
+		ServiceDefinitions: []*ServiceDefinition{
+			{
+				Name: "hello",
+				DataSource: &engine.RemoteDataSource{
+					URL: subgraph.URL,
+					WillSendRequest: func(ctx context.Context, req *http.Request, oc *graphql.OperationContext) {
+						req.Header.Add("X-Data-Source", "called")
+					},
+				},
+				HeaderRules: &HeaderRules{
+					Request: []*HeaderRule{
+						{Action: HeaderActionPropagate, Named: "Authorization"},
+					},
+				},
+				WillSendRequest: func(ctx context.Context, req *http.Request, oc *graphql.OperationContext) {
+					req.Header.Add("X-Service-Definition", "called")
+				},
+			},
+		},
+	}
+
+	// NOTE the config is reused. hooks must not be chained to the data source of the config
+	for i := 0; i < 2; i++ {
+		gw, err := NewGateway(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		postQuery(t, gw, http.Header{"Authorization": {"Bearer token"}})
+
+		header := <-receivedHeaders
+		for _, name := range []string{"Authorization", "X-Data-Source", "X-Service-Definition"} {
+			if v := header.Values(name); len(v) != 1 {
+				t.Errorf("%d: unexpected %s: %v", i, name, v)
+			}
+		}
+	}
+
+	rds := cfg.ServiceDefinitions[0].DataSource.(*engine.RemoteDataSource)
+	req := httptest.NewRequest(http.MethodPost, subgraph.URL, nil)
+	rds.WillSendRequest(ctx, req, nil)
+	if v := req.Header.Values("X-Service-Definition"); len(v) != 0 {
+		t.Errorf("the data source of the config is modified: %v", v)
+	}
+}
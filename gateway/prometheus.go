@@ -0,0 +1,258 @@
+package gateway
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ Metrics = (*PrometheusMetrics)(nil)
+var _ http.Handler = (*PrometheusMetrics)(nil)
+
+// DefaultPrometheusBuckets are upper bounds of histograms in seconds. they are the same as the Prometheus client's ones.
+var DefaultPrometheusBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// maxPrometheusOperationNames is the number of distinct operation names that PrometheusMetrics records.
+const maxPrometheusOperationNames = 100
+
+// otherOperationName is the label value of operations whose names exceed maxPrometheusOperationNames.
+const otherOperationName = "other"
+
+// PrometheusMetrics keeps Metrics in memory and serves them in the Prometheus text exposition format.
+// mount it to the scrape endpoint. e.g. http.Handle("/metrics", metrics).
+// NOTE operation names are given by clients. names after the first 100 ones are recorded as "other" to bound series.
+type PrometheusMetrics struct {
+	buckets           []float64
+	maxOperationNames int
+
+	mu             sync.Mutex
+	operationNames map[string]bool
+	operations     map[operationLabels]*operationCounter
+	planning       map[bool]*histogram
+	fetches        map[string]*fetchCounter
+}
+
+type operationLabels struct {
+	name          string
+	operationType string
+}
+
+type operationCounter struct {
+	count  uint64
+	errors uint64
+}
+
+type fetchCounter struct {
+	duration *histogram
+	entities uint64
+	errors   uint64
+}
+
+// NewPrometheusMetrics returns PrometheusMetrics. DefaultPrometheusBuckets are used when buckets is empty.
+func NewPrometheusMetrics(buckets ...float64) *PrometheusMetrics {
+	if len(buckets) == 0 {
+		buckets = DefaultPrometheusBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &PrometheusMetrics{
+		buckets:           buckets,
+		maxOperationNames: maxPrometheusOperationNames,
+		operationNames:    make(map[string]bool),
+		operations:        make(map[operationLabels]*operationCounter),
+		planning:          make(map[bool]*histogram),
+		fetches:           make(map[string]*fetchCounter),
+	}
+}
+
+func (m *PrometheusMetrics) ObserveOperation(operationName string, operationType string, errors int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.operationNames[operationName] {
+		if len(m.operationNames) >= m.maxOperationNames {
+			operationName = otherOperationName
+		} else {
+			m.operationNames[operationName] = true
+		}
+	}
+
+	key := operationLabels{name: operationName, operationType: operationType}
+	counter := m.operations[key]
+	if counter == nil {
+		counter = &operationCounter{}
+		m.operations[key] = counter
+	}
+	counter.count++
+	counter.errors += uint64(errors)
+}
+
+func (m *PrometheusMetrics) ObservePlanning(duration time.Duration, cacheHit bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h := m.planning[cacheHit]
+	if h == nil {
+		h = newHistogram(m.buckets)
+		m.planning[cacheHit] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+func (m *PrometheusMetrics) ObserveFetch(serviceName string, duration time.Duration, entities int, errors int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counter := m.fetches[serviceName]
+	if counter == nil {
+		counter = &fetchCounter{duration: newHistogram(m.buckets)}
+		m.fetches[serviceName] = counter
+	}
+	counter.duration.observe(duration.Seconds())
+	counter.entities += uint64(entities)
+	counter.errors += uint64(errors)
+}
+
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	m.write(&buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// write writes all metrics. series are sorted by labels to be stable.
+func (m *PrometheusMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	operations := make([]operationLabels, 0, len(m.operations))
+	for key := range m.operations {
+		operations = append(operations, key)
+	}
+	sort.Slice(operations, func(i, j int) bool {
+		if operations[i].name != operations[j].name {
+			return operations[i].name < operations[j].name
+		}
+		return operations[i].operationType < operations[j].operationType
+	})
+	operationLabelsOf := func(key operationLabels) string {
+		return formatLabels("operation_name", key.name, "operation_type", key.operationType)
+	}
+	if len(operations) != 0 {
+		writeHeader(w, "fedeway_operations_total", "counter", "Number of operations by name and type.")
+		for _, key := range operations {
+			fmt.Fprintf(w, "fedeway_operations_total%s %d\n", operationLabelsOf(key), m.operations[key].count)
+		}
+		writeHeader(w, "fedeway_operation_errors_total", "counter", "Number of errors in responses of operations.")
+		for _, key := range operations {
+			fmt.Fprintf(w, "fedeway_operation_errors_total%s %d\n", operationLabelsOf(key), m.operations[key].errors)
+		}
+	}
+
+	if len(m.planning) != 0 {
+		writeHeader(w, "fedeway_query_planning_duration_seconds", "histogram", "Duration of query planning including the query plan cache.")
+		for _, cacheHit := range []bool{true, false} {
+			h := m.planning[cacheHit]
+			if h == nil {
+				continue
+			}
+			h.write(w, "fedeway_query_planning_duration_seconds", "cache_hit", strconv.FormatBool(cacheHit))
+		}
+	}
+
+	services := make([]string, 0, len(m.fetches))
+	for serviceName := range m.fetches {
+		services = append(services, serviceName)
+	}
+	sort.Strings(services)
+	if len(services) != 0 {
+		writeHeader(w, "fedeway_fetch_duration_seconds", "histogram", "Latency of requests to subgraphs.")
+		for _, serviceName := range services {
+			m.fetches[serviceName].duration.write(w, "fedeway_fetch_duration_seconds", "service", serviceName)
+		}
+		writeHeader(w, "fedeway_fetch_entities_total", "counter", "Number of entities requested to subgraphs.")
+		for _, serviceName := range services {
+			fmt.Fprintf(w, "fedeway_fetch_entities_total%s %d\n", formatLabels("service", serviceName), m.fetches[serviceName].entities)
+		}
+		writeHeader(w, "fedeway_fetch_errors_total", "counter", "Number of errors from subgraphs.")
+		for _, serviceName := range services {
+			fmt.Fprintf(w, "fedeway_fetch_errors_total%s %d\n", formatLabels("service", serviceName), m.fetches[serviceName].errors)
+		}
+	}
+}
+
+func writeHeader(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats pairs of the label name and the value. e.g. {service="accounts"}.
+func formatLabels(pairs ...string) string {
+	var buf strings.Builder
+	buf.WriteString("{")
+	for i := 0; i < len(pairs); i += 2 {
+		if i != 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString(pairs[i])
+		buf.WriteString(`="`)
+		buf.WriteString(labelValueReplacer.Replace(pairs[i+1]))
+		buf.WriteString(`"`)
+	}
+	buf.WriteString("}")
+
+	return buf.String()
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// histogram is a Prometheus histogram. counts are cumulative.
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name string, labelName, labelValue string) {
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(labelName, labelValue, "le", formatFloat(bound)), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(labelName, labelValue, "le", "+Inf"), h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(labelName, labelValue), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(labelName, labelValue), h.count)
+}
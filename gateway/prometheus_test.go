@@ -0,0 +1,118 @@
+package gateway
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/MakeNowJust/heredoc/v2"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	metrics := NewPrometheusMetrics(1, 0.1)
+
+	metrics.ObserveOperation("GetMe", "query", 0)
+	metrics.ObserveOperation("GetMe", "query", 2)
+	metrics.ObserveOperation("", "mutation", 0)
+	metrics.ObservePlanning(50*time.Millisecond, false)
+	metrics.ObservePlanning(time.Millisecond, true)
+	metrics.ObserveFetch("reviews", 50*time.Millisecond, 0, 0)
+	metrics.ObserveFetch("accounts", 500*time.Millisecond, 3, 1)
+	metrics.ObserveFetch("accounts", 2*time.Second, 2, 0)
+	metrics.ObserveFetch("quoted\"\\\nname", 0, 0, 0)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, req)
+
+	if v := w.Header().Get("Content-Type"); v != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("unexpected content type: %s", v)
+	}
+
+	expected := heredoc.Doc(`
+		# HELP fedeway_operations_total Number of operations by name and type.
+		# TYPE fedeway_operations_total counter
+		fedeway_operations_total{operation_name="",operation_type="mutation"} 1
+		fedeway_operations_total{operation_name="GetMe",operation_type="query"} 2
+		# HELP fedeway_operation_errors_total Number of errors in responses of operations.
+		# TYPE fedeway_operation_errors_total counter
+		fedeway_operation_errors_total{operation_name="",operation_type="mutation"} 0
+		fedeway_operation_errors_total{operation_name="GetMe",operation_type="query"} 2
+		# HELP fedeway_query_planning_duration_seconds Duration of query planning including the query plan cache.
+		# TYPE fedeway_query_planning_duration_seconds histogram
+		fedeway_query_planning_duration_seconds_bucket{cache_hit="true",le="0.1"} 1
+		fedeway_query_planning_duration_seconds_bucket{cache_hit="true",le="1"} 1
+		fedeway_query_planning_duration_seconds_bucket{cache_hit="true",le="+Inf"} 1
+		fedeway_query_planning_duration_seconds_sum{cache_hit="true"} 0.001
+		fedeway_query_planning_duration_seconds_count{cache_hit="true"} 1
+		fedeway_query_planning_duration_seconds_bucket{cache_hit="false",le="0.1"} 1
+		fedeway_query_planning_duration_seconds_bucket{cache_hit="false",le="1"} 1
+		fedeway_query_planning_duration_seconds_bucket{cache_hit="false",le="+Inf"} 1
+		fedeway_query_planning_duration_seconds_sum{cache_hit="false"} 0.05
+		fedeway_query_planning_duration_seconds_count{cache_hit="false"} 1
+		# HELP fedeway_fetch_duration_seconds Latency of requests to subgraphs.
+		# TYPE fedeway_fetch_duration_seconds histogram
+		fedeway_fetch_duration_seconds_bucket{service="accounts",le="0.1"} 0
+		fedeway_fetch_duration_seconds_bucket{service="accounts",le="1"} 1
+		fedeway_fetch_duration_seconds_bucket{service="accounts",le="+Inf"} 2
+		fedeway_fetch_duration_seconds_sum{service="accounts"} 2.5
+		fedeway_fetch_duration_seconds_count{service="accounts"} 2
+		fedeway_fetch_duration_seconds_bucket{service="quoted\"\\\nname",le="0.1"} 1
+		fedeway_fetch_duration_seconds_bucket{service="quoted\"\\\nname",le="1"} 1
+		fedeway_fetch_duration_seconds_bucket{service="quoted\"\\\nname",le="+Inf"} 1
+		fedeway_fetch_duration_seconds_sum{service="quoted\"\\\nname"} 0
+		fedeway_fetch_duration_seconds_count{service="quoted\"\\\nname"} 1
+		fedeway_fetch_duration_seconds_bucket{service="reviews",le="0.1"} 1
+		fedeway_fetch_duration_seconds_bucket{service="reviews",le="1"} 1
+		fedeway_fetch_duration_seconds_bucket{service="reviews",le="+Inf"} 1
+		fedeway_fetch_duration_seconds_sum{service="reviews"} 0.05
+		fedeway_fetch_duration_seconds_count{service="reviews"} 1
+		# HELP fedeway_fetch_entities_total Number of entities requested to subgraphs.
+		# TYPE fedeway_fetch_entities_total counter
+		fedeway_fetch_entities_total{service="accounts"} 5
+		fedeway_fetch_entities_total{service="quoted\"\\\nname"} 0
+		fedeway_fetch_entities_total{service="reviews"} 0
+		# HELP fedeway_fetch_errors_total Number of errors from subgraphs.
+		# TYPE fedeway_fetch_errors_total counter
+		fedeway_fetch_errors_total{service="accounts"} 1
+		fedeway_fetch_errors_total{service="quoted\"\\\nname"} 0
+		fedeway_fetch_errors_total{service="reviews"} 0
+	`)
+	if v := w.Body.String(); v != expected {
+		t.Errorf("unexpected metrics:\n%s", v)
+	}
+}
+
+func TestPrometheusMetricsOperationNameLimit(t *testing.T) {
+	metrics := NewPrometheusMetrics()
+	metrics.maxOperationNames = 2
+
+	metrics.ObserveOperation("A", "query", 0)
+	metrics.ObserveOperation("B", "query", 0)
+	metrics.ObserveOperation("C", "query", 1)
+	metrics.ObserveOperation("D", "mutation", 0)
+	metrics.ObserveOperation("A", "query", 0)
+
+	var buf bytes.Buffer
+	metrics.write(&buf)
+
+	expected := heredoc.Doc(`
+		# HELP fedeway_operations_total Number of operations by name and type.
+		# TYPE fedeway_operations_total counter
+		fedeway_operations_total{operation_name="A",operation_type="query"} 2
+		fedeway_operations_total{operation_name="B",operation_type="query"} 1
+		fedeway_operations_total{operation_name="other",operation_type="mutation"} 1
+		fedeway_operations_total{operation_name="other",operation_type="query"} 1
+		# HELP fedeway_operation_errors_total Number of errors in responses of operations.
+		# TYPE fedeway_operation_errors_total counter
+		fedeway_operation_errors_total{operation_name="A",operation_type="query"} 0
+		fedeway_operation_errors_total{operation_name="B",operation_type="query"} 0
+		fedeway_operation_errors_total{operation_name="other",operation_type="mutation"} 0
+		fedeway_operation_errors_total{operation_name="other",operation_type="query"} 1
+	`)
+	if v := buf.String(); v != expected {
+		t.Errorf("unexpected metrics:\n%s", v)
+	}
+}
@@ -0,0 +1,187 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+const (
+	defaultCircuitBreakerFailureThreshold = 5
+	defaultCircuitBreakerOpenDuration     = 30 * time.Second
+)
+
+// CircuitBreakerOpenCode is the error code for fetches that are rejected by the open circuit breaker.
+const CircuitBreakerOpenCode = "CIRCUIT_BREAKER_OPEN"
+
+type CircuitState int
+
+const (
+	// CircuitClosed sends all fetches.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects all fetches without sending them.
+	CircuitOpen
+	// CircuitHalfOpen sends only one fetch to probe the recovery of the service.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(s))
+	}
+}
+
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failures to open the circuit. default is 5.
+	FailureThreshold int
+	// OpenDuration is the duration before the open circuit goes half-open. default is 30s.
+	OpenDuration time.Duration
+}
+
+// CircuitBreaker tracks failures of fetches to a service.
+// a fetch is failed when it timed out or the response has errors without data. e.g. network errors.
+// errors with data mean the service is working and they don't affect the circuit.
+type CircuitBreaker struct {
+	failureThreshold int
+	openDuration     time.Duration
+	now              func() time.Time
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+	// generation is incremented on every state change.
+	// results of fetches allowed in the previous state are ignored.
+	generation uint64
+}
+
+// circuitTicket is given to an allowed fetch. its result must be reported with it.
+type circuitTicket struct {
+	generation uint64
+	// probe is true for the only fetch that is allowed in half-open state.
+	probe bool
+}
+
+func NewCircuitBreaker(cfg *CircuitBreakerConfig) *CircuitBreaker {
+	cb := &CircuitBreaker{
+		failureThreshold: defaultCircuitBreakerFailureThreshold,
+		openDuration:     defaultCircuitBreakerOpenDuration,
+		now:              time.Now,
+	}
+	if cfg != nil && cfg.FailureThreshold > 0 {
+		cb.failureThreshold = cfg.FailureThreshold
+	}
+	if cfg != nil && cfg.OpenDuration > 0 {
+		cb.openDuration = cfg.OpenDuration
+	}
+
+	return cb
+}
+
+// State returns the current state. the open circuit is reported as half-open after OpenDuration.
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitOpen && cb.now().Sub(cb.openedAt) >= cb.openDuration {
+		return CircuitHalfOpen
+	}
+
+	return cb.state
+}
+
+// allow reports whether the fetch can be sent.
+// the caller must report the result with the ticket by onSuccess, onFailure or onCancel when it returns true.
+func (cb *CircuitBreaker) allow() (circuitTicket, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		if cb.now().Sub(cb.openedAt) < cb.openDuration {
+			return circuitTicket{}, false
+		}
+		cb.setState(CircuitHalfOpen)
+		cb.probing = true
+		return circuitTicket{generation: cb.generation, probe: true}, true
+	case CircuitHalfOpen:
+		// NOTE only one probe at a time
+		if cb.probing {
+			return circuitTicket{}, false
+		}
+		cb.probing = true
+		return circuitTicket{generation: cb.generation, probe: true}, true
+	default:
+		return circuitTicket{generation: cb.generation}, true
+	}
+}
+
+func (cb *CircuitBreaker) onSuccess(ticket circuitTicket) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	// NOTE fetches started before the circuit opened don't close it. only the probe decides in half-open state.
+	if ticket.generation != cb.generation {
+		return
+	}
+
+	if ticket.probe {
+		cb.setState(CircuitClosed)
+	}
+	cb.failures = 0
+}
+
+func (cb *CircuitBreaker) onFailure(ticket circuitTicket) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if ticket.generation != cb.generation {
+		return
+	}
+
+	cb.failures++
+	if ticket.probe || cb.failures >= cb.failureThreshold {
+		cb.setState(CircuitOpen)
+		cb.openedAt = cb.now()
+	}
+}
+
+// onCancel is for fetches that are interrupted by the operation. e.g. the operation deadline.
+// they don't tell anything about the service, the next fetch can probe it.
+func (cb *CircuitBreaker) onCancel(ticket circuitTicket) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if ticket.generation != cb.generation || !ticket.probe {
+		return
+	}
+
+	cb.probing = false
+}
+
+// setState must be called with the lock.
+func (cb *CircuitBreaker) setState(state CircuitState) {
+	cb.state = state
+	cb.generation++
+	cb.probing = false
+}
+
+func circuitBreakerOpenError(serviceName string) *gqlerror.Error {
+	return &gqlerror.Error{
+		Message: fmt.Sprintf(`service "%s" is unavailable: circuit breaker is open`, serviceName),
+		Extensions: map[string]interface{}{
+			"code":        CircuitBreakerOpenCode,
+			"serviceName": serviceName,
+		},
+	}
+}
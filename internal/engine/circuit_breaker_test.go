@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	cb := NewCircuitBreaker(&CircuitBreakerConfig{
+		FailureThreshold: 2,
+		OpenDuration:     10 * time.Second,
+	})
+	cb.now = func() time.Time { return now }
+
+	check := func(expected CircuitState) {
+		t.Helper()
+		if v := cb.State(); v != expected {
+			t.Errorf("unexpected state: %s, expected: %s", v, expected)
+		}
+	}
+	allow := func() circuitTicket {
+		t.Helper()
+		ticket, ok := cb.allow()
+		if !ok {
+			t.Fatalf("%s circuit doesn't allow the fetch", cb.State())
+		}
+		return ticket
+	}
+
+	// success resets consecutive failures
+	cb.onFailure(allow())
+	cb.onSuccess(allow())
+	cb.onFailure(allow())
+	check(CircuitClosed)
+
+	cb.onFailure(allow())
+	check(CircuitOpen)
+	if _, ok := cb.allow(); ok {
+		t.Error("open circuit allows the fetch")
+	}
+
+	// half-open allows only one probe
+	now = now.Add(10 * time.Second)
+	check(CircuitHalfOpen)
+	probe := allow()
+	if _, ok := cb.allow(); ok {
+		t.Error("half-open circuit allows the second probe")
+	}
+
+	// failed probe opens the circuit again
+	cb.onFailure(probe)
+	check(CircuitOpen)
+
+	// canceled probe doesn't change the state
+	now = now.Add(10 * time.Second)
+	cb.onCancel(allow())
+	check(CircuitHalfOpen)
+
+	// succeeded probe closes the circuit
+	cb.onSuccess(allow())
+	check(CircuitClosed)
+	allow()
+}
+
+func TestCircuitBreakerStaleResults(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	cb := NewCircuitBreaker(&CircuitBreakerConfig{
+		FailureThreshold: 2,
+		OpenDuration:     10 * time.Second,
+	})
+	cb.now = func() time.Time { return now }
+
+	check := func(expected CircuitState) {
+		t.Helper()
+		if v := cb.State(); v != expected {
+			t.Errorf("unexpected state: %s, expected: %s", v, expected)
+		}
+	}
+	allow := func() circuitTicket {
+		t.Helper()
+		ticket, ok := cb.allow()
+		if !ok {
+			t.Fatalf("%s circuit doesn't allow the fetch", cb.State())
+		}
+		return ticket
+	}
+
+	// NOTE the fetch is sent before the circuit opens and finishes after that
+	stale := allow()
+	cb.onFailure(allow())
+	cb.onFailure(allow())
+	check(CircuitOpen)
+	cb.onSuccess(stale)
+	check(CircuitOpen)
+
+	// only the probe decides the state of the half-open circuit
+	now = now.Add(10 * time.Second)
+	probe := allow()
+	cb.onSuccess(stale)
+	check(CircuitHalfOpen)
+	cb.onFailure(stale)
+	check(CircuitHalfOpen)
+	cb.onCancel(stale)
+	if _, ok := cb.allow(); ok {
+		t.Error("the stale fetch releases the probe")
+	}
+
+	cb.onSuccess(probe)
+	check(CircuitClosed)
+
+	// the result of the probe doesn't affect the circuit after it is closed. e.g. reported twice
+	cb.onFailure(probe)
+	cb.onFailure(probe)
+	check(CircuitClosed)
+}
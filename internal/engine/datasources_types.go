@@ -4,8 +4,32 @@ import (
 	"context"
 
 	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/gqlerror"
 )
 
 type DataSource interface {
 	Process(ctx context.Context, oc *graphql.OperationContext) *graphql.Response
 }
+
+// SubscriptionDataSource is a DataSource that can also handle subscription operations.
+type SubscriptionDataSource interface {
+	DataSource
+	// Subscribe starts the subscription. the returned handler returns the next event, or nil when the subscription is completed.
+	// the subscription is terminated when ctx is done.
+	Subscribe(ctx context.Context, oc *graphql.OperationContext) graphql.ResponseHandler
+}
+
+// DecodedDataSource is a DataSource that can return the decoded data without JSON. e.g. in-process services.
+// the engine prefers ProcessDecoded to Process for queries and mutations.
+type DecodedDataSource interface {
+	DataSource
+	ProcessDecoded(ctx context.Context, oc *graphql.OperationContext) *DecodedResponse
+}
+
+// DecodedResponse is the response of DecodedDataSource.
+// Data must be the same as the result of decoding JSON by json.Decoder with UseNumber.
+// e.g. numbers are json.Number to keep the precision.
+type DecodedResponse struct {
+	Data   map[string]interface{} // nil means null
+	Errors gqlerror.List
+}
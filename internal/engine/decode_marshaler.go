@@ -0,0 +1,304 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// resolvedFields records fields that gqlgen resolved by ResolverMiddleware.
+// decodeMarshaler uses them to convert the result of gqlgen to the same value as decodeResponseData makes from JSON.
+type resolvedFields struct {
+	schema *ast.Schema
+	oc     *graphql.OperationContext
+
+	mu sync.Mutex
+	// keys are paths of field contexts. they are built from the parent's one.
+	keys map[*graphql.FieldContext]string
+	// types are runtime type names of objects by their paths.
+	types map[string]string
+	// scalars are decoded values of built-in scalar fields by their paths.
+	scalars map[string]interface{}
+}
+
+func newResolvedFields(schema *ast.Schema, oc *graphql.OperationContext) *resolvedFields {
+	return &resolvedFields{
+		schema:  schema,
+		oc:      oc,
+		keys:    make(map[*graphql.FieldContext]string),
+		types:   make(map[string]string),
+		scalars: make(map[string]interface{}),
+	}
+}
+
+// record is called with the result of the resolver. `__typename` doesn't reach here.
+func (r *resolvedFields) record(ctx context.Context, res interface{}) {
+	fc := graphql.GetFieldContext(ctx)
+	if fc == nil || fc.Field.Field == nil {
+		return
+	}
+
+	var scalar interface{}
+	var isScalar bool
+	if len(fc.Field.Selections) == 0 && fc.Field.Definition != nil {
+		scalar, isScalar = decodeScalar(fc.Field.Definition.Type.Name(), res)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	objectKey := r.pathKey(fc.Parent)
+	r.types[objectKey] = fc.Object
+	if isScalar {
+		r.scalars[fieldKey(objectKey, fc.Field.Alias)] = scalar
+	}
+}
+
+// pathKey makes the same string as fc.Path().String() from the cached key of the parent.
+func (r *resolvedFields) pathKey(fc *graphql.FieldContext) string {
+	if fc == nil {
+		return ""
+	}
+	if key, ok := r.keys[fc]; ok {
+		return key
+	}
+
+	key := r.pathKey(fc.Parent)
+	if fc.Index != nil {
+		key = indexKey(key, *fc.Index)
+	} else if fc.Field.Field != nil {
+		key = fieldKey(key, fc.Field.Alias)
+	}
+	r.keys[fc] = key
+
+	return key
+}
+
+// fieldKey makes the same string as ast.Path.String.
+func fieldKey(objectKey string, alias string) string {
+	if objectKey == "" {
+		return alias
+	}
+
+	return objectKey + "." + alias
+}
+
+func indexKey(listKey string, index int) string {
+	return listKey + "[" + strconv.Itoa(index) + "]"
+}
+
+// decodeMarshaler decodes m of the field at key. selections are ones of the field.
+// objects and lists are converted directly by recorded fields. values that aren't recorded are decoded from their own small JSON.
+// e.g. custom scalars, enums, objects that have only `__typename`.
+func (r *resolvedFields) decodeMarshaler(m graphql.Marshaler, key string, selections ast.SelectionSet) (interface{}, error) {
+	switch m := m.(type) {
+	case nil:
+		return nil, nil
+	case *graphql.FieldSet:
+		fields, typeName, ok := r.collectFields(m, key, selections)
+		if !ok {
+			return decodeMarshalerJSON(m)
+		}
+		result := make(map[string]interface{}, len(fields))
+		for i, field := range fields {
+			if field.Name == "__typename" {
+				result[field.Alias] = typeName
+				continue
+			}
+			v, err := r.decodeMarshaler(m.Values[i], fieldKey(key, field.Alias), field.Selections)
+			if err != nil {
+				return nil, err
+			}
+			result[field.Alias] = v
+		}
+		return result, nil
+	case graphql.Array:
+		if v, ok := r.scalar(key); ok {
+			if list, ok := v.([]interface{}); ok && len(list) == len(m) {
+				return list, nil
+			}
+		}
+		result := make([]interface{}, 0, len(m))
+		for i, elem := range m {
+			v, err := r.decodeMarshaler(elem, indexKey(key, i), selections)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, v)
+		}
+		return result, nil
+	}
+
+	if m == graphql.Null {
+		return nil, nil
+	}
+	if v, ok := r.scalar(key); ok {
+		return v, nil
+	}
+
+	return decodeMarshalerJSON(m)
+}
+
+func (r *resolvedFields) scalar(key string) (interface{}, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v, ok := r.scalars[key]
+	return v, ok
+}
+
+// collectFields returns the fields of the FieldSet like the generated code of gqlgen collects them.
+// it reports false when the runtime type of the object isn't recorded.
+func (r *resolvedFields) collectFields(fs *graphql.FieldSet, key string, selections ast.SelectionSet) ([]graphql.CollectedField, string, bool) {
+	r.mu.Lock()
+	typeName, ok := r.types[key]
+	r.mu.Unlock()
+	if !ok {
+		return nil, "", false
+	}
+	def := r.schema.Types[typeName]
+	if def == nil {
+		return nil, "", false
+	}
+
+	satisfies := []string{typeName}
+	for _, implement := range r.schema.GetImplements(def) {
+		satisfies = append(satisfies, implement.Name)
+	}
+	fields := graphql.CollectFields(r.oc, selections, satisfies)
+	if len(fields) != len(fs.Values) {
+		return nil, "", false
+	}
+
+	return fields, typeName, true
+}
+
+// decodeScalar converts the result of the resolver of built-in scalars like graphql.MarshalString and others do.
+// it reports false for types that may be marshaled by custom marshalers.
+func decodeScalar(typeName string, v interface{}) (interface{}, bool) {
+	if v == nil {
+		return nil, true
+	}
+
+	switch typeName {
+	case "String", "ID":
+		switch v := v.(type) {
+		case string:
+			return v, true
+		case *string:
+			if v == nil {
+				return nil, true
+			}
+			return *v, true
+		}
+	case "Boolean":
+		switch v := v.(type) {
+		case bool:
+			return v, true
+		case *bool:
+			if v == nil {
+				return nil, true
+			}
+			return *v, true
+		}
+	case "Int":
+		switch v := v.(type) {
+		case int:
+			return json.Number(strconv.Itoa(v)), true
+		case *int:
+			if v == nil {
+				return nil, true
+			}
+			return json.Number(strconv.Itoa(*v)), true
+		case int32:
+			return json.Number(strconv.FormatInt(int64(v), 10)), true
+		case *int32:
+			if v == nil {
+				return nil, true
+			}
+			return json.Number(strconv.FormatInt(int64(*v), 10)), true
+		case int64:
+			return json.Number(strconv.FormatInt(v, 10)), true
+		case *int64:
+			if v == nil {
+				return nil, true
+			}
+			return json.Number(strconv.FormatInt(*v, 10)), true
+		}
+	case "Float":
+		switch v := v.(type) {
+		case float64:
+			return decodeFloat(v)
+		case *float64:
+			if v == nil {
+				return nil, true
+			}
+			return decodeFloat(*v)
+		}
+	default:
+		return nil, false
+	}
+
+	// NOTE lists of scalars. e.g. []string, []*int
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return nil, false
+	}
+	if rv.IsNil() {
+		return nil, true
+	}
+	list := make([]interface{}, rv.Len())
+	for i := range list {
+		elem, ok := decodeScalar(typeName, rv.Index(i).Interface())
+		if !ok {
+			return nil, false
+		}
+		list[i] = elem
+	}
+
+	return list, true
+}
+
+// decodeFloat makes the same number as graphql.MarshalFloat writes by %g.
+func decodeFloat(f float64) (interface{}, bool) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, false
+	}
+
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), true
+}
+
+func decodeMarshalerJSON(m graphql.Marshaler) (interface{}, error) {
+	var buf bytes.Buffer
+	m.MarshalGQL(&buf)
+	b := bytes.TrimSpace(buf.Bytes())
+
+	switch {
+	case len(b) == 0:
+		return nil, nil
+	case bytes.Equal(b, []byte("null")):
+		return nil, nil
+	case bytes.Equal(b, []byte("true")):
+		return true, nil
+	case bytes.Equal(b, []byte("false")):
+		return false, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var v interface{}
+	err := dec.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
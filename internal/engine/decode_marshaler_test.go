@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vvakame/fedeway/internal/engine/subgraphs/accounts"
+)
+
+func TestDecodeScalar(t *testing.T) {
+	str := "\"quoted\"\n"
+	num := 42
+	tests := []struct {
+		typeName string
+		value    interface{}
+		m        graphql.Marshaler
+	}{
+		{"String", str, graphql.MarshalString(str)},
+		{"String", &str, graphql.MarshalString(str)},
+		{"String", (*string)(nil), graphql.Null},
+		{"ID", "1", graphql.MarshalID("1")},
+		{"Boolean", true, graphql.MarshalBoolean(true)},
+		{"Int", num, graphql.MarshalInt(num)},
+		{"Int", &num, graphql.MarshalInt(num)},
+		{"Int", int64(9007199254740993), graphql.MarshalInt64(9007199254740993)},
+		{"Int", int32(-1), graphql.MarshalInt32(-1)},
+		{"Float", 0.1, graphql.MarshalFloat(0.1)},
+		{"Float", 1e21, graphql.MarshalFloat(1e21)},
+		{"Float", 100.0, graphql.MarshalFloat(100)},
+		{"String", []string{"a", "b"}, graphql.Array{graphql.MarshalString("a"), graphql.MarshalString("b")}},
+		{"Int", []*int{&num, nil}, graphql.Array{graphql.MarshalInt(num), graphql.Null}},
+	}
+	for _, tt := range tests {
+		v, ok := decodeScalar(tt.typeName, tt.value)
+		if !ok {
+			t.Errorf("%s %#v is not decoded", tt.typeName, tt.value)
+			continue
+		}
+
+		// NOTE it must be same as the result of the JSON path
+		var buf bytes.Buffer
+		tt.m.MarshalGQL(&buf)
+		var expected interface{}
+		dec := json.NewDecoder(&buf)
+		dec.UseNumber()
+		err := dec.Decode(&expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(v, expected) {
+			t.Errorf("unexpected value of %s %#v: %#v, expected: %#v", tt.typeName, tt.value, v, expected)
+		}
+	}
+
+	// custom scalars and enums are marshaled by their own marshalers
+	if _, ok := decodeScalar("JSON", "{}"); ok {
+		t.Error("custom scalar is decoded")
+	}
+	if _, ok := decodeScalar("String", struct{}{}); ok {
+		t.Error("unknown type is decoded")
+	}
+}
+
+// jsonForbiddenMarshaler fails the test when it is marshaled.
+type jsonForbiddenMarshaler struct {
+	t *testing.T
+}
+
+func (m jsonForbiddenMarshaler) MarshalGQL(w io.Writer) {
+	m.t.Error("recorded value is marshaled to JSON")
+}
+
+func TestResolvedFieldsDecodeMarshaler(t *testing.T) {
+	schema := accounts.NewExecutableSchema().ExecutableSchema().Schema()
+	doc, gErrs := gqlparser.LoadQuery(schema, `{ me { __typename id login: username name { first } metadata { name } } }`)
+	if len(gErrs) != 0 {
+		t.Fatal(gErrs)
+	}
+	oc := &graphql.OperationContext{
+		Doc:       doc,
+		Operation: doc.Operations[0],
+		Variables: map[string]interface{}{},
+	}
+	me := doc.Operations[0].SelectionSet[0].(*ast.Field)
+
+	r := newResolvedFields(schema, oc)
+	r.types["me"] = "User"
+	r.scalars["me.id"] = "1"
+	r.scalars["me.login"] = "ada"
+	r.types["me.name"] = "Name"
+	r.scalars["me.name.first"] = "Ada"
+
+	forbidden := jsonForbiddenMarshaler{t: t}
+	name := graphql.NewFieldSet(graphql.CollectFields(oc, me.SelectionSet[3].(*ast.Field).SelectionSet, []string{"Name"}))
+	name.Values[0] = forbidden
+	// NOTE the type of metadata isn't recorded. it falls back to JSON.
+	metadata := graphql.NewFieldSet(graphql.CollectFields(oc, me.SelectionSet[4].(*ast.Field).SelectionSet, []string{"UserMetadata"}))
+	metadata.Values[0] = graphql.MarshalString("admin")
+	user := graphql.NewFieldSet(graphql.CollectFields(oc, me.SelectionSet, []string{"User", "_Entity"}))
+	user.Values[0] = forbidden
+	user.Values[1] = forbidden
+	user.Values[2] = forbidden
+	user.Values[3] = name
+	user.Values[4] = graphql.Array{metadata}
+
+	v, err := r.decodeMarshaler(user, "me", me.SelectionSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"__typename": "User",
+		"id":         "1",
+		"login":      "ada",
+		"name":       map[string]interface{}{"first": "Ada"},
+		"metadata":   []interface{}{map[string]interface{}{"name": "admin"}},
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Errorf("unexpected value: %#v", v)
+	}
+}
+
+func TestLocalDataSourceProcessDecoded(t *testing.T) {
+	ctx := context.Background()
+
+	ds := &LocalDataSource{ExecutableSchema: accounts.NewExecutableSchema().ExecutableSchema()}
+	const query = `
+		query ($representations: [_Any!]!) {
+			_entities(representations: $representations) {
+				__typename
+				... on User {
+					id
+					login: username
+					name {
+						first
+						last
+					}
+					account {
+						__typename
+						... on PasswordAccount {
+							email
+						}
+						... on SMSAccount {
+							number
+						}
+					}
+					metadata {
+						name
+						address
+					}
+				}
+			}
+		}
+	`
+	newOperationContext := func() *graphql.OperationContext {
+		doc, gErrs := gqlparser.LoadQuery(ds.ExecutableSchema.Schema(), query)
+		if len(gErrs) != 0 {
+			t.Fatal(gErrs)
+		}
+		return &graphql.OperationContext{
+			RawQuery: query,
+			Doc:      doc,
+			Variables: map[string]interface{}{
+				"representations": []interface{}{
+					map[string]interface{}{"__typename": "User", "id": "1"},
+					map[string]interface{}{"__typename": "User", "id": "2"},
+				},
+			},
+			Operation:              doc.Operations[0],
+			ResolverMiddleware:     func(ctx context.Context, next graphql.Resolver) (interface{}, error) { return next(ctx) },
+			RootResolverMiddleware: func(ctx context.Context, next graphql.RootResolver) graphql.Marshaler { return next(ctx) },
+		}
+	}
+
+	decoded := ds.ProcessDecoded(ctx, newOperationContext())
+	if len(decoded.Errors) != 0 {
+		t.Fatal(decoded.Errors)
+	}
+	resp := ds.Process(ctx, newOperationContext())
+	if len(resp.Errors) != 0 {
+		t.Fatal(resp.Errors)
+	}
+	expected, gErr := decodeResponseData(resp.Data)
+	if gErr != nil {
+		t.Fatal(gErr)
+	}
+	if !reflect.DeepEqual(decoded.Data, expected) {
+		t.Errorf("unexpected data: %#v, expected: %s", decoded.Data, resp.Data)
+	}
+}
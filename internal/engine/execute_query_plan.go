@@ -4,100 +4,484 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/vvakame/fedeway/internal/execute"
 	"sync"
+	"time"
 
 	"github.com/99designs/gqlgen/graphql"
+	apollotrace "github.com/99designs/gqlgen/graphql/handler/apollofederatedtracingv1/generated"
 	"github.com/vektah/gqlparser/v2/ast"
 	"github.com/vektah/gqlparser/v2/gqlerror"
 	"github.com/vektah/gqlparser/v2/parser"
+	"github.com/vektah/gqlparser/v2/validator"
+	"github.com/vvakame/fedeway/internal/execute"
+	"github.com/vvakame/fedeway/internal/log"
 	"github.com/vvakame/fedeway/internal/plan"
+	"github.com/vvakame/fedeway/internal/planner"
 	"github.com/vvakame/fedeway/internal/utils"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ServiceMap map[string]DataSource
 
+type executeConfig struct {
+	errorPresenter graphql.ErrorPresenterFunc
+	recoverFunc    graphql.RecoverFunc
+	fetchTimeouts  map[string]time.Duration
+	breakers       map[string]*CircuitBreaker
+	maxBatchSizes  map[string]int
+	coalescer      *RequestCoalescer
+	diagnostics    bool
+	tracerProvider trace.TracerProvider
+	traceSink      FederatedTraceSink
+	metrics        FetchMetrics
+}
+
+type ExecuteOption func(cfg *executeConfig)
+
+// WithErrorPresenter sets the error presenter that is applied to all errors in the response.
+func WithErrorPresenter(errorPresenter graphql.ErrorPresenterFunc) ExecuteOption {
+	return func(cfg *executeConfig) {
+		cfg.errorPresenter = errorPresenter
+	}
+}
+
+// WithRecoverFunc sets the recover func. RecoverFunc of the request is used when it isn't given.
+func WithRecoverFunc(recoverFunc graphql.RecoverFunc) ExecuteOption {
+	return func(cfg *executeConfig) {
+		cfg.recoverFunc = recoverFunc
+	}
+}
+
+// WithFetchTimeouts sets the timeout of each fetch by the service name.
+// a fetch that exceeds it becomes DOWNSTREAM_SERVICE_ERROR and the rest of the plan continues.
+func WithFetchTimeouts(fetchTimeouts map[string]time.Duration) ExecuteOption {
+	return func(cfg *executeConfig) {
+		cfg.fetchTimeouts = fetchTimeouts
+	}
+}
+
+// WithCircuitBreakers sets the circuit breaker of each service by the service name.
+func WithCircuitBreakers(breakers map[string]*CircuitBreaker) ExecuteOption {
+	return func(cfg *executeConfig) {
+		cfg.breakers = breakers
+	}
+}
+
+// WithMaxBatchSizes sets the max number of representations in an `_entities` request by the service name.
+// representations over it are split into batches and sent concurrently.
+func WithMaxBatchSizes(maxBatchSizes map[string]int) ExecuteOption {
+	return func(cfg *executeConfig) {
+		cfg.maxBatchSizes = maxBatchSizes
+	}
+}
+
+// WithRequestCoalescer shares in-flight responses among identical query fetches.
+func WithRequestCoalescer(coalescer *RequestCoalescer) ExecuteOption {
+	return func(cfg *executeConfig) {
+		cfg.coalescer = coalescer
+	}
+}
+
+// WithFetchDiagnostics records every request to services and returns them in extensions of the response.
+// see FetchDiagnostic. it is for debugging, the in-process fast path of DecodedDataSource isn't used.
+func WithFetchDiagnostics(enabled bool) ExecuteOption {
+	return func(cfg *executeConfig) {
+		cfg.diagnostics = enabled
+	}
+}
+
+// WithTracerProvider sets the TracerProvider for spans of the execution. the global one is used when it isn't given.
+func WithTracerProvider(tracerProvider trace.TracerProvider) ExecuteOption {
+	return func(cfg *executeConfig) {
+		cfg.tracerProvider = tracerProvider
+	}
+}
+
+// WithFederatedTraceSink asks services to return their traces (ftv1) and exports the stitched trace of the operation to the sink.
+// it isn't applied to subscriptions.
+func WithFederatedTraceSink(sink FederatedTraceSink) ExecuteOption {
+	return func(cfg *executeConfig) {
+		cfg.traceSink = sink
+	}
+}
+
+// WithFetchMetrics records latencies, entities and errors of every request to services.
+func WithFetchMetrics(metrics FetchMetrics) ExecuteOption {
+	return func(cfg *executeConfig) {
+		cfg.metrics = metrics
+	}
+}
+
+func newExecuteConfig(opts []ExecuteOption) *executeConfig {
+	cfg := &executeConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return cfg
+}
+
 type executionContext struct {
 	QueryPlan      *plan.QueryPlan
 	Schema         *ast.Schema
+	APISchema      *ast.Schema
 	ServiceMap     ServiceMap
 	RequestContext *graphql.OperationContext
-	Errors         gqlerror.List
+	ErrorPresenter graphql.ErrorPresenterFunc // optional
+	RecoverFunc    graphql.RecoverFunc        // optional
+	FetchTimeouts  map[string]time.Duration   // optional
+	Breakers       map[string]*CircuitBreaker // optional
+	MaxBatchSizes  map[string]int             // optional
+	Coalescer      *RequestCoalescer          // optional
+	Diagnostics    *fetchDiagnostics          // optional
+	Tracer         trace.Tracer
+	Tracing        *federatedTracing // optional
+	Metrics        FetchMetrics      // optional
+	// Data is the root of the results. it is used to resolve response paths of entities.
+	Data resultObject
+
+	errorsLock sync.Mutex
+	Errors     gqlerror.List
 }
 
-func ExecuteQueryPlan(ctx context.Context, queryPlan *plan.QueryPlan, serviceMap ServiceMap, schema *ast.Schema, requestContext *graphql.OperationContext) *graphql.Response {
-	ec := &executionContext{
+func newExecutionContext(queryPlan *plan.QueryPlan, serviceMap ServiceMap, composedSchema *planner.ComposedSchema, requestContext *graphql.OperationContext, cfg *executeConfig) *executionContext {
+	var diagnostics *fetchDiagnostics
+	if cfg.diagnostics {
+		diagnostics = newFetchDiagnostics()
+	}
+
+	return &executionContext{
 		QueryPlan:      queryPlan,
-		Schema:         schema,
+		Schema:         composedSchema.Schema,
+		APISchema:      composedSchema.APISchema,
 		ServiceMap:     serviceMap,
 		RequestContext: requestContext,
+		ErrorPresenter: cfg.errorPresenter,
+		RecoverFunc:    cfg.recoverFunc,
+		FetchTimeouts:  cfg.fetchTimeouts,
+		Breakers:       cfg.breakers,
+		MaxBatchSizes:  cfg.maxBatchSizes,
+		Coalescer:      cfg.coalescer,
+		Diagnostics:    diagnostics,
+		Tracer:         NewTracer(cfg.tracerProvider),
+		Metrics:        cfg.metrics,
+	}
+}
+
+func (ec *executionContext) addError(gErr *gqlerror.Error) {
+	ec.errorsLock.Lock()
+	defer ec.errorsLock.Unlock()
+
+	ec.Errors = append(ec.Errors, gErr)
+}
+
+func (ec *executionContext) recoverFunc() graphql.RecoverFunc {
+	if ec.RecoverFunc != nil {
+		return ec.RecoverFunc
+	}
+	if ec.RequestContext.RecoverFunc != nil {
+		return ec.RequestContext.RecoverFunc
+	}
+
+	return graphql.DefaultRecover
+}
+
+// recover converts a recovered value to an error by the recover func like gqlgen does.
+func (ec *executionContext) recover(ctx context.Context, r interface{}, path ast.Path) *gqlerror.Error {
+	err := ec.recoverFunc()(ctx, r)
+	var gErr *gqlerror.Error
+	if errors.As(err, &gErr) {
+		copied := *gErr
+		if len(copied.Path) == 0 {
+			copied.Path = path
+		}
+		return &copied
 	}
 
+	return gqlerror.WrapPath(path, err)
+}
+
+func ExecuteQueryPlan(ctx context.Context, queryPlan *plan.QueryPlan, serviceMap ServiceMap, composedSchema *planner.ComposedSchema, requestContext *graphql.OperationContext, opts ...ExecuteOption) *graphql.Response {
+	ctx = withRequestContext(ctx, requestContext)
+	cfg := newExecuteConfig(opts)
+	ec := newExecutionContext(queryPlan, serviceMap, composedSchema, requestContext, cfg)
+	if cfg.traceSink != nil {
+		ec.Tracing = newFederatedTracing(cfg.traceSink)
+		ctx = withIncludeTrace(ctx)
+	}
+
+	ctx, span := ec.Tracer.Start(ctx, "gateway.execute")
+	defer span.End()
+
 	var resultLock sync.Mutex
-	data := make(map[string]interface{})
+	data := make(resultObject)
+	ec.Data = data
 
+	var queryPlanTrace *apollotrace.Trace_QueryPlanNode
 	if queryPlan.Node != nil {
-		executeNode(ctx, ec, queryPlan.Node, &resultLock, data, nil)
+		queryPlanTrace = executeNode(ctx, ec, queryPlan.Node, &resultLock, data, nil)
 	}
 
+	resp := ec.postprocess(ctx, data)
+	ec.addExtensions(resp)
+
+	if ec.Tracing != nil {
+		err := ec.Tracing.export(ctx, requestContext, queryPlanTrace)
+		if err != nil {
+			log.FromContext(ctx).Error(err, "failed to export the federated trace")
+		}
+	}
+
+	return resp
+}
+
+// ExecuteSubscriptionPlan subscribes to the service that owns the subscription root field.
+// the returned handler waits for the next event and executes the rest of the plan for it.
+// it returns nil when the subscription is completed.
+func ExecuteSubscriptionPlan(ctx context.Context, queryPlan *plan.QueryPlan, serviceMap ServiceMap, composedSchema *planner.ComposedSchema, requestContext *graphql.OperationContext, opts ...ExecuteOption) graphql.ResponseHandler {
+	ctx = withRequestContext(ctx, requestContext)
+	cfg := newExecuteConfig(opts)
+	// NOTE for errors before the subscription is started
+	setupEC := newExecutionContext(queryPlan, serviceMap, composedSchema, requestContext, cfg)
+	errorResponse := func(gErr *gqlerror.Error) graphql.ResponseHandler {
+		setupEC.addError(gErr)
+		return graphql.OneShot(&graphql.Response{Errors: setupEC.presentErrors(ctx)})
+	}
+
+	node, ok := queryPlan.Node.(*plan.SubscriptionNode)
+	if !ok {
+		return errorResponse(gqlerror.Errorf("unexpected node type for subscription: %T", queryPlan.Node))
+	}
+	primary := node.Primary
+
+	service := serviceMap[primary.ServiceName]
+	if service == nil {
+		return errorResponse(gqlerror.Errorf(`couldn't find service with name "%s"`, primary.ServiceName))
+	}
+	subscriptionService, ok := service.(SubscriptionDataSource)
+	if !ok {
+		return errorResponse(gqlerror.Errorf(`service "%s" doesn't support subscription`, primary.ServiceName))
+	}
+
+	oc, gErr := newFetchOperationContext(primary, variablesForFetch(requestContext, primary), setupEC.recoverFunc())
+	if gErr != nil {
+		return errorResponse(gErr)
+	}
+	if primary.OperationDocument != nil {
+		ctx = withPlannedFetch(ctx, primary)
+	}
+
+	next := subscriptionService.Subscribe(ctx, oc)
+
+	return func(ctx context.Context) *graphql.Response {
+		response := next(ctx)
+		if response == nil {
+			return nil
+		}
+
+		ec := newExecutionContext(queryPlan, serviceMap, composedSchema, requestContext, cfg)
+
+		ctx, span := ec.Tracer.Start(ctx, "gateway.execute")
+		defer span.End()
+
+		for _, gErr := range response.Errors {
+			ec.addError(downstreamServiceError(gErr, primary.ServiceName, nil))
+		}
+
+		data, gErr := decodeResponseData(response.Data)
+		if gErr != nil {
+			ec.addError(gErr)
+		}
+		if data == nil {
+			return &graphql.Response{Errors: ec.presentErrors(ctx)}
+		}
+		result := toResultTree(data).(resultObject)
+		ec.Data = result
+
+		if node.Rest != nil {
+			var resultLock sync.Mutex
+			executeNode(ctx, ec, node.Rest, &resultLock, result, nil)
+		}
+
+		resp := ec.postprocess(ctx, result)
+		ec.addExtensions(resp)
+
+		return resp
+	}
+}
+
+// postprocess builds the response in its own span.
+func (ec *executionContext) postprocess(ctx context.Context, data resultObject) *graphql.Response {
+	ctx, span := ec.Tracer.Start(ctx, "gateway.postprocessing")
+	defer span.End()
+
+	return buildResponse(ctx, ec, data)
+}
+
+// addExtensions adds what is collected while executing the plan to extensions of the response.
+func (ec *executionContext) addExtensions(resp *graphql.Response) {
+	if ec.Diagnostics == nil {
+		return
+	}
+
+	if resp.Extensions == nil {
+		resp.Extensions = make(map[string]interface{})
+	}
+	resp.Extensions[FetchDiagnosticsExtension] = ec.Diagnostics.list()
+}
+
+// buildResponse shapes the merged data to the requested operation.
+// NOTE the response is shaped by the API schema, so @inaccessible elements never reach clients.
+func buildResponse(ctx context.Context, ec *executionContext, data resultObject) *graphql.Response {
+	requestContext := ec.RequestContext
+
+	operation := requestContext.Doc.Operations.ForName(requestContext.OperationName)
+	variables, err := validator.VariableValues(ec.APISchema, operation, requestContext.Variables)
+	if err != nil {
+		gErr, ok := err.(*gqlerror.Error)
+		if !ok {
+			gErr = gqlerror.WrapPath(nil, err)
+		}
+		return &graphql.Response{Errors: gqlerror.List{gErr}}
+	}
+	oc := &graphql.OperationContext{
+		RawQuery:  requestContext.RawQuery,
+		Variables: variables,
+		Doc:       requestContext.Doc,
+		Operation: operation,
+	}
+
+	w := newResultWriter(ec.APISchema, oc)
+	rootType := w.rootType(operation)
+	if rootType != nil {
+		for _, field := range w.collectFields(operation.SelectionSet, rootType) {
+			if field.Name == "__schema" || field.Name == "__type" {
+				return buildIntrospectionResponse(ctx, ec, data)
+			}
+		}
+	}
+	w.writeOperation(operation, data)
+
+	// NOTE 通常ここではエラーは発生しないが、API schema に存在しない型(e.g. @inaccessible) に解決された場合などは発生する
+	gErrs := ec.presentErrors(ctx)
+	errorPresenter := ec.ErrorPresenter
+	if errorPresenter == nil {
+		errorPresenter = graphql.DefaultErrorPresenter
+	}
+	for _, gErr := range w.errors {
+		gErrs = append(gErrs, errorPresenter(ctx, gErr))
+	}
+
+	return &graphql.Response{
+		Errors: gErrs,
+		Data:   w.buf.Bytes(),
+	}
+}
+
+// buildIntrospectionResponse shapes the data by execute.Execute. it can resolve introspection fields by the schema.
+func buildIntrospectionResponse(ctx context.Context, ec *executionContext, data resultObject) *graphql.Response {
+	requestContext := ec.RequestContext
+
 	resp := execute.Execute(ctx, &execute.ExecutionArgs{
-		Schema:         schema,
+		Schema:         ec.APISchema,
 		RawQuery:       requestContext.RawQuery,
 		Document:       requestContext.Doc,
-		RootValue:      data,
+		RootValue:      fromResultTree(data),
 		VariableValues: requestContext.Variables,
 		OperationName:  requestContext.OperationName,
 		FieldResolver:  nil,
-		TypeResolver:   nil,
+		TypeResolver:   apiSchemaTypeResolver,
+		ErrorPresenter: ec.ErrorPresenter,
+		RecoverFunc:    ec.recoverFunc(),
 	})
-	if len(resp.Errors) != 0 {
-		// ここではエラーが発生しないはず
-		return &graphql.Response{Errors: resp.Errors}
-	}
-	if len(ec.Errors) != 0 {
-		resp.Errors = ec.Errors
+	if gErrs := ec.presentErrors(ctx); len(gErrs) != 0 {
+		resp.Errors = append(gErrs, resp.Errors...)
 	}
 
 	return resp
 }
 
-// Note: this function always returns a protobuf QueryPlanNode tree, even if
-// we're going to ignore it, because it makes the code much simpler and more
-// typesafe. However, it doesn't actually ask for traces from the backend
-// service unless we are capturing traces for Studio.
-// ... original comment said.
-func executeNode(ctx context.Context, ec *executionContext, node plan.PlanNode, resultLock *sync.Mutex, results interface{}, path ast.Path) {
-	// TODO capture panic & recover
-	// 以下はgqlgenでの対応パターン
-	//defer func() {
-	//	if r := recover(); r != nil {
-	//		ec.Error(ctx, ec.Recover(ctx, r))
-	//		ret = graphql.Null
-	//	}
-	//}()
+// presentErrors applies the error presenter to errors collected while executing the plan.
+func (ec *executionContext) presentErrors(ctx context.Context) gqlerror.List {
+	ec.errorsLock.Lock()
+	defer ec.errorsLock.Unlock()
+
+	if ec.ErrorPresenter == nil || len(ec.Errors) == 0 {
+		return ec.Errors
+	}
+
+	gErrs := make(gqlerror.List, 0, len(ec.Errors))
+	for _, gErr := range ec.Errors {
+		gErrs = append(gErrs, ec.ErrorPresenter(ctx, gErr))
+	}
+
+	return gErrs
+}
+
+// apiSchemaTypeResolver resolves the runtime type by `__typename` like the default one.
+// typenames that don't exist in the API schema (e.g. @inaccessible types) are treated as unresolvable
+// to avoid leaking them in error messages.
+func apiSchemaTypeResolver(ctx context.Context, value interface{}, schema *ast.Schema, abstractType *ast.Type) string {
+	if !utils.IsObjectLike(value) {
+		return ""
+	}
+	typename, ok := value.(map[string]interface{})["__typename"].(string)
+	if !ok {
+		return ""
+	}
+	if schema.Types[typename] == nil {
+		return ""
+	}
+
+	return typename
+}
+
+// executeNode returns the protobuf QueryPlanNode tree of the federated trace.
+// NOTE unlike Apollo Gateway, it is nil unless traces are captured. see WithFederatedTraceSink.
+func executeNode(ctx context.Context, ec *executionContext, node plan.PlanNode, resultLock *sync.Mutex, results interface{}, path ast.Path) *apollotrace.Trace_QueryPlanNode {
+	ctx, span := ec.startNodeSpan(ctx, node, path)
+	defer span.End()
+
+	// NOTE panic (e.g. merging unexpected shapes) is converted to an error at the path of the node.
+	defer func() {
+		if r := recover(); r != nil {
+			gErr := ec.recover(ctx, r, path)
+			setSpanError(ctx, gErr.Message)
+			ec.addError(gErr)
+		}
+	}()
 
 	switch node := node.(type) {
 	case *plan.SequenceNode:
-		for _, childNode := range node.Nodes {
-			executeNode(ctx, ec, childNode, resultLock, results, path)
+		traceNodes := make([]*apollotrace.Trace_QueryPlanNode, len(node.Nodes))
+		for i, childNode := range node.Nodes {
+			traceNodes[i] = executeNode(ctx, ec, childNode, resultLock, results, path)
+		}
+		if ec.Tracing != nil {
+			return ec.Tracing.sequenceNode(traceNodes)
 		}
 	case *plan.ParallelNode:
+		traceNodes := make([]*apollotrace.Trace_QueryPlanNode, len(node.Nodes))
 		var wg sync.WaitGroup
-		for _, childNode := range node.Nodes {
+		for i, childNode := range node.Nodes {
 			wg.Add(1)
-			childNode := childNode
+			i, childNode := i, childNode
 			go func() {
-				executeNode(ctx, ec, childNode, resultLock, results, path)
-				wg.Done()
+				defer wg.Done()
+				traceNodes[i] = executeNode(ctx, ec, childNode, resultLock, results, path)
 			}()
 		}
 		wg.Wait()
+		if ec.Tracing != nil {
+			return ec.Tracing.parallelNode(traceNodes)
+		}
 	case *plan.FlattenNode:
 		newPath := make(ast.Path, 0, len(path)+len(node.Path))
 		newPath = append(newPath, path...)
 		newPath = append(newPath, node.Path...)
-		executeNode(
+		traceNode := executeNode(
 			ctx,
 			ec,
 			node.Node,
@@ -105,7 +489,14 @@ func executeNode(ctx context.Context, ec *executionContext, node plan.PlanNode,
 			flattenResultsAtPath(resultLock, true, results, node.Path),
 			newPath,
 		)
+		if ec.Tracing != nil {
+			return ec.Tracing.flattenNode(node.Path, traceNode)
+		}
 	case *plan.FetchNode:
+		var traceNodes *fetchTraceNodes
+		if ec.Tracing != nil {
+			traceNodes = &fetchTraceNodes{}
+		}
 		gErr := executeFetch(
 			ctx,
 			ec,
@@ -113,173 +504,479 @@ func executeNode(ctx context.Context, ec *executionContext, node plan.PlanNode,
 			resultLock,
 			results,
 			path,
+			traceNodes,
 		)
 		if gErr != nil {
-			ec.Errors = append(ec.Errors, gErr)
+			setSpanError(ctx, gErr.Message)
+			ec.addError(gErr)
+		}
+		if ec.Tracing != nil {
+			return ec.Tracing.fetchTraceNode(node.ServiceName, traceNodes)
 		}
 
 	default:
 		// ignore
 	}
+
+	return nil
 }
 
-func executeFetch(ctx context.Context, ec *executionContext, fetch *plan.FetchNode, resultLock *sync.Mutex, results interface{}, path ast.Path) *gqlerror.Error {
+// traceNodes collects fetch nodes of the federated trace. it is nil unless traces are captured.
+func executeFetch(ctx context.Context, ec *executionContext, fetch *plan.FetchNode, resultLock *sync.Mutex, results interface{}, path ast.Path, traceNodes *fetchTraceNodes) *gqlerror.Error {
 	service := ec.ServiceMap[fetch.ServiceName]
 
 	if service == nil {
 		return gqlerror.Errorf(`couldn't find service with name "%s"`, fetch.ServiceName)
 	}
 
-	sendOperation := func(ec *executionContext, source string, variables map[string]interface{}) (map[string]interface{}, *gqlerror.Error) {
-		doc, err := parser.ParseQuery(&ast.Source{Input: source})
-		if gErr, ok := err.(*gqlerror.Error); ok {
+	// NOTE resultLock は results の読み書きの間だけ保持する
+	// subgraph への通信中に保持すると ParallelNode 配下の fetch が直列化されてしまう
+	// 1. lock して entities と representations の snapshot を作る
+	// 2. unlock して subgraph に問い合わせる
+	// 3. lock して結果を merge する
+
+	entities, representations, representationToEntity, gErr := snapshotEntities(ctx, ec, fetch, resultLock, results)
+	if gErr != nil {
+		return gErr
+	}
+
+	if len(entities) < 1 {
+		return nil
+	}
+
+	// NOTE the operation deadline is already exceeded. don't send requests that will fail anyway.
+	if ctx.Err() != nil {
+		ec.addError(downstreamServiceError(operationDeadlineError(ctx, fetch.ServiceName), fetch.ServiceName, path))
+		return nil
+	}
+
+	// entitiesOffset is the index of the first representation in variables when the representations are split into batches.
+	sendOperation := func(ec *executionContext, variables map[string]interface{}, entitiesOffset int) (resultObject, *gqlerror.Error) {
+		oc, gErr := newFetchOperationContext(fetch, variables, ec.recoverFunc())
+		if gErr != nil {
 			return nil, gErr
-		} else if err != nil {
-			return nil, gqlerror.WrapPath(nil, err)
 		}
-		oc := &graphql.OperationContext{
-			RawQuery:             source,
-			Variables:            variables,
-			Doc:                  doc,
-			Operation:            doc.Operations.ForName(""),
-			DisableIntrospection: true,
-			RecoverFunc:          graphql.DefaultRecover, // TODO make configurable
-			ResolverMiddleware: func(ctx context.Context, next graphql.Resolver) (res interface{}, err error) {
-				return next(ctx)
-			},
-			Stats: graphql.Stats{}, // TODO support stats
-		}
-
-		response := service.Process(ctx, oc)
-
-		if len(response.Errors) != 0 {
-			for _, gErr := range response.Errors {
-				gErr := downstreamServiceError(gErr, fetch.ServiceName, path)
-				ec.Errors = append(ec.Errors, gErr)
-			}
+
+		var sent, received time.Time
+		var rawResponse *graphql.Response
+		if traceNodes != nil {
+			defer func() {
+				traceNodes.add(ec.Tracing.fetchNode(fetch.ServiceName, sent, received, rawResponse))
+			}()
 		}
 
-		if len(response.Data) == 0 {
-			return nil, nil
+		// errorCount is the number of errors of this request. it is shared by diagnostics and metrics.
+		var errorCount int
+		var diagnostic *FetchDiagnostic
+		if ec.Diagnostics != nil {
+			diagnostic = ec.Diagnostics.begin(fetch.ServiceName, path, oc)
+			defer func() {
+				diagnostic.Errors = errorCount
+				ec.Diagnostics.end(diagnostic)
+			}()
+		}
+		if ec.Metrics != nil {
+			defer func() {
+				// NOTE requests rejected by the circuit breaker aren't sent
+				if !sent.IsZero() && !received.IsZero() {
+					ec.Metrics.ObserveFetch(fetch.ServiceName, received.Sub(sent), representationCount(oc), errorCount)
+				}
+			}()
 		}
 
-		dec := json.NewDecoder(bytes.NewBuffer(response.Data))
-		// UseNumber しないと 1 とかが float64 になってしまい UnmarshalInt とかがコケる
-		dec.UseNumber()
+		// NOTE fail fast while the service is known to be down
+		breaker := ec.Breakers[fetch.ServiceName]
+		var ticket circuitTicket
+		if breaker != nil {
+			var allowed bool
+			ticket, allowed = breaker.allow()
+			if !allowed {
+				gErr := circuitBreakerOpenError(fetch.ServiceName)
+				gErr.Path = path
+				ec.addError(gErr)
+				errorCount = 1
+				setSpanError(ctx, gErr.Message)
+				return nil, nil
+			}
+			// NOTE the probe in half-open state must be released even if the data source panics
+			defer func() {
+				if r := recover(); r != nil {
+					breaker.onFailure(ticket)
+					panic(r)
+				}
+			}()
+		}
 
-		result := make(map[string]interface{})
-		err = dec.Decode(&result)
-		if err != nil {
-			return nil, gqlerror.Errorf("json unmarshal error: %s", err)
+		fetchCtx := ctx
+		if fetch.OperationDocument != nil {
+			fetchCtx = withPlannedFetch(fetchCtx, fetch)
+		}
+		timeout := ec.FetchTimeouts[fetch.ServiceName]
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			fetchCtx, cancel = context.WithTimeout(fetchCtx, timeout)
+			defer cancel()
 		}
 
-		return result, nil
-	}
+		var data map[string]interface{}
+		var responseErrors gqlerror.List
+		var noData bool
+		var decodeErr *gqlerror.Error
+		sent = time.Now()
+		if decodedService, ok := service.(DecodedDataSource); ok && ec.Coalescer == nil && diagnostic == nil {
+			// NOTE the decoded data can't be shared by coalesced fetches because it is merged into the results
+			response := decodedService.ProcessDecoded(fetchCtx, oc)
+			data, responseErrors, noData = response.Data, response.Errors, response.Data == nil
+		} else {
+			var response *graphql.Response
+			if ec.Coalescer != nil {
+				response = ec.Coalescer.process(fetchCtx, service, fetch.ServiceName, oc)
+			} else {
+				response = service.Process(fetchCtx, oc)
+			}
+			rawResponse = response
+			responseErrors, noData = response.Errors, isNullData(response.Data)
+			data, decodeErr = decodeResponseData(response.Data)
+			if diagnostic != nil {
+				diagnostic.ResponseBytes = responseBytes(response)
+			}
+		}
+		received = time.Now()
+		errorCount = len(responseErrors)
+		if decodeErr != nil {
+			errorCount++
+		}
 
-	resultLock.Lock()
-	defer resultLock.Unlock()
-	entities := make([]interface{}, 0)
-	if v, ok := results.([]interface{}); ok {
-		if v != nil {
-			entities = append(entities, v...)
+		// NOTE errors from the service (e.g. "context deadline exceeded") are replaced by the timeout error.
+		// the subtree of this fetch is left as null and the others are kept.
+		if ctx.Err() != nil {
+			if breaker != nil {
+				breaker.onCancel(ticket)
+			}
+			gErr := operationDeadlineError(ctx, fetch.ServiceName)
+			ec.addError(downstreamServiceError(gErr, fetch.ServiceName, path))
+			errorCount = 1
+			setSpanError(ctx, gErr.Message)
+			return nil, nil
+		} else if errors.Is(fetchCtx.Err(), context.DeadlineExceeded) {
+			if breaker != nil {
+				breaker.onFailure(ticket)
+			}
+			gErr := gqlerror.Errorf(`fetch from service "%s" timed out after %s`, fetch.ServiceName, timeout)
+			ec.addError(downstreamServiceError(gErr, fetch.ServiceName, path))
+			errorCount = 1
+			setSpanError(ctx, gErr.Message)
+			return nil, nil
 		}
-	} else {
-		entities = []interface{}{results}
-	}
 
-	if len(entities) < 1 {
-		return nil
-	}
+		if breaker != nil {
+			// NOTE errors without data mean the service couldn't process the request. e.g. network errors.
+			if len(responseErrors) != 0 && noData {
+				breaker.onFailure(ticket)
+			} else {
+				breaker.onSuccess(ticket)
+			}
+		}
 
-	variables := make(map[string]interface{})
-	if len(ec.RequestContext.Variables) != 0 {
-		for _, variableName := range fetch.VariableUsages {
-			providedVariable, ok := ec.RequestContext.Variables[variableName]
-			if ok {
-				variables[variableName] = providedVariable
+		if len(responseErrors) != 0 {
+			setSpanError(ctx, fmt.Sprintf(`%d errors from service "%s"`, len(responseErrors), fetch.ServiceName))
+			var entityPaths []ast.Path
+			for _, gErr := range responseErrors {
+				// NOTE an error of a representation is reported at the response paths of all entities that share it
+				representationIndex, rest, ok := entitiesErrorPath(gErr, entitiesOffset)
+				if !ok || representationIndex >= len(representationToEntity) || ec.Data == nil {
+					ec.addError(downstreamServiceError(gErr, fetch.ServiceName, path))
+					continue
+				}
+				if entityPaths == nil {
+					entityPaths = flattenPathsAtPath(resultLock, ec.Data, path)
+				}
+				for _, entityIndex := range representationToEntity[representationIndex] {
+					errorPath := path
+					if entityIndex < len(entityPaths) {
+						errorPath = make(ast.Path, 0, len(entityPaths[entityIndex])+len(rest))
+						errorPath = append(errorPath, entityPaths[entityIndex]...)
+						errorPath = append(errorPath, rest...)
+					}
+					ec.addError(downstreamServiceError(gErr, fetch.ServiceName, errorPath))
+				}
 			}
 		}
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		if data == nil {
+			return nil, nil
+		}
+
+		return toResultTree(data).(resultObject), nil
 	}
 
+	variables := variablesForFetch(ec.RequestContext, fetch)
+
 	if len(fetch.Requires) == 0 {
-		dataReceivedFromService, gErr := sendOperation(ec, fetch.Operation, variables)
+		dataReceivedFromService, gErr := sendOperation(ec, variables, 0)
 		if gErr != nil {
 			return gErr
 		}
-		for _, entity := range entities {
-			utils.DeepMerge(entity, dataReceivedFromService)
-		}
-	} else {
-		requires := fetch.Requires
 
-		representations := make([]interface{}, 0, len(entities))
-		representationToEntity := make([]int, 0, len(entities))
+		if dataReceivedFromService == nil {
+			return nil
+		}
 
-		for index, entity := range entities {
-			if entity == nil {
-				continue
-			}
-			originalEntity := entity
-			entity, ok := originalEntity.(map[string]interface{})
+		resultLock.Lock()
+		defer resultLock.Unlock()
+		for i, entity := range entities {
+			entity, ok := entity.(resultObject)
 			if !ok {
-				return gqlerror.Errorf("unexpected entity type: %T", originalEntity)
-			}
-			representation, gErr := executeSelectionSet(ctx, ec, entity, requires)
-			if gErr != nil {
-				return gErr
+				continue
 			}
-			if representation != nil && representation["__typename"] != nil {
-				representations = append(representations, representation)
-				representationToEntity = append(representationToEntity, index)
+			received := dataReceivedFromService
+			if i != 0 {
+				// NOTE entities must not share the received objects
+				received = copyResult(received).(resultObject)
 			}
+			mergeResult(entity, received)
 		}
 
-		// If there are no representations, that means the type conditions in
-		// the requires don't match any entities.
-		if len(representations) < 1 {
-			return nil
-		}
+		return nil
+	}
 
-		if _, ok := variables["representations"]; ok {
-			return gqlerror.Errorf(`variables cannot contain key "representations"`)
-		}
+	// If there are no representations, that means the type conditions in
+	// the requires don't match any entities.
+	trace.SpanFromContext(ctx).SetAttributes(AttributeEntityCount.Int(len(representations)))
+	if len(representations) < 1 {
+		return nil
+	}
 
+	if _, ok := variables["representations"]; ok {
+		return gqlerror.Errorf(`variables cannot contain key "representations"`)
+	}
+
+	// NOTE large representations are split into batches and sent concurrently.
+	// received entities are reassembled in the original order.
+	receivedEntities := make(resultList, len(representations))
+	batchSize := ec.MaxBatchSizes[fetch.ServiceName]
+	if batchSize <= 0 {
+		batchSize = len(representations)
+	}
+	sendBatch := func(start, end int) {
 		newVariables := make(map[string]interface{}, len(variables)+1)
 		for k, v := range variables {
 			newVariables[k] = v
 		}
-		newVariables["representations"] = representations
-		dataReceivedFromService, gErr := sendOperation(ec, fetch.Operation, newVariables)
+		newVariables["representations"] = representations[start:end]
+		dataReceivedFromService, gErr := sendOperation(ec, newVariables, start)
 		if gErr != nil {
-			return gErr
+			ec.addError(gErr)
+			return
 		}
 
 		if dataReceivedFromService == nil {
-			return nil
+			return
 		}
 
-		var receivedEntities []interface{}
+		// NOTE entities of the failed batch are left as is. the others are merged.
+		var batchEntities resultList
 		if v, ok := dataReceivedFromService["_entities"]; !ok {
-			return gqlerror.Errorf(`expected "data._entities" in response to be an array`)
-		} else if v, ok := v.([]interface{}); !ok {
-			return gqlerror.Errorf(`expected "data._entities" in response to be an array`)
+			ec.addError(gqlerror.Errorf(`expected "data._entities" in response to be an array`))
+			return
+		} else if v, ok := v.(resultList); !ok {
+			ec.addError(gqlerror.Errorf(`expected "data._entities" in response to be an array`))
+			return
 		} else {
-			receivedEntities = v
+			batchEntities = v
 		}
 
-		if len(receivedEntities) != len(representations) {
-			return gqlerror.Errorf(`expected "data._entities" to contain %d elements`, len(representations))
+		if len(batchEntities) != end-start {
+			ec.addError(gqlerror.Errorf(`expected "data._entities" to contain %d elements`, end-start))
+			return
+		}
+
+		copy(receivedEntities[start:end], batchEntities)
+	}
+
+	if batchSize >= len(representations) {
+		sendBatch(0, len(representations))
+	} else {
+		var wg sync.WaitGroup
+		for start := 0; start < len(representations); start += batchSize {
+			end := start + batchSize
+			if end > len(representations) {
+				end = len(representations)
+			}
+			wg.Add(1)
+			start := start
+			go func() {
+				defer wg.Done()
+				// NOTE executeNode can't recover panics in other goroutines
+				defer func() {
+					if r := recover(); r != nil {
+						ec.addError(ec.recover(ctx, r, path))
+					}
+				}()
+				sendBatch(start, end)
+			}()
 		}
+		wg.Wait()
+	}
 
-		for i := range receivedEntities {
-			utils.DeepMerge(entities[representationToEntity[i]], receivedEntities[i])
+	resultLock.Lock()
+	defer resultLock.Unlock()
+	for i := range receivedEntities {
+		if receivedEntities[i] == nil {
+			continue
+		}
+		receivedEntity, ok := receivedEntities[i].(resultObject)
+		if !ok {
+			ec.addError(gqlerror.ErrorPathf(path, `expected "data._entities" to contain objects. actual: %T`, receivedEntities[i]))
+			continue
+		}
+		for j, entityIndex := range representationToEntity[i] {
+			entity, ok := entities[entityIndex].(resultObject)
+			if !ok {
+				continue
+			}
+			received := receivedEntity
+			if j != 0 {
+				// NOTE entities must not share the received objects. later fetches merge into them separately.
+				received = copyResult(received).(resultObject)
+			}
+			mergeResult(entity, received)
 		}
 	}
 
 	return nil
 }
 
-func executeSelectionSet(ctx context.Context, ec *executionContext, source map[string]interface{}, selections []plan.QueryPlanSelectionNode) (map[string]interface{}, *gqlerror.Error) {
+// snapshotEntities collects entities and representations under the lock.
+// the lock is released even if it panics.
+// identical representations are deduplicated. representationToEntity maps each representation to indices of its entities.
+func snapshotEntities(ctx context.Context, ec *executionContext, fetch *plan.FetchNode, resultLock *sync.Mutex, results interface{}) ([]interface{}, []interface{}, [][]int, *gqlerror.Error) {
+	resultLock.Lock()
+	defer resultLock.Unlock()
+
+	entities := make([]interface{}, 0)
+	if v, ok := results.(resultList); ok {
+		if v != nil {
+			entities = append(entities, v...)
+		}
+	} else {
+		entities = []interface{}{results}
+	}
+
+	if len(entities) < 1 || len(fetch.Requires) == 0 {
+		return entities, nil, nil, nil
+	}
+
+	requires := fetch.Requires
+
+	representations := make([]interface{}, 0, len(entities))
+	representationToEntity := make([][]int, 0, len(entities))
+	representationIndexes := make(map[string]int, len(entities))
+
+	for index, entity := range entities {
+		if entity == nil {
+			continue
+		}
+		originalEntity := entity
+		entity, ok := originalEntity.(resultObject)
+		if !ok {
+			return nil, nil, nil, gqlerror.Errorf("unexpected entity type: %T", originalEntity)
+		}
+		representation, gErr := executeSelectionSet(ctx, ec, entity, requires)
+		if gErr != nil {
+			return nil, nil, nil, gErr
+		}
+		if representation == nil || representation["__typename"] == nil {
+			continue
+		}
+
+		// NOTE encoding/json sorts map keys, so the same representation always has the same key
+		b, err := json.Marshal(representation)
+		if err != nil {
+			return nil, nil, nil, gqlerror.WrapPath(nil, err)
+		}
+		key := string(b)
+		if representationIndex, ok := representationIndexes[key]; ok {
+			representationToEntity[representationIndex] = append(representationToEntity[representationIndex], index)
+			continue
+		}
+		representationIndexes[key] = len(representations)
+		representations = append(representations, representation)
+		representationToEntity = append(representationToEntity, []int{index})
+	}
+
+	return entities, representations, representationToEntity, nil
+}
+
+func newFetchOperationContext(fetch *plan.FetchNode, variables map[string]interface{}, recoverFunc graphql.RecoverFunc) (*graphql.OperationContext, *gqlerror.Error) {
+	if recoverFunc == nil {
+		recoverFunc = graphql.DefaultRecover
+	}
+
+	// NOTE the plan made by hand may not have the parsed operation
+	doc, operation := fetch.OperationDocument, fetch.OperationDefinition
+	if doc == nil {
+		var err error
+		doc, err = parser.ParseQuery(&ast.Source{Input: fetch.Operation})
+		if gErr, ok := err.(*gqlerror.Error); ok {
+			return nil, gErr
+		} else if err != nil {
+			return nil, gqlerror.WrapPath(nil, err)
+		}
+		operation = doc.Operations.ForName("")
+	}
+	oc := &graphql.OperationContext{
+		RawQuery:             fetch.Operation,
+		Variables:            variables,
+		Doc:                  doc,
+		Operation:            operation,
+		DisableIntrospection: true,
+		RecoverFunc:          recoverFunc,
+		ResolverMiddleware: func(ctx context.Context, next graphql.Resolver) (res interface{}, err error) {
+			return next(ctx)
+		},
+		Stats: graphql.Stats{}, // TODO support stats
+	}
+
+	return oc, nil
+}
+
+func variablesForFetch(requestContext *graphql.OperationContext, fetch *plan.FetchNode) map[string]interface{} {
+	variables := make(map[string]interface{})
+	if len(requestContext.Variables) != 0 {
+		for _, variableName := range fetch.VariableUsages {
+			providedVariable, ok := requestContext.Variables[variableName]
+			if ok {
+				variables[variableName] = providedVariable
+			}
+		}
+	}
+
+	return variables
+}
+
+func decodeResponseData(data json.RawMessage) (map[string]interface{}, *gqlerror.Error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewBuffer(data))
+	// UseNumber しないと 1 とかが float64 になってしまい UnmarshalInt とかがコケる
+	dec.UseNumber()
+
+	result := make(map[string]interface{})
+	err := dec.Decode(&result)
+	if err != nil {
+		return nil, gqlerror.Errorf("json unmarshal error: %s", err)
+	}
+
+	return result, nil
+}
+
+// executeSelectionSet makes the representation of the entity. it consists of maps and slices for variables.
+func executeSelectionSet(ctx context.Context, ec *executionContext, source resultObject, selections []plan.QueryPlanSelectionNode) (map[string]interface{}, *gqlerror.Error) {
 	// If the underlying service has returned null for the parent (source)
 	// then there is no need to iterate through the parent's selection set
 	if source == nil {
@@ -299,11 +996,11 @@ func executeSelectionSet(ctx context.Context, ec *executionContext, source map[s
 
 			if source, ok := source[responseName]; !ok {
 				return nil, gqlerror.Errorf(`field "%s" was not found in response`, responseName)
-			} else if sourceArray, ok := source.([]interface{}); ok {
+			} else if sourceArray, ok := source.(resultList); ok {
 				var resultArray []interface{}
 				for _, source := range sourceArray {
 					if len(selections) != 0 {
-						nextValue, ok := source.(map[string]interface{})
+						nextValue, ok := source.(resultObject)
 						if !ok {
 							return nil, gqlerror.Errorf("unexpected type: %T", source)
 						}
@@ -318,7 +1015,7 @@ func executeSelectionSet(ctx context.Context, ec *executionContext, source map[s
 				}
 				result[responseName] = resultArray
 
-			} else if sourceObject, ok := source.(map[string]interface{}); ok {
+			} else if sourceObject, ok := source.(resultObject); ok {
 				subResult, gErr := executeSelectionSet(
 					ctx,
 					ec,
@@ -406,11 +1103,11 @@ func flattenResultsAtPath(resultLock *sync.Mutex, shouldLock bool, value interfa
 	current := path[0]
 	rest := path[1:]
 	if current == ast.PathName("@") {
-		values := value.([]interface{})
-		newValues := make([]interface{}, 0, len(values))
+		values := value.(resultList)
+		newValues := make(resultList, 0, len(values))
 		for _, element := range values {
 			v := flattenResultsAtPath(resultLock, false, element, rest)
-			if vs, ok := v.([]interface{}); ok {
+			if vs, ok := v.(resultList); ok {
 				newValues = append(newValues, vs...)
 			} else {
 				newValues = append(newValues, v)
@@ -418,11 +1115,84 @@ func flattenResultsAtPath(resultLock *sync.Mutex, shouldLock bool, value interfa
 		}
 		return newValues
 	} else {
-		value := value.(map[string]interface{})
+		value := value.(resultObject)
 		return flattenResultsAtPath(resultLock, false, value[string(current.(ast.PathName))], rest)
 	}
 }
 
+// flattenPathsAtPath returns the response paths of values that flattenResultsAtPath returns in the same order.
+// value must be the root of the results because the path is from the root.
+func flattenPathsAtPath(resultLock *sync.Mutex, value interface{}, path ast.Path) []ast.Path {
+	resultLock.Lock()
+	defer resultLock.Unlock()
+
+	var paths []ast.Path
+	var walk func(value interface{}, path ast.Path, current ast.Path)
+	walk = func(value interface{}, path ast.Path, current ast.Path) {
+		if len(path) == 0 {
+			if values, ok := value.(resultList); ok {
+				for i := range values {
+					paths = append(paths, appendPath(current, ast.PathIndex(i)))
+				}
+				return
+			}
+			paths = append(paths, current)
+			return
+		}
+		if value == nil {
+			paths = append(paths, current)
+			return
+		}
+
+		if path[0] == ast.PathName("@") {
+			for i, element := range value.(resultList) {
+				walk(element, path[1:], appendPath(current, ast.PathIndex(i)))
+			}
+		} else {
+			name := path[0].(ast.PathName)
+			walk(value.(resultObject)[string(name)], path[1:], appendPath(current, name))
+		}
+	}
+	walk(value, path, nil)
+
+	return paths
+}
+
+// appendPath makes a new path. paths must not share the backing array.
+func appendPath(path ast.Path, element ast.PathElement) ast.Path {
+	newPath := make(ast.Path, 0, len(path)+1)
+	newPath = append(newPath, path...)
+	return append(newPath, element)
+}
+
+// entitiesErrorPath returns the index in all representations and the rest of the path when the error is about `_entities`.
+// offset is the index of the first representation of the batch.
+func entitiesErrorPath(gErr *gqlerror.Error, offset int) (int, ast.Path, bool) {
+	if len(gErr.Path) < 2 || gErr.Path[0] != ast.PathName("_entities") {
+		return 0, nil, false
+	}
+	index, ok := gErr.Path[1].(ast.PathIndex)
+	if !ok || index < 0 {
+		return 0, nil, false
+	}
+
+	return int(index) + offset, gErr.Path[2:], true
+}
+
+func isNullData(data json.RawMessage) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) == 0 || bytes.Equal(data, []byte("null"))
+}
+
+// operationDeadlineError is for fetches that are interrupted by the deadline or cancellation of the operation.
+func operationDeadlineError(ctx context.Context, serviceName string) *gqlerror.Error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return gqlerror.Errorf(`operation deadline exceeded while fetching from service "%s"`, serviceName)
+	}
+
+	return gqlerror.Errorf(`operation canceled while fetching from service "%s"`, serviceName)
+}
+
 func downstreamServiceError(originalError *gqlerror.Error, serviceName string, path ast.Path) *gqlerror.Error {
 	message := originalError.Message
 	extensions := originalError.Extensions
@@ -442,7 +1212,7 @@ func downstreamServiceError(originalError *gqlerror.Error, serviceName string, p
 	}
 	extensions = newExtensions
 
-	// TODO is this path correct? maybe wrong...?
+	// NOTE path is the response path of the entity for errors in `_entities`, otherwise the path of the fetch
 	newErr := gqlerror.WrapPath(path, originalError)
 	newErr.Message = message
 	newErr.Extensions = extensions
@@ -4,18 +4,32 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"path"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	"github.com/go-logr/logr"
 	testlogr "github.com/go-logr/logr/testing"
 	"github.com/goccy/go-yaml"
 	"github.com/vektah/gqlparser/v2/ast"
 	"github.com/vektah/gqlparser/v2/formatter"
+	"github.com/vektah/gqlparser/v2/gqlerror"
 	"github.com/vektah/gqlparser/v2/parser"
 	"github.com/vektah/gqlparser/v2/validator"
+	"github.com/vvakame/fedeway/internal/execute"
 	"github.com/vvakame/fedeway/internal/log"
 	planpkg "github.com/vvakame/fedeway/internal/plan"
 	"github.com/vvakame/fedeway/internal/planner"
@@ -43,14 +57,6 @@ func TestExecuteQueryPlan(t *testing.T) {
 			ctx := context.Background()
 			ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
 
-			composedSchema, serviceMap := getFederatedTestingSchema(ctx, t)
-
-			{
-				var buf bytes.Buffer
-				formatter.NewFormatter(&buf).FormatSchema(composedSchema.Schema)
-				testutils.CheckGoldenFile(t, buf.Bytes(), path.Join(expectFileDir, "composedSchema.graphqls"))
-			}
-
 			filePath := path.Join(testFileDir, file.Name())
 			b, err := ioutil.ReadFile(filePath)
 			if err != nil {
@@ -62,6 +68,21 @@ func TestExecuteQueryPlan(t *testing.T) {
 				t.SkipNow()
 			}
 
+			var inaccessibleElements []string
+			if v := testutils.FindOptionString(t, "inaccessible", string(b)); v != "" {
+				inaccessibleElements = strings.Split(v, ",")
+			}
+
+			composedSchema, serviceMap := getFederatedTestingSchema(ctx, t, inaccessibleElements...)
+
+			if len(inaccessibleElements) == 0 {
+				var buf bytes.Buffer
+				formatter.NewFormatter(&buf).FormatSchema(composedSchema.Schema)
+				testutils.CheckGoldenFile(t, buf.Bytes(), path.Join(expectFileDir, "composedSchema.graphqls"))
+			}
+
+			fileName := file.Name()[:len(file.Name())-len(".graphql")]
+
 			variables := make(map[string]interface{})
 			variablesFile := testutils.FindOptionString(t, "variable", string(b))
 			if variablesFile != "" {
@@ -83,9 +104,21 @@ func TestExecuteQueryPlan(t *testing.T) {
 			if gErr != nil {
 				t.Fatal(gErr)
 			}
-			gErrs := validator.Validate(composedSchema.Schema, queryDoc)
+			// clients can only request against API schema.
+			// skipAPISchemaValidation is used for checking the execution phase doesn't return @inaccessible fields.
+			validationSchema := composedSchema.APISchema
+			if testutils.FindOptionBool(t, "skipAPISchemaValidation", string(b)) {
+				validationSchema = composedSchema.Schema
+			}
+			gErrs := validator.Validate(validationSchema, queryDoc)
 			if len(gErrs) != 0 {
-				t.Fatal(gErrs)
+				responseBytes, err := json.MarshalIndent(&graphql.Response{Errors: gErrs}, "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				testutils.CheckGoldenFile(t, responseBytes, path.Join(expectFileDir, fileName+".response.json"))
+				return
 			}
 
 			opctx, err := planner.BuildOperationContext(ctx, composedSchema, queryDoc, "")
@@ -115,15 +148,29 @@ func TestExecuteQueryPlan(t *testing.T) {
 				Stats: graphql.Stats{}, // TODO support stats
 			}
 
-			resp := ExecuteQueryPlan(ctx, plan, serviceMap, composedSchema.Schema, oc)
+			var resp interface{}
+			if oc.Operation.Operation == ast.Subscription {
+				// all events are stored in the golden file
+				resp = collectSubscriptionResponses(ctx, ExecuteSubscriptionPlan(ctx, plan, serviceMap, composedSchema, oc))
+			} else {
+				resp = ExecuteQueryPlan(ctx, plan, serviceMap, composedSchema, oc)
+
+				// the JSON path must behave exactly like the decoded path of LocalDataSource
+				jsonServiceMap := make(map[string]DataSource, len(serviceMap))
+				for name, ds := range serviceMap {
+					jsonServiceMap[name] = &jsonDataSource{next: ds}
+				}
+				jsonResp := ExecuteQueryPlan(ctx, plan, jsonServiceMap, composedSchema, oc)
+				if !reflect.DeepEqual(resp, jsonResp) {
+					t.Errorf("unexpected response of the JSON path: %+v", jsonResp)
+				}
+			}
 
 			responseBytes, err := json.MarshalIndent(resp, "", "  ")
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			fileName := file.Name()[:len(file.Name())-len(".graphql")]
-
 			testutils.CheckGoldenFile(t, responseBytes, path.Join(expectFileDir, fileName+".response.json"))
 
 			buf.Reset()
@@ -133,3 +180,758 @@ func TestExecuteQueryPlan(t *testing.T) {
 		})
 	}
 }
+
+// jsonDataSource hides ProcessDecoded of the data source.
+type jsonDataSource struct {
+	next DataSource
+}
+
+func (ds *jsonDataSource) Process(ctx context.Context, oc *graphql.OperationContext) *graphql.Response {
+	return ds.next.Process(ctx, oc)
+}
+
+func TestExecuteQueryPlanParallelFetch(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	const query = `
+		query {
+			me {
+				username
+			}
+			topReviews {
+				body
+			}
+		}
+	`
+
+	composedSchema, serviceMap, plan, oc := planQuery(ctx, t, query)
+
+	parallelNode, ok := plan.Node.(*planpkg.ParallelNode)
+	if !ok {
+		t.Fatalf("unexpected plan node type: %T", plan.Node)
+	}
+
+	// every fetch under the ParallelNode waits until all of them are in flight.
+	// if fetches are serialized, the barrier never opens and fetches time out.
+	barrier := &barrierDataSource{
+		size:    len(parallelNode.Nodes),
+		release: make(chan struct{}),
+		timeout: 5 * time.Second,
+	}
+	for name, ds := range serviceMap {
+		serviceMap[name] = &barrierDataSourceEntry{barrier: barrier, next: ds}
+	}
+
+	resp := ExecuteQueryPlan(ctx, plan, serviceMap, composedSchema, oc)
+	if len(resp.Errors) != 0 {
+		t.Fatal(resp.Errors)
+	}
+
+	if v := atomic.LoadInt32(&barrier.timedOut); v != 0 {
+		t.Errorf("%d fetches didn't overlap with others", v)
+	}
+}
+
+func TestExecuteQueryPlanFetchTimeout(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	const query = `
+		query {
+			topReviews {
+				body
+				product {
+					name
+				}
+			}
+		}
+	`
+
+	tests := []struct {
+		name            string
+		fetchTimeouts   map[string]time.Duration
+		deadline        time.Duration
+		expectedMessage string
+	}{
+		{
+			name:            "fetch timeout",
+			fetchTimeouts:   map[string]time.Duration{"product": 50 * time.Millisecond},
+			expectedMessage: `fetch from service "product" timed out after 50ms`,
+		},
+		{
+			name:            "operation deadline",
+			deadline:        50 * time.Millisecond,
+			expectedMessage: `operation deadline exceeded while fetching from service "product"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := ctx
+			if tt.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.deadline)
+				defer cancel()
+			}
+
+			composedSchema, serviceMap, plan, oc := planQuery(ctx, t, query)
+			serviceMap["product"] = &hangingDataSource{}
+
+			resp := ExecuteQueryPlan(ctx, plan, serviceMap, composedSchema, oc, WithFetchTimeouts(tt.fetchTimeouts))
+			if len(resp.Errors) == 0 {
+				t.Fatal("errors are expected")
+			}
+			for _, gErr := range resp.Errors {
+				if v := gErr.Message; v != tt.expectedMessage {
+					t.Errorf("unexpected message: %s", v)
+				}
+				if v := gErr.Extensions["code"]; v != "DOWNSTREAM_SERVICE_ERROR" {
+					t.Errorf("unexpected code: %v", v)
+				}
+				if v := gErr.Extensions["serviceName"]; v != "product" {
+					t.Errorf("unexpected serviceName: %v", v)
+				}
+			}
+
+			// data from the reviews service is kept
+			if v := string(resp.Data); !strings.Contains(v, `"body":"Love it!"`) {
+				t.Errorf("unexpected data: %s", v)
+			}
+		})
+	}
+}
+
+func TestExecuteQueryPlanDeduplicateRepresentations(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	const query = `
+		query {
+			topReviews(first: 10) {
+				author {
+					id
+					name {
+						first
+					}
+				}
+			}
+		}
+	`
+
+	composedSchema, serviceMap, plan, oc := planQuery(ctx, t, query)
+	accounts := &representationsRecorder{next: serviceMap["accounts"]}
+	serviceMap["accounts"] = accounts
+
+	resp := ExecuteQueryPlan(ctx, plan, serviceMap, composedSchema, oc)
+	if len(resp.Errors) != 0 {
+		t.Fatal(resp.Errors)
+	}
+
+	// reviews are written by 2 users
+	if v := accounts.representations; !reflect.DeepEqual(v, []int{2}) {
+		t.Errorf("unexpected representations: %v", v)
+	}
+
+	var data struct {
+		TopReviews []struct {
+			Author struct {
+				ID   string `json:"id"`
+				Name struct {
+					First string `json:"first"`
+				} `json:"name"`
+			} `json:"author"`
+		} `json:"topReviews"`
+	}
+	err := json.Unmarshal(resp.Data, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.TopReviews) <= 2 {
+		t.Fatalf("unexpected reviews: %s", string(resp.Data))
+	}
+	firstNames := map[string]string{"1": "Ada", "2": "Alan"}
+	for _, review := range data.TopReviews {
+		if v := review.Author.Name.First; v != firstNames[review.Author.ID] {
+			t.Errorf("unexpected first name of %s: %s", review.Author.ID, v)
+		}
+	}
+}
+
+func TestExecuteQueryPlanBatchRepresentations(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	const query = `
+		query {
+			topReviews(first: 10) {
+				author {
+					id
+					name {
+						first
+					}
+				}
+				product {
+					upc
+					name
+				}
+			}
+		}
+	`
+
+	execute := func(t *testing.T, opts ...ExecuteOption) (*graphql.Response, *representationsRecorder) {
+		composedSchema, serviceMap, plan, oc := planQuery(ctx, t, query)
+		product := &representationsRecorder{next: serviceMap["product"], entityError: true}
+		serviceMap["product"] = product
+
+		return ExecuteQueryPlan(ctx, plan, serviceMap, composedSchema, oc, opts...), product
+	}
+
+	expected, product := execute(t)
+	totals := product.representations
+	sum := 0
+	for _, v := range totals {
+		sum += v
+	}
+	if sum <= len(totals)*2 {
+		t.Fatalf("too few representations: %v", totals)
+	}
+
+	resp, product := execute(t, WithMaxBatchSizes(map[string]int{"product": 2}))
+	batchedSum := 0
+	for _, v := range product.representations {
+		if v > 2 {
+			t.Errorf("batch is larger than max size: %d", v)
+		}
+		batchedSum += v
+	}
+	if batchedSum != sum {
+		t.Errorf("unexpected representations: %v", product.representations)
+	}
+
+	if v1, v2 := string(resp.Data), string(expected.Data); v1 != v2 {
+		t.Errorf("unexpected data: %s, expected: %s", v1, v2)
+	}
+
+	// NOTE errors refer to the response paths of entities as clients see them.
+	// representationsRecorder adds an error for the first representation of each request.
+	// a fetch to product has all products. "1" of topReviews[0] and topReviews[3] is deduplicated.
+	// another fetch to product has books of topReviews[4:7].
+	errorPaths := func(resp *graphql.Response) []string {
+		paths := make([]string, 0, len(resp.Errors))
+		for _, gErr := range resp.Errors {
+			paths = append(paths, gErr.Path.String())
+		}
+		sort.Strings(paths)
+		return paths
+	}
+	expectedPaths := []string{
+		"topReviews[0].product",
+		"topReviews[3].product",
+		"topReviews[4].product",
+	}
+	if v := errorPaths(expected); !reflect.DeepEqual(v, expectedPaths) {
+		t.Errorf("unexpected paths: %v", v)
+	}
+	// NOTE errors are added for the first representation of each batch.
+	// "3" and "0136291554" of all products, and "0201633612" of books.
+	expectedPaths = []string{
+		"topReviews[0].product",
+		"topReviews[2].product",
+		"topReviews[3].product",
+		"topReviews[4].product",
+		"topReviews[5].product",
+		"topReviews[6].product",
+	}
+	if v := errorPaths(resp); !reflect.DeepEqual(v, expectedPaths) {
+		t.Errorf("unexpected paths: %v", v)
+	}
+}
+
+func TestExecuteQueryPlanFetchDiagnostics(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	const query = `
+		query {
+			topReviews(first: 5) {
+				body
+				product {
+					upc
+					name
+				}
+			}
+		}
+	`
+
+	composedSchema, serviceMap, plan, oc := planQuery(ctx, t, query)
+	product := &representationsRecorder{next: serviceMap["product"], entityError: true}
+	serviceMap["product"] = product
+
+	resp := ExecuteQueryPlan(ctx, plan, serviceMap, composedSchema, oc)
+	if _, ok := resp.Extensions[FetchDiagnosticsExtension]; ok {
+		t.Error("fetch diagnostics must be opt-in")
+	}
+
+	product.representations = nil
+	resp = ExecuteQueryPlan(ctx, plan, serviceMap, composedSchema, oc, WithFetchDiagnostics(true), WithMaxBatchSizes(map[string]int{"product": 2}))
+	fetches, ok := resp.Extensions[FetchDiagnosticsExtension].([]*FetchDiagnostic)
+	if !ok {
+		t.Fatalf("unexpected extensions: %v", resp.Extensions)
+	}
+
+	var representations []int
+	for i, fetch := range fetches {
+		if fetch.RequestBytes == 0 || fetch.ResponseBytes == 0 {
+			t.Errorf("unexpected sizes: %+v", fetch)
+		}
+		if i != 0 && fetch.StartOffset < fetches[i-1].StartOffset {
+			t.Errorf("fetches must be ordered by the start: %+v", fetches)
+		}
+		switch fetch.ServiceName {
+		case "reviews":
+			if fetch.Representations != 0 || len(fetch.Path) != 0 || fetch.Errors != 0 {
+				t.Errorf("unexpected root fetch: %+v", fetch)
+			}
+		case "product":
+			if v := fetch.Path.String(); !strings.HasPrefix(v, "topReviews.@.product") {
+				t.Errorf("unexpected path: %s", v)
+			}
+			// representationsRecorder adds an error for each batch
+			if fetch.Errors != 1 {
+				t.Errorf("unexpected errors: %d", fetch.Errors)
+			}
+			representations = append(representations, fetch.Representations)
+		}
+	}
+	expected := product.representations
+	sort.Ints(representations)
+	sort.Ints(expected)
+	if len(representations) < 2 || !reflect.DeepEqual(representations, expected) {
+		t.Errorf("unexpected representations: %v, expected: %v", representations, expected)
+	}
+}
+
+// representationsRecorder records the number of representations of each fetch.
+type representationsRecorder struct {
+	next DataSource
+	// entityError adds an error for the first entity of each fetch
+	entityError bool
+
+	mu              sync.Mutex
+	representations []int
+}
+
+func (ds *representationsRecorder) Process(ctx context.Context, oc *graphql.OperationContext) *graphql.Response {
+	if representations, ok := oc.Variables["representations"].([]interface{}); ok {
+		ds.mu.Lock()
+		ds.representations = append(ds.representations, len(representations))
+		ds.mu.Unlock()
+	}
+
+	resp := ds.next.Process(ctx, oc)
+	if ds.entityError {
+		resp.Errors = append(resp.Errors, &gqlerror.Error{
+			Message: "entity error",
+			Path:    ast.Path{ast.PathName("_entities"), ast.PathIndex(0)},
+		})
+	}
+
+	return resp
+}
+
+// hangingDataSource never responds until the context is done.
+type hangingDataSource struct{}
+
+func (ds *hangingDataSource) Process(ctx context.Context, oc *graphql.OperationContext) *graphql.Response {
+	<-ctx.Done()
+	return &graphql.Response{Errors: gqlerror.List{gqlerror.Errorf("%s", ctx.Err().Error())}}
+}
+
+func TestRemoteDataSourceTimeoutBudgetHeader(t *testing.T) {
+	ctx := context.Background()
+
+	budgets := make(chan string, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		budgets <- r.Header.Get(TimeoutBudgetHeader)
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer s.Close()
+
+	ds := &RemoteDataSource{URL: s.URL}
+	oc, gErr := newFetchOperationContext(&planpkg.FetchNode{Operation: `{ __typename }`}, nil, nil)
+	if gErr != nil {
+		t.Fatal(gErr)
+	}
+
+	ds.Process(ctx, oc)
+	if v := <-budgets; v != "" {
+		t.Errorf("unexpected budget without deadline: %s", v)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	ds.Process(ctx, oc)
+	budget, err := strconv.Atoi(<-budgets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if budget <= 0 || budget > int(time.Minute.Milliseconds()) {
+		t.Errorf("unexpected budget: %d", budget)
+	}
+}
+
+type barrierDataSource struct {
+	size    int
+	timeout time.Duration
+
+	mu       sync.Mutex
+	arrived  int
+	release  chan struct{}
+	timedOut int32
+}
+
+type barrierDataSourceEntry struct {
+	barrier *barrierDataSource
+	next    DataSource
+}
+
+func (ds *barrierDataSourceEntry) Process(ctx context.Context, oc *graphql.OperationContext) *graphql.Response {
+	b := ds.barrier
+
+	b.mu.Lock()
+	b.arrived++
+	if b.arrived == b.size {
+		close(b.release)
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-b.release:
+	case <-time.After(b.timeout):
+		atomic.AddInt32(&b.timedOut, 1)
+	}
+
+	return ds.next.Process(ctx, oc)
+}
+
+func TestExecuteQueryPlanRecoverPanic(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	const query = `
+		query {
+			me {
+				username
+			}
+			topReviews {
+				product {
+					name
+				}
+			}
+		}
+	`
+
+	composedSchema, serviceMap, plan, oc := planQuery(ctx, t, query)
+	serviceMap["product"] = &panickingDataSource{}
+	oc.RecoverFunc = func(ctx context.Context, err interface{}) error {
+		return fmt.Errorf("recovered: %v", err)
+	}
+
+	// the data source panics in the goroutine of ParallelNode.
+	// both of fetches for Book and Furniture fail.
+	resp := ExecuteQueryPlan(ctx, plan, serviceMap, composedSchema, oc)
+	if len(resp.Errors) != 2 {
+		t.Fatalf("unexpected errors: %v", resp.Errors)
+	}
+	for _, gErr := range resp.Errors {
+		if v := gErr.Message; !strings.HasPrefix(v, "recovered: ") {
+			t.Errorf("unexpected message: %s", v)
+		}
+		if v := gErr.Path.String(); v != "topReviews.@.product" {
+			t.Errorf("unexpected path: %s", v)
+		}
+	}
+	if v := string(resp.Data); !strings.Contains(v, `"username":"@ada"`) {
+		t.Errorf("unexpected data: %s", v)
+	}
+}
+
+// panickingDataSource panics in Process.
+type panickingDataSource struct{}
+
+func (ds *panickingDataSource) Process(ctx context.Context, oc *graphql.OperationContext) *graphql.Response {
+	panic("panickingDataSource")
+}
+
+func TestExecuteQueryPlanNonObjectEntities(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	const query = `
+		query {
+			me {
+				username
+			}
+			topReviews {
+				product {
+					name
+				}
+			}
+		}
+	`
+
+	composedSchema, serviceMap, plan, oc := planQuery(ctx, t, query)
+	serviceMap["product"] = &brokenEntitiesDataSource{}
+
+	// non-object entities are reported as errors. the other fields are still resolved.
+	resp := ExecuteQueryPlan(ctx, plan, serviceMap, composedSchema, oc)
+	if len(resp.Errors) == 0 {
+		t.Fatal("errors are expected")
+	}
+	for _, gErr := range resp.Errors {
+		if v := gErr.Message; v != `expected "data._entities" to contain objects. actual: string` {
+			t.Errorf("unexpected message: %s", v)
+		}
+		if v := gErr.Path.String(); v != "topReviews.@.product" {
+			t.Errorf("unexpected path: %s", v)
+		}
+	}
+	if v := string(resp.Data); !strings.Contains(v, `"username":"@ada"`) {
+		t.Errorf("unexpected data: %s", v)
+	}
+}
+
+// brokenEntitiesDataSource returns non-object entities.
+type brokenEntitiesDataSource struct{}
+
+func (ds *brokenEntitiesDataSource) Process(ctx context.Context, oc *graphql.OperationContext) *graphql.Response {
+	representations, _ := oc.Variables["representations"].([]interface{})
+	entities := make([]interface{}, 0, len(representations))
+	for range representations {
+		entities = append(entities, "broken")
+	}
+
+	b, err := json.Marshal(map[string]interface{}{
+		"_entities": entities,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return &graphql.Response{Data: b}
+}
+
+func collectSubscriptionResponses(ctx context.Context, next graphql.ResponseHandler) []*graphql.Response {
+	resps := make([]*graphql.Response, 0)
+	for {
+		resp := next(ctx)
+		if resp == nil {
+			return resps
+		}
+		resps = append(resps, resp)
+	}
+}
+
+func TestExecuteSubscriptionPlanOverWebsocket(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	const fileName = "subscription_executes_rest_of_plan_for_each_event"
+	b, err := ioutil.ReadFile(path.Join("./_testdata/executeQueryPlan/assets", fileName+".graphql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	composedSchema, serviceMap, plan, oc := planQuery(ctx, t, string(b))
+
+	srv := handler.New(serviceMap["reviews"].(*LocalDataSource).ExecutableSchema)
+	srv.AddTransport(transport.Websocket{})
+	s := httptest.NewServer(srv)
+	defer s.Close()
+	serviceMap["reviews"] = &RemoteDataSource{URL: s.URL}
+
+	resps := collectSubscriptionResponses(ctx, ExecuteSubscriptionPlan(ctx, plan, serviceMap, composedSchema, oc))
+	responseBytes, err := json.MarshalIndent(resps, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same result as LocalDataSource
+	testutils.CheckGoldenFile(t, responseBytes, path.Join("./_testdata/executeQueryPlan/expected", fileName+".response.json"))
+}
+
+func TestExecuteQueryPlanSharedPlan(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	const query = `
+		query ($first: Int, $withBody: Boolean!) {
+			topProducts(first: $first) {
+				name
+				reviews {
+					body @include(if: $withBody)
+				}
+			}
+		}
+	`
+
+	// NOTE the plan is built once and executed concurrently like cached plans
+	composedSchema, serviceMap, plan, planned := planQuery(ctx, t, query)
+
+	var fetches []*planpkg.FetchNode
+	var walk func(node planpkg.PlanNode)
+	walk = func(node planpkg.PlanNode) {
+		switch node := node.(type) {
+		case *planpkg.SequenceNode:
+			for _, node := range node.Nodes {
+				walk(node)
+			}
+		case *planpkg.ParallelNode:
+			for _, node := range node.Nodes {
+				walk(node)
+			}
+		case *planpkg.FlattenNode:
+			walk(node.Node)
+		case *planpkg.FetchNode:
+			fetches = append(fetches, node)
+		}
+	}
+	walk(plan.Node)
+	if len(fetches) == 0 {
+		t.Fatal("fetch nodes are not found")
+	}
+	for _, fetch := range fetches {
+		if fetch.OperationDocument == nil || fetch.OperationDefinition == nil {
+			t.Errorf("operation is not parsed: %s", fetch.Operation)
+		}
+	}
+
+	execute := func() *graphql.Response {
+		oc := &graphql.OperationContext{
+			RawQuery:  planned.RawQuery,
+			Variables: map[string]interface{}{"first": 3, "withBody": true},
+			Doc:       planned.Doc,
+			Operation: planned.Operation,
+		}
+		return ExecuteQueryPlan(ctx, plan, serviceMap, composedSchema, oc)
+	}
+
+	expected := execute()
+	if len(expected.Errors) != 0 {
+		t.Fatal(expected.Errors)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := execute()
+			if len(resp.Errors) != 0 {
+				t.Error(resp.Errors)
+				return
+			}
+			if v := string(resp.Data); v != string(expected.Data) {
+				t.Errorf("unexpected data: %s", v)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// NOTE LocalDataSource keeps the validation result in the plan, not in the data source.
+	// fetches[0] is the root fetch, the others may be skipped by the result.
+	fetches[0].ValidateOnce(func(doc *ast.QueryDocument) gqlerror.List {
+		t.Errorf("operation is not validated: %s", fetches[0].Operation)
+		return nil
+	})
+}
+
+const benchmarkQuery = `
+	query {
+		topProducts(first: 5) {
+			__typename
+			name
+			price
+			reviews {
+				body
+				author {
+					username
+					name {
+						first
+						last
+					}
+				}
+			}
+		}
+		topReviews(first: 5) {
+			body
+			product {
+				name
+			}
+		}
+	}
+`
+
+func prepareBenchmark(b *testing.B) (context.Context, *planner.ComposedSchema, ServiceMap, *planpkg.QueryPlan, *graphql.OperationContext) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, logr.Discard())
+
+	composedSchema, serviceMap, plan, oc := planQuery(ctx, b, benchmarkQuery)
+
+	return ctx, composedSchema, serviceMap, plan, oc
+}
+
+func BenchmarkExecuteQueryPlan(b *testing.B) {
+	ctx, composedSchema, serviceMap, plan, oc := prepareBenchmark(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp := ExecuteQueryPlan(ctx, plan, serviceMap, composedSchema, oc)
+		if len(resp.Errors) != 0 {
+			b.Fatal(resp.Errors)
+		}
+	}
+}
+
+// BenchmarkBuildResponse compares the result tree with execute.Execute that was used to shape all responses.
+func BenchmarkBuildResponse(b *testing.B) {
+	ctx, composedSchema, serviceMap, plan, oc := prepareBenchmark(b)
+
+	ec := newExecutionContext(plan, serviceMap, composedSchema, oc, newExecuteConfig(nil))
+	data := make(resultObject)
+	var resultLock sync.Mutex
+	executeNode(ctx, ec, plan.Node, &resultLock, data, nil)
+	if len(ec.Errors) != 0 {
+		b.Fatal(ec.Errors)
+	}
+
+	b.Run("resultTree", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			resp := buildResponse(ctx, ec, data)
+			if len(resp.Errors) != 0 {
+				b.Fatal(resp.Errors)
+			}
+		}
+	})
+	b.Run("execute", func(b *testing.B) {
+		rootValue := fromResultTree(copyResult(data))
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			resp := execute.Execute(ctx, &execute.ExecutionArgs{
+				Schema:         composedSchema.APISchema,
+				RawQuery:       oc.RawQuery,
+				Document:       oc.Doc,
+				RootValue:      rootValue,
+				VariableValues: oc.Variables,
+				TypeResolver:   apiSchemaTypeResolver,
+			})
+			if len(resp.Errors) != 0 {
+				b.Fatal(resp.Errors)
+			}
+		}
+	})
+}
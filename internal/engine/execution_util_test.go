@@ -2,9 +2,11 @@ package engine
 
 import (
 	"context"
+	"strings"
 	"testing"
 
 	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2"
 	"github.com/vektah/gqlparser/v2/ast"
 	"github.com/vektah/gqlparser/v2/parser"
 	"github.com/vektah/gqlparser/v2/validator"
@@ -15,6 +17,7 @@ import (
 	"github.com/vvakame/fedeway/internal/engine/subgraphs/product"
 	"github.com/vvakame/fedeway/internal/engine/subgraphs/reviews"
 	"github.com/vvakame/fedeway/internal/federation"
+	planpkg "github.com/vvakame/fedeway/internal/plan"
 	"github.com/vvakame/fedeway/internal/planner"
 )
 
@@ -24,7 +27,9 @@ type ServiceDefinitionModule interface {
 	ExecutableSchema() graphql.ExecutableSchema
 }
 
-func getFederatedTestingSchema(ctx context.Context, t *testing.T) (*planner.ComposedSchema, ServiceMap) {
+// getFederatedTestingSchema returns composed schema of testing subgraphs.
+// inaccessibleElements are marked as @inaccessible in supergraph. e.g. "User.ssn", "Car".
+func getFederatedTestingSchema(ctx context.Context, t testing.TB, inaccessibleElements ...string) (*planner.ComposedSchema, ServiceMap) {
 	fixtures := []ServiceDefinitionModule{
 		accounts.NewExecutableSchema(),
 		books.NewExecutableSchema(),
@@ -74,6 +79,10 @@ func getFederatedTestingSchema(ctx context.Context, t *testing.T) (*planner.Comp
 		t.Fatal(gErr)
 	}
 
+	if len(inaccessibleElements) != 0 {
+		markInaccessible(t, schemaDoc, inaccessibleElements)
+	}
+
 	cs, err := planner.BuildComposedSchema(ctx, schemaDoc)
 	if err != nil {
 		t.Fatal(err)
@@ -81,3 +90,69 @@ func getFederatedTestingSchema(ctx context.Context, t *testing.T) (*planner.Comp
 
 	return cs, serviceMap
 }
+
+// planQuery builds the query plan of the query against testing subgraphs.
+// the operation context has no variables. data sources in serviceMap can be replaced before executing the plan.
+func planQuery(ctx context.Context, t testing.TB, query string) (*planner.ComposedSchema, ServiceMap, *planpkg.QueryPlan, *graphql.OperationContext) {
+	t.Helper()
+
+	composedSchema, serviceMap := getFederatedTestingSchema(ctx, t)
+
+	queryDoc, gErrs := gqlparser.LoadQuery(composedSchema.APISchema, query)
+	if len(gErrs) != 0 {
+		t.Fatal(gErrs)
+	}
+	opctx, err := planner.BuildOperationContext(ctx, composedSchema, queryDoc, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	qp, err := planner.BuildQueryPlan(ctx, opctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oc := &graphql.OperationContext{
+		RawQuery:  query,
+		Variables: map[string]interface{}{},
+		Doc:       queryDoc,
+		Operation: queryDoc.Operations.ForName(""),
+	}
+
+	return composedSchema, serviceMap, qp, oc
+}
+
+func markInaccessible(t testing.TB, schemaDoc *ast.SchemaDocument, elements []string) {
+	t.Helper()
+
+	if schemaDoc.Directives.ForName("inaccessible") == nil {
+		schemaDoc.Directives = append(schemaDoc.Directives, &ast.DirectiveDefinition{
+			Name: "inaccessible",
+			Locations: []ast.DirectiveLocation{
+				ast.LocationFieldDefinition,
+				ast.LocationObject,
+				ast.LocationInterface,
+				ast.LocationUnion,
+			},
+		})
+	}
+
+	for _, element := range elements {
+		typeName, fieldName, isField := strings.Cut(element, ".")
+		def := schemaDoc.Definitions.ForName(typeName)
+		if def == nil {
+			t.Fatalf("type %s is not found", typeName)
+		}
+
+		directive := &ast.Directive{Name: "inaccessible"}
+		if !isField {
+			def.Directives = append(def.Directives, directive)
+			continue
+		}
+
+		fieldDef := def.Fields.ForName(fieldName)
+		if fieldDef == nil {
+			t.Fatalf("field %s is not found", element)
+		}
+		fieldDef.Directives = append(fieldDef.Directives, directive)
+	}
+}
@@ -0,0 +1,321 @@
+package engine
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	apollotrace "github.com/99designs/gqlgen/graphql/handler/apollofederatedtracingv1/generated"
+	"github.com/vektah/gqlparser/v2/ast"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// FederatedTraceHeader asks subgraphs to return their trace in extensions.ftv1. the value is "ftv1".
+const FederatedTraceHeader = "apollo-federation-include-trace"
+
+// FederatedTrace is the trace of an operation. traces of subgraphs are stitched in Trace.QueryPlan
+// like Apollo Gateway does. fetches without the trace (e.g. LocalDataSource) have only timings of the gateway side.
+type FederatedTrace struct {
+	OperationName string
+	Query         string
+	Trace         *apollotrace.Trace
+}
+
+// FederatedTraceSink receives traces of operations. it is called by concurrent executions.
+// ExportTrace is called on the request path after the response is made. implementations must not block,
+// e.g. send traces by another goroutine and drop them when it can't catch up, like FileTraceSink does.
+type FederatedTraceSink interface {
+	ExportTrace(ctx context.Context, trace *FederatedTrace) error
+}
+
+type includeTraceKey struct{}
+
+// withIncludeTrace tells data sources to ask the trace to the service.
+func withIncludeTrace(ctx context.Context) context.Context {
+	return context.WithValue(ctx, includeTraceKey{}, true)
+}
+
+func shouldIncludeTrace(ctx context.Context) bool {
+	v, _ := ctx.Value(includeTraceKey{}).(bool)
+	return v
+}
+
+// federatedTracing builds the query plan node tree of the trace while executing the plan.
+type federatedTracing struct {
+	sink  FederatedTraceSink
+	start time.Time
+}
+
+func newFederatedTracing(sink FederatedTraceSink) *federatedTracing {
+	return &federatedTracing{
+		sink:  sink,
+		start: time.Now(),
+	}
+}
+
+// NOTE nodes may have nil for children that panicked. protobuf doesn't accept nil in repeated fields.
+func compactTraceNodes(nodes []*apollotrace.Trace_QueryPlanNode) []*apollotrace.Trace_QueryPlanNode {
+	compacted := nodes[:0]
+	for _, node := range nodes {
+		if node != nil {
+			compacted = append(compacted, node)
+		}
+	}
+
+	return compacted
+}
+
+func (ft *federatedTracing) sequenceNode(nodes []*apollotrace.Trace_QueryPlanNode) *apollotrace.Trace_QueryPlanNode {
+	return &apollotrace.Trace_QueryPlanNode{
+		Node: &apollotrace.Trace_QueryPlanNode_Sequence{
+			Sequence: &apollotrace.Trace_QueryPlanNode_SequenceNode{Nodes: compactTraceNodes(nodes)},
+		},
+	}
+}
+
+func (ft *federatedTracing) parallelNode(nodes []*apollotrace.Trace_QueryPlanNode) *apollotrace.Trace_QueryPlanNode {
+	return &apollotrace.Trace_QueryPlanNode{
+		Node: &apollotrace.Trace_QueryPlanNode_Parallel{
+			Parallel: &apollotrace.Trace_QueryPlanNode_ParallelNode{Nodes: compactTraceNodes(nodes)},
+		},
+	}
+}
+
+func (ft *federatedTracing) flattenNode(path ast.Path, node *apollotrace.Trace_QueryPlanNode) *apollotrace.Trace_QueryPlanNode {
+	responsePath := make([]*apollotrace.Trace_QueryPlanNode_ResponsePathElement, 0, len(path))
+	for _, elem := range path {
+		switch elem := elem.(type) {
+		case ast.PathName:
+			responsePath = append(responsePath, &apollotrace.Trace_QueryPlanNode_ResponsePathElement{
+				Id: &apollotrace.Trace_QueryPlanNode_ResponsePathElement_FieldName{FieldName: string(elem)},
+			})
+		case ast.PathIndex:
+			responsePath = append(responsePath, &apollotrace.Trace_QueryPlanNode_ResponsePathElement{
+				Id: &apollotrace.Trace_QueryPlanNode_ResponsePathElement_Index{Index: uint32(elem)},
+			})
+		}
+	}
+
+	return &apollotrace.Trace_QueryPlanNode{
+		Node: &apollotrace.Trace_QueryPlanNode_Flatten{
+			Flatten: &apollotrace.Trace_QueryPlanNode_FlattenNode{
+				ResponsePath: responsePath,
+				Node:         node,
+			},
+		},
+	}
+}
+
+// fetchNode records a request to the service. sent is zero when no request is sent.
+func (ft *federatedTracing) fetchNode(serviceName string, sent, received time.Time, response *graphql.Response) *apollotrace.Trace_QueryPlanNode {
+	fetch := &apollotrace.Trace_QueryPlanNode_FetchNode{
+		ServiceName: serviceName,
+	}
+	if !sent.IsZero() {
+		fetch.SentTimeOffset = uint64(sent.Sub(ft.start))
+		fetch.SentTime = timestamppb.New(sent)
+		fetch.ReceivedTime = timestamppb.New(received)
+	}
+
+	if response != nil && response.Extensions["ftv1"] != nil {
+		trace, err := decodeFTV1(response.Extensions["ftv1"])
+		if err != nil {
+			fetch.TraceParsingFailed = true
+		} else {
+			fetch.Trace = trace
+		}
+	}
+
+	return &apollotrace.Trace_QueryPlanNode{
+		Node: &apollotrace.Trace_QueryPlanNode_Fetch{Fetch: fetch},
+	}
+}
+
+// decodeFTV1 decodes extensions.ftv1 of the response. it is a base64 encoded protobuf message.
+func decodeFTV1(v interface{}) (*apollotrace.Trace, error) {
+	ftv1, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected ftv1 type: %T", v)
+	}
+	b, err := base64.StdEncoding.DecodeString(ftv1)
+	if err != nil {
+		return nil, err
+	}
+	trace := &apollotrace.Trace{}
+	err = proto.Unmarshal(b, trace)
+	if err != nil {
+		return nil, err
+	}
+
+	return trace, nil
+}
+
+// export sends the trace of the operation to the sink.
+func (ft *federatedTracing) export(ctx context.Context, requestContext *graphql.OperationContext, queryPlan *apollotrace.Trace_QueryPlanNode) error {
+	end := time.Now()
+	operationName := requestContext.OperationName
+	if operationName == "" && requestContext.Operation != nil {
+		operationName = requestContext.Operation.Name
+	}
+
+	return ft.sink.ExportTrace(ctx, &FederatedTrace{
+		OperationName: operationName,
+		Query:         requestContext.RawQuery,
+		Trace: &apollotrace.Trace{
+			StartTime:  timestamppb.New(ft.start),
+			EndTime:    timestamppb.New(end),
+			DurationNs: uint64(end.Sub(ft.start)),
+			QueryPlan:  queryPlan,
+		},
+	})
+}
+
+// fetchTraceNodes collects fetch nodes of a FetchNode. batches are recorded concurrently.
+type fetchTraceNodes struct {
+	mu    sync.Mutex
+	nodes []*apollotrace.Trace_QueryPlanNode
+}
+
+func (t *fetchTraceNodes) add(node *apollotrace.Trace_QueryPlanNode) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nodes = append(t.nodes, node)
+}
+
+// fetchTraceNode returns the fetch node of the FetchNode. split batches become a parallel node.
+func (ft *federatedTracing) fetchTraceNode(serviceName string, t *fetchTraceNodes) *apollotrace.Trace_QueryPlanNode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch len(t.nodes) {
+	case 0:
+		// NOTE no entities to fetch
+		return ft.fetchNode(serviceName, time.Time{}, time.Time{}, nil)
+	case 1:
+		return t.nodes[0]
+	default:
+		return ft.parallelNode(t.nodes)
+	}
+}
+
+var _ FederatedTraceSink = (*FileTraceSink)(nil)
+
+// fileTraceSinkBufferSize is the number of traces that FileTraceSink keeps until they are written.
+const fileTraceSinkBufferSize = 1024
+
+var errTraceBufferFull = errors.New("trace buffer is full. the trace is dropped")
+
+// FileTraceSink appends traces to the file as JSON lines. the trace is encoded by protojson.
+// traces are written by another goroutine. they are dropped when the buffer is full.
+// it is for testing and debugging.
+type FileTraceSink struct {
+	w      io.WriteCloser
+	traces chan *FederatedTrace
+	done   chan struct{}
+
+	mu       sync.RWMutex
+	closed   bool
+	writeErr error
+}
+
+// NewFileTraceSink opens the file to append traces. the file is created if it doesn't exist.
+func NewFileTraceSink(path string) (*FileTraceSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return newFileTraceSink(file, fileTraceSinkBufferSize), nil
+}
+
+func newFileTraceSink(w io.WriteCloser, bufferSize int) *FileTraceSink {
+	s := &FileTraceSink{
+		w:      w,
+		traces: make(chan *FederatedTrace, bufferSize),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+
+	return s
+}
+
+func (s *FileTraceSink) ExportTrace(ctx context.Context, trace *FederatedTrace) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return errors.New("FileTraceSink is closed")
+	}
+
+	select {
+	case s.traces <- trace:
+		return nil
+	default:
+		return errTraceBufferFull
+	}
+}
+
+// run writes traces until the sink is closed. the first error is reported by Close.
+func (s *FileTraceSink) run() {
+	defer close(s.done)
+
+	for trace := range s.traces {
+		err := s.write(trace)
+		if err != nil && s.writeErr == nil {
+			s.writeErr = err
+		}
+	}
+}
+
+func (s *FileTraceSink) write(trace *FederatedTrace) error {
+	b, err := protojson.Marshal(trace.Trace)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(&struct {
+		OperationName string          `json:"operationName,omitempty"`
+		Query         string          `json:"query"`
+		Trace         json.RawMessage `json:"trace"`
+	}{
+		OperationName: trace.OperationName,
+		Query:         trace.Query,
+		Trace:         b,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	_, err = s.w.Write(line)
+	return err
+}
+
+// Close writes buffered traces and closes the file.
+func (s *FileTraceSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.traces)
+	s.mu.Unlock()
+
+	<-s.done
+
+	err := s.w.Close()
+	if s.writeErr != nil {
+		return s.writeErr
+	}
+	return err
+}
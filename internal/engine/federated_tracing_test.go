@@ -0,0 +1,243 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/apollofederatedtracingv1"
+	apollotrace "github.com/99designs/gqlgen/graphql/handler/apollofederatedtracingv1/generated"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	testlogr "github.com/go-logr/logr/testing"
+	"github.com/vvakame/fedeway/internal/engine/subgraphs/accounts"
+	"github.com/vvakame/fedeway/internal/engine/subgraphs/reviews"
+	"github.com/vvakame/fedeway/internal/log"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+var _ FederatedTraceSink = (*memoryTraceSink)(nil)
+
+type memoryTraceSink struct {
+	mu     sync.Mutex
+	traces []*FederatedTrace
+}
+
+func (s *memoryTraceSink) ExportTrace(ctx context.Context, trace *FederatedTrace) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.traces = append(s.traces, trace)
+	return nil
+}
+
+// newTracingServer serves the subgraph over HTTP with gqlgen's federated tracing.
+func newTracingServer(es graphql.ExecutableSchema) *httptest.Server {
+	srv := handler.New(es)
+	srv.AddTransport(transport.POST{})
+	srv.Use(&apollofederatedtracingv1.Tracer{})
+
+	return httptest.NewServer(srv)
+}
+
+func TestExecuteQueryPlanFederatedTrace(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	const query = `
+		query TopReviews {
+			topReviews(first: 2) {
+				body
+				author {
+					name {
+						first
+					}
+				}
+			}
+		}
+	`
+
+	composedSchema, serviceMap, qp, oc := planQuery(ctx, t, query)
+	reviewsServer := newTracingServer(reviews.NewExecutableSchema().ExecutableSchema())
+	defer reviewsServer.Close()
+	serviceMap["reviews"] = &RemoteDataSource{URL: reviewsServer.URL}
+	accountsServer := newTracingServer(accounts.NewExecutableSchema().ExecutableSchema())
+	defer accountsServer.Close()
+	serviceMap["accounts"] = &RemoteDataSource{URL: accountsServer.URL}
+
+	sink := &memoryTraceSink{}
+	resp := ExecuteQueryPlan(ctx, qp, serviceMap, composedSchema, oc, WithFederatedTraceSink(sink))
+	if len(resp.Errors) != 0 {
+		t.Fatal(resp.Errors)
+	}
+
+	if len(sink.traces) != 1 {
+		t.Fatalf("unexpected traces: %d", len(sink.traces))
+	}
+	trace := sink.traces[0]
+	if trace.OperationName != "TopReviews" || trace.Query != query {
+		t.Errorf("unexpected operation: %s", trace.OperationName)
+	}
+	if trace.Trace.StartTime == nil || trace.Trace.EndTime == nil || trace.Trace.DurationNs == 0 {
+		t.Errorf("unexpected timings: %v", trace.Trace)
+	}
+
+	sequence := trace.Trace.QueryPlan.GetSequence()
+	if sequence == nil || len(sequence.Nodes) != 2 {
+		t.Fatalf("unexpected query plan: %v", trace.Trace.QueryPlan)
+	}
+	checkFetch := func(fetch *apollotrace.Trace_QueryPlanNode_FetchNode, serviceName string, rootField string) {
+		t.Helper()
+
+		if fetch == nil {
+			t.Fatal("fetch node is missing")
+		}
+		if fetch.ServiceName != serviceName {
+			t.Errorf("unexpected service: %s", fetch.ServiceName)
+		}
+		if fetch.TraceParsingFailed || fetch.Trace == nil {
+			t.Fatalf("trace of %s is missing", serviceName)
+		}
+		if fetch.SentTime == nil || fetch.ReceivedTime == nil {
+			t.Errorf("unexpected timings: %v", fetch)
+		}
+		if children := fetch.Trace.Root.GetChild(); len(children) != 1 || children[0].GetResponseName() != rootField {
+			t.Errorf("unexpected trace of %s: %v", serviceName, fetch.Trace.Root)
+		}
+	}
+	checkFetch(sequence.Nodes[0].GetFetch(), "reviews", "topReviews")
+
+	flatten := sequence.Nodes[1].GetFlatten()
+	if flatten == nil {
+		t.Fatalf("unexpected node: %v", sequence.Nodes[1])
+	}
+	var path []string
+	for _, elem := range flatten.ResponsePath {
+		path = append(path, elem.GetFieldName())
+	}
+	if len(path) != 3 || path[0] != "topReviews" || path[1] != "@" || path[2] != "author" {
+		t.Errorf("unexpected path: %v", path)
+	}
+	checkFetch(flatten.Node.GetFetch(), "accounts", "_entities")
+
+	t.Run("file sink", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "traces.jsonl")
+		fileSink, err := NewFileTraceSink(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fileSink.ExportTrace(ctx, trace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fileSink.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1024*1024)
+		var lines int
+		for scanner.Scan() {
+			lines++
+			var v struct {
+				OperationName string          `json:"operationName"`
+				Trace         json.RawMessage `json:"trace"`
+			}
+			err := json.Unmarshal(scanner.Bytes(), &v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.OperationName != "TopReviews" {
+				t.Errorf("unexpected operation: %s", v.OperationName)
+			}
+			decoded := &apollotrace.Trace{}
+			err = protojson.Unmarshal(v.Trace, decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(decoded, trace.Trace) {
+				t.Errorf("unexpected trace: %v", decoded)
+			}
+		}
+		if lines != 1 {
+			t.Errorf("unexpected lines: %d", lines)
+		}
+	})
+}
+
+// blockingWriter blocks writes until release is closed.
+type blockingWriter struct {
+	writing chan struct{}
+	release chan struct{}
+
+	mu    sync.Mutex
+	lines int
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.writing <- struct{}{}
+	<-w.release
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lines++
+
+	return len(p), nil
+}
+
+func (w *blockingWriter) Close() error {
+	return nil
+}
+
+func TestFileTraceSinkDropsTraces(t *testing.T) {
+	ctx := context.Background()
+
+	w := &blockingWriter{
+		writing: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+	sink := newFileTraceSink(w, 1)
+
+	trace := &FederatedTrace{Query: "{ me { id } }", Trace: &apollotrace.Trace{}}
+	// the first one is being written and the second one is in the buffer
+	err := sink.ExportTrace(ctx, trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-w.writing
+	err = sink.ExportTrace(ctx, trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.ExportTrace(ctx, trace)
+	if err != errTraceBufferFull {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	close(w.release)
+	err = sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.lines != 2 {
+		t.Errorf("unexpected lines: %d", w.lines)
+	}
+	err = sink.ExportTrace(ctx, trace)
+	if err == nil {
+		t.Error("closed sink accepts the trace")
+	}
+}
@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// FetchDiagnosticsExtension is the key of the fetch diagnostics in extensions of the response.
+const FetchDiagnosticsExtension = "fetches"
+
+// FetchDiagnostic is the record of a request to the service. split batches are recorded separately.
+// durations are in nanoseconds like Apollo Tracing.
+type FetchDiagnostic struct {
+	ServiceName     string   `json:"serviceName"`
+	Path            ast.Path `json:"path"`
+	Representations int      `json:"representations"` // 0 for fetches without requires
+	RequestBytes    int      `json:"requestBytes"`
+	ResponseBytes   int      `json:"responseBytes"`
+	StartOffset     int64    `json:"startOffset"` // from the start of the execution
+	Duration        int64    `json:"duration"`
+	Errors          int      `json:"errors"`
+}
+
+// fetchDiagnostics collects FetchDiagnostic of an execution.
+type fetchDiagnostics struct {
+	start time.Time
+
+	mu      sync.Mutex
+	fetches []*FetchDiagnostic
+}
+
+func newFetchDiagnostics() *fetchDiagnostics {
+	return &fetchDiagnostics{
+		start: time.Now(),
+	}
+}
+
+// begin starts the record of the request. the caller fills the rest and calls end.
+func (d *fetchDiagnostics) begin(serviceName string, path ast.Path, oc *graphql.OperationContext) *FetchDiagnostic {
+	fetch := &FetchDiagnostic{
+		ServiceName:     serviceName,
+		Path:            path,
+		RequestBytes:    requestBytes(oc),
+		Representations: representationCount(oc),
+		StartOffset:     int64(time.Since(d.start)),
+	}
+	if fetch.Path == nil {
+		fetch.Path = ast.Path{}
+	}
+
+	return fetch
+}
+
+func (d *fetchDiagnostics) end(fetch *FetchDiagnostic) {
+	fetch.Duration = int64(time.Since(d.start)) - fetch.StartOffset
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.fetches = append(d.fetches, fetch)
+}
+
+// list returns records in the order of their start.
+func (d *fetchDiagnostics) list() []*FetchDiagnostic {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fetches := make([]*FetchDiagnostic, len(d.fetches))
+	copy(fetches, d.fetches)
+	sort.SliceStable(fetches, func(i, j int) bool {
+		return fetches[i].StartOffset < fetches[j].StartOffset
+	})
+
+	return fetches
+}
+
+// requestBytes returns the size of the request body that RemoteDataSource sends.
+func requestBytes(oc *graphql.OperationContext) int {
+	b, err := json.Marshal(&struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName,omitempty"`
+		Variables     map[string]interface{} `json:"variables,omitempty"`
+	}{
+		Query:         oc.RawQuery,
+		OperationName: oc.OperationName,
+		Variables:     oc.Variables,
+	})
+	if err != nil {
+		return 0
+	}
+
+	return len(b)
+}
+
+// responseBytes returns the size of the response body.
+func responseBytes(response *graphql.Response) int {
+	b, err := json.Marshal(response)
+	if err != nil {
+		return 0
+	}
+
+	return len(b)
+}
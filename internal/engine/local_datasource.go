@@ -3,21 +3,70 @@ package engine
 import (
 	"context"
 	"encoding/json"
+	"sync"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/ast"
 	"github.com/vektah/gqlparser/v2/gqlerror"
 	"github.com/vektah/gqlparser/v2/validator"
 	"github.com/vvakame/fedeway/internal/gqlfun"
-
-	"github.com/99designs/gqlgen/graphql"
 )
 
 var _ DataSource = (*LocalDataSource)(nil)
+var _ SubscriptionDataSource = (*LocalDataSource)(nil)
+var _ DecodedDataSource = (*LocalDataSource)(nil)
 
 type LocalDataSource struct {
 	ExecutableSchema graphql.ExecutableSchema
+
+	ErrorPresenter graphql.ErrorPresenterFunc // optional
+	// RecoverFunc is used when the panic occurred in the resolvers.
+	// RecoverFunc of the given OperationContext is used when it is nil.
+	RecoverFunc graphql.RecoverFunc // optional
+}
+
+func (ds *LocalDataSource) errorPresenter() graphql.ErrorPresenterFunc {
+	if ds.ErrorPresenter != nil {
+		return ds.ErrorPresenter
+	}
+
+	return graphql.DefaultErrorPresenter
+}
+
+func (ds *LocalDataSource) recoverFunc(oc *graphql.OperationContext) graphql.RecoverFunc {
+	if ds.RecoverFunc != nil {
+		return ds.RecoverFunc
+	}
+	if oc != nil && oc.RecoverFunc != nil {
+		return oc.RecoverFunc
+	}
+
+	return graphql.DefaultRecover
+}
+
+// validate validates the document and annotates it by the schema. gqlgen requires the annotated document.
+// planned documents are validated only once because they are shared by all executions of the plan.
+// the result is kept in the FetchNode, it is released with the plan.
+func (ds *LocalDataSource) validate(ctx context.Context, oc *graphql.OperationContext) gqlerror.List {
+	fetch := plannedFetch(ctx, oc.Doc)
+	if fetch == nil {
+		return validator.Validate(ds.ExecutableSchema.Schema(), oc.Doc)
+	}
+
+	return fetch.ValidateOnce(func(doc *ast.QueryDocument) gqlerror.List {
+		return validator.Validate(ds.ExecutableSchema.Schema(), doc)
+	})
 }
 
 func (lds *LocalDataSource) SDL(ctx context.Context) (string, gqlerror.List) {
-	resp := gqlfun.Execute(ctx, lds.ExecutableSchema, `{ _service { sdl }}`, nil)
+	resp := gqlfun.Execute(
+		ctx,
+		lds.ExecutableSchema,
+		`{ _service { sdl }}`,
+		nil,
+		gqlfun.WithErrorPresenter(lds.errorPresenter()),
+		gqlfun.WithRecoverFunc(lds.recoverFunc(nil)),
+	)
 	if len(resp.Errors) != 0 {
 		return "", resp.Errors
 	}
@@ -53,11 +102,12 @@ func (ds *LocalDataSource) Process(ctx context.Context, oc *graphql.OperationCon
 		}
 	}
 
+	oc.RecoverFunc = ds.recoverFunc(oc)
+
 	ctx = graphql.WithOperationContext(ctx, oc)
-	// TODO make configurable
-	ctx = graphql.WithResponseContext(ctx, graphql.DefaultErrorPresenter, graphql.DefaultRecover)
+	ctx = graphql.WithResponseContext(ctx, ds.errorPresenter(), oc.RecoverFunc)
 
-	gErrs := validator.Validate(ds.ExecutableSchema.Schema(), oc.Doc)
+	gErrs := ds.validate(ctx, oc)
 	if len(gErrs) != 0 {
 		return &graphql.Response{Errors: gErrs}
 	}
@@ -71,3 +121,130 @@ func (ds *LocalDataSource) Process(ctx context.Context, oc *graphql.OperationCon
 
 	return resp
 }
+
+// ProcessDecoded is the same as Process except that it returns the result of gqlgen without JSON.
+func (ds *LocalDataSource) ProcessDecoded(ctx context.Context, oc *graphql.OperationContext) *DecodedResponse {
+	// NOTE fields are recorded to decode the result without JSON. see decodeMarshaler.
+	resolved := newResolvedFields(ds.ExecutableSchema.Schema(), oc)
+	resolverMiddleware := oc.ResolverMiddleware
+	oc.ResolverMiddleware = func(ctx context.Context, next graphql.Resolver) (interface{}, error) {
+		var res interface{}
+		var err error
+		if resolverMiddleware != nil {
+			res, err = resolverMiddleware(ctx, next)
+		} else {
+			res, err = next(ctx)
+		}
+		if err == nil {
+			resolved.record(ctx, res)
+		}
+		return res, err
+	}
+
+	// NOTE results of root fields are captured before gqlgen marshals them. gqlgen marshals null instead.
+	type rootValue struct {
+		m          graphql.Marshaler
+		selections ast.SelectionSet
+	}
+	var rootValuesLock sync.Mutex
+	rootValues := make(map[string]rootValue)
+	rootResolverMiddleware := oc.RootResolverMiddleware
+	oc.RootResolverMiddleware = func(ctx context.Context, next graphql.RootResolver) graphql.Marshaler {
+		var m graphql.Marshaler
+		if rootResolverMiddleware != nil {
+			m = rootResolverMiddleware(ctx, next)
+		} else {
+			m = next(ctx)
+		}
+		fc := graphql.GetRootFieldContext(ctx)
+		if fc == nil || m == graphql.Null {
+			return m
+		}
+
+		rootValuesLock.Lock()
+		defer rootValuesLock.Unlock()
+		rootValues[fc.Field.Alias] = rootValue{m: m, selections: fc.Field.Selections}
+
+		return graphql.Null
+	}
+
+	oc.RecoverFunc = ds.recoverFunc(oc)
+
+	ctx = graphql.WithOperationContext(ctx, oc)
+	ctx = graphql.WithResponseContext(ctx, ds.errorPresenter(), oc.RecoverFunc)
+
+	gErrs := ds.validate(ctx, oc)
+	if len(gErrs) != 0 {
+		return &DecodedResponse{Errors: gErrs}
+	}
+
+	rh := ds.ExecutableSchema.Exec(ctx)
+	resp := rh(ctx)
+
+	var data map[string]interface{}
+	if resp != nil {
+		// NOTE the root object is small. e.g. {"_entities":null,"__typename":"Query"}
+		var gErr *gqlerror.Error
+		data, gErr = decodeResponseData(resp.Data)
+		if gErr != nil {
+			return &DecodedResponse{Errors: gqlerror.List{gErr}}
+		}
+	}
+	if data != nil {
+		for alias, rv := range rootValues {
+			v, err := resolved.decodeMarshaler(rv.m, alias, rv.selections)
+			if err != nil {
+				return &DecodedResponse{Errors: gqlerror.List{gqlerror.Errorf("unexpected result of %s: %s", alias, err)}}
+			}
+			data[alias] = v
+		}
+	}
+
+	// NOTE scalars may report errors while they are marshaled
+	gErrs = graphql.GetErrors(ctx)
+	if len(gErrs) != 0 {
+		return &DecodedResponse{Errors: gErrs}
+	}
+
+	return &DecodedResponse{Data: data}
+}
+
+func (ds *LocalDataSource) Subscribe(ctx context.Context, oc *graphql.OperationContext) graphql.ResponseHandler {
+	if oc.ResolverMiddleware == nil {
+		oc.ResolverMiddleware = func(ctx context.Context, next graphql.Resolver) (interface{}, error) {
+			return next(ctx)
+		}
+	}
+	if oc.RootResolverMiddleware == nil {
+		oc.RootResolverMiddleware = func(ctx context.Context, next graphql.RootResolver) graphql.Marshaler {
+			return next(ctx)
+		}
+	}
+
+	oc.RecoverFunc = ds.recoverFunc(oc)
+
+	ctx = graphql.WithOperationContext(ctx, oc)
+	ctx = graphql.WithResponseContext(ctx, ds.errorPresenter(), oc.RecoverFunc)
+
+	gErrs := ds.validate(ctx, oc)
+	if len(gErrs) != 0 {
+		return graphql.OneShot(&graphql.Response{Errors: gErrs})
+	}
+
+	rh := ds.ExecutableSchema.Exec(ctx)
+	if gErrs := graphql.GetErrors(ctx); len(gErrs) != 0 {
+		return graphql.OneShot(&graphql.Response{Errors: gErrs})
+	}
+
+	return func(_ context.Context) *graphql.Response {
+		// NOTE errors are collected for each event like gqlgen's executor does
+		ctx := graphql.WithResponseContext(ctx, ds.errorPresenter(), oc.RecoverFunc)
+		resp := rh(ctx)
+		if resp == nil {
+			return nil
+		}
+		resp.Errors = append(resp.Errors, graphql.GetErrors(ctx)...)
+
+		return resp
+	}
+}
@@ -0,0 +1,25 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+)
+
+// FetchMetrics records requests to services. it is called by concurrent executions.
+type FetchMetrics interface {
+	// ObserveFetch is called for every request sent to the service. split batches are observed separately.
+	// entities is the number of representations, 0 for fetches without requires.
+	// errors is the number of errors of the request, including timeouts.
+	ObserveFetch(serviceName string, duration time.Duration, entities int, errors int)
+}
+
+// representationCount returns the number of representations in the `_entities` request.
+func representationCount(oc *graphql.OperationContext) int {
+	representations, ok := oc.Variables["representations"].([]interface{})
+	if !ok {
+		return 0
+	}
+
+	return len(representations)
+}
@@ -0,0 +1,58 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	testlogr "github.com/go-logr/logr/testing"
+	"github.com/vvakame/fedeway/internal/log"
+)
+
+var _ FetchMetrics = (*testFetchMetrics)(nil)
+
+type testFetchMetrics struct {
+	mu      sync.Mutex
+	fetches []string
+}
+
+func (m *testFetchMetrics) ObserveFetch(serviceName string, duration time.Duration, entities int, errors int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.fetches = append(m.fetches, fmt.Sprintf("%s entities=%d errors=%d", serviceName, entities, errors))
+}
+
+func TestExecuteQueryPlanFetchMetrics(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	const query = `
+		query {
+			topReviews(first: 2) {
+				body
+				author {
+					name {
+						first
+					}
+				}
+			}
+		}
+	`
+
+	composedSchema, serviceMap, qp, oc := planQuery(ctx, t, query)
+
+	metrics := &testFetchMetrics{}
+	resp := ExecuteQueryPlan(ctx, qp, serviceMap, composedSchema, oc, WithFetchMetrics(metrics))
+	if len(resp.Errors) != 0 {
+		t.Fatal(resp.Errors)
+	}
+
+	expected := []string{"reviews entities=0 errors=0", "accounts entities=1 errors=0"}
+	if !reflect.DeepEqual(metrics.fetches, expected) {
+		t.Errorf("unexpected fetches: %v", metrics.fetches)
+	}
+}
@@ -6,16 +6,60 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/99designs/gqlgen/graphql"
+	"github.com/gorilla/websocket"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"github.com/vvakame/fedeway/internal/log"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 var _ DataSource = (*RemoteDataSource)(nil)
+var _ SubscriptionDataSource = (*RemoteDataSource)(nil)
+
+// TimeoutBudgetHeader tells the remaining time budget of the request in milliseconds to the remote service.
+// it is set when the context has a deadline. e.g. fetch timeouts or the operation deadline.
+const TimeoutBudgetHeader = "X-Timeout-Budget-Ms"
+
+// WillSendRequestFunc is called just before sending the request to the remote service.
+// oc is the operation for the remote service. headers of the inbound request are available by RequestHeaders(ctx).
+type WillSendRequestFunc func(ctx context.Context, req *http.Request, oc *graphql.OperationContext)
+
+// DidReceiveResponseFunc is called with the response from the remote service that is finally used.
+// responses discarded by retries are not given. the body is already consumed.
+type DidReceiveResponseFunc func(ctx context.Context, resp *http.Response, oc *graphql.OperationContext)
 
 type RemoteDataSource struct {
 	URL string
 
 	Client *http.Client
+
+	// WillSendRequest can modify the request. e.g. propagating headers of the inbound request.
+	// for subscriptions, it is called with the websocket handshake request.
+	WillSendRequest WillSendRequestFunc // optional
+	// DidReceiveResponse can read the response. e.g. copying headers to the response of the gateway.
+	// it is called once per Process even if retries happen. it isn't called for subscriptions.
+	DidReceiveResponse DidReceiveResponseFunc // optional
+
+	// Propagator injects the trace context of the fetch into requests. default is W3C Trace Context. e.g. traceparent.
+	Propagator propagation.TextMapPropagator // optional
+
+	// Retry enables retries of query operations for transient errors. mutations are never retried.
+	// when retries happen, attempts and retries are put into extensions of the response, or of the error when it failed.
+	Retry *RetryPolicy // optional
+
+	// ErrorPresenter and RecoverFunc are used for errors that occurred in the gateway side. e.g. network errors.
+	// errors in the response from the remote service are returned as is.
+	// RecoverFunc of the given OperationContext is used when RecoverFunc is nil.
+	ErrorPresenter graphql.ErrorPresenterFunc // optional
+	RecoverFunc    graphql.RecoverFunc        // optional
+
+	// WebsocketURL is used for subscriptions. derived from URL (http -> ws, https -> wss) when it is empty.
+	WebsocketURL string            // optional
+	Dialer       *websocket.Dialer // optional
 }
 
 func (ds *RemoteDataSource) Process(ctx context.Context, oc *graphql.OperationContext) *graphql.Response {
@@ -24,12 +68,7 @@ func (ds *RemoteDataSource) Process(ctx context.Context, oc *graphql.OperationCo
 		hc = http.DefaultClient
 	}
 
-	ctx = graphql.WithResponseContext(
-		ctx,
-		// TODO make configurable
-		graphql.DefaultErrorPresenter,
-		graphql.DefaultRecover,
-	)
+	ctx = graphql.WithResponseContext(ctx, ds.errorPresenter(), ds.recoverFunc(oc))
 
 	type RawParams struct {
 		Query         string                 `json:"query"`
@@ -50,48 +89,171 @@ func (ds *RemoteDataSource) Process(ctx context.Context, oc *graphql.OperationCo
 		}
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", ds.URL, bytes.NewBuffer(b))
-	if err != nil {
-		graphql.AddError(ctx, err)
-		return &graphql.Response{
-			Errors: graphql.GetErrors(ctx),
+	// NOTE only queries are retried. mutations may not be idempotent.
+	retry := ds.Retry
+	if oc.Operation == nil || oc.Operation.Operation != ast.Query {
+		retry = nil
+	}
+
+	var retries []string
+	for attempt := 1; ; attempt++ {
+		resp, respBody, err := ds.send(ctx, hc, b, oc)
+		if err == nil {
+			ds.didReceiveResponse(ctx, resp, oc)
+			gqlResp := &graphql.Response{}
+			err = json.Unmarshal(respBody, gqlResp)
+			if err != nil {
+				return ds.retryErrorResponse(ctx, err, attempt, retries)
+			}
+
+			if len(retries) != 0 {
+				ds.logRetries(ctx, attempt, retries, nil)
+				if gqlResp.Extensions == nil {
+					gqlResp.Extensions = make(map[string]interface{})
+				}
+				for key, value := range retryExtensions(attempt, retries) {
+					gqlResp.Extensions[key] = value
+				}
+			}
+
+			return gqlResp
+		}
+
+		backoff, ok := retry.next(ctx, attempt, err)
+		if !ok {
+			ds.didReceiveResponse(ctx, resp, oc)
+			return ds.retryErrorResponse(ctx, err, attempt, retries)
 		}
+
+		retries = append(retries, err.Error())
+		log.FromContext(ctx).Info(
+			"retrying fetch",
+			"url", ds.URL,
+			"attempt", attempt,
+			"backoff", backoff,
+			"reason", err.Error(),
+		)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ds.retryErrorResponse(ctx, ctx.Err(), attempt, retries)
+		case <-timer.C:
+		}
+	}
+}
+
+// retryErrorResponse makes the response for the error. the retry history is put into extensions when retries happened.
+func (ds *RemoteDataSource) retryErrorResponse(ctx context.Context, err error, attempts int, retries []string) *graphql.Response {
+	if len(retries) == 0 {
+		graphql.AddError(ctx, err)
+	} else {
+		ds.logRetries(ctx, attempts, retries, err)
+		gErr := gqlerror.WrapPath(nil, err)
+		gErr.Extensions = retryExtensions(attempts, retries)
+		graphql.AddError(ctx, gErr)
+	}
+
+	return &graphql.Response{
+		Errors: graphql.GetErrors(ctx),
+	}
+}
+
+// logRetries logs the result of the fetch that is retried. err is nil when it succeeded at last.
+func (ds *RemoteDataSource) logRetries(ctx context.Context, attempts int, retries []string, err error) {
+	if err != nil {
+		log.FromContext(ctx).Info(
+			"fetch failed after retries",
+			"url", ds.URL,
+			"attempts", attempts,
+			"retries", retries,
+			"reason", err.Error(),
+		)
+		return
+	}
+
+	log.FromContext(ctx).Info(
+		"fetch succeeded after retries",
+		"url", ds.URL,
+		"attempts", attempts,
+		"retries", retries,
+	)
+}
+
+// send sends the request once and returns the response and its body.
+// the response is returned with non-200 status codes too. it is nil for network errors.
+func (ds *RemoteDataSource) send(ctx context.Context, hc *http.Client, body []byte, oc *graphql.OperationContext) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", ds.URL, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, nil, err
 	}
 	req.Header.Add("Content-Type", "application/json")
+	if deadline, ok := ctx.Deadline(); ok {
+		budget := time.Until(deadline).Milliseconds()
+		if budget < 0 {
+			budget = 0
+		}
+		req.Header.Set(TimeoutBudgetHeader, strconv.FormatInt(budget, 10))
+	}
+	ds.propagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if shouldIncludeTrace(ctx) {
+		req.Header.Set(FederatedTraceHeader, "ftv1")
+	}
+	if ds.WillSendRequest != nil {
+		ds.WillSendRequest(ctx, req, oc)
+	}
 
 	resp, err := hc.Do(req)
 	if err != nil {
-		graphql.AddError(ctx, err)
-		return &graphql.Response{
-			Errors: graphql.GetErrors(ctx),
-		}
+		return nil, nil, &networkError{err: err}
 	}
 	defer func() {
 		_ = resp.Body.Close()
 	}()
-	b, err = io.ReadAll(resp.Body)
+	b, err := io.ReadAll(resp.Body)
 	if err != nil {
-		graphql.AddError(ctx, err)
-		return &graphql.Response{
-			Errors: graphql.GetErrors(ctx),
-		}
+		return nil, nil, &networkError{err: err}
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		graphql.AddErrorf(ctx, "unexpected response code: %d", resp.StatusCode)
-		return &graphql.Response{
-			Errors: graphql.GetErrors(ctx),
-		}
+		return resp, nil, &statusCodeError{statusCode: resp.StatusCode}
 	}
 
-	gqlResp := &graphql.Response{}
-	err = json.Unmarshal(b, gqlResp)
-	if err != nil {
-		graphql.AddError(ctx, err)
-		return &graphql.Response{
-			Errors: graphql.GetErrors(ctx),
-		}
+	return resp, b, nil
+}
+
+func (ds *RemoteDataSource) didReceiveResponse(ctx context.Context, resp *http.Response, oc *graphql.OperationContext) {
+	if resp == nil || ds.DidReceiveResponse == nil {
+		return
+	}
+
+	ds.DidReceiveResponse(ctx, resp, oc)
+}
+
+func (ds *RemoteDataSource) propagator() propagation.TextMapPropagator {
+	if ds.Propagator != nil {
+		return ds.Propagator
+	}
+
+	return defaultPropagator
+}
+
+func (ds *RemoteDataSource) errorPresenter() graphql.ErrorPresenterFunc {
+	if ds.ErrorPresenter != nil {
+		return ds.ErrorPresenter
+	}
+
+	return graphql.DefaultErrorPresenter
+}
+
+func (ds *RemoteDataSource) recoverFunc(oc *graphql.OperationContext) graphql.RecoverFunc {
+	if ds.RecoverFunc != nil {
+		return ds.RecoverFunc
+	}
+	if oc != nil && oc.RecoverFunc != nil {
+		return oc.RecoverFunc
 	}
 
-	return gqlResp
+	return graphql.DefaultRecover
 }
@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultRetryMaxAttempts    = 3
+	defaultRetryInitialBackoff = 100 * time.Millisecond
+	defaultRetryMaxBackoff     = 2 * time.Second
+)
+
+var defaultRetryableStatusCodes = []int{
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// RetryPolicy is the retry settings of RemoteDataSource.
+// backoff is exponential from InitialBackoff up to MaxBackoff with full jitter.
+type RetryPolicy struct {
+	MaxAttempts    int           // including the first attempt. default is 3
+	InitialBackoff time.Duration // default is 100ms
+	MaxBackoff     time.Duration // default is 2s
+	// RetryableStatusCodes are HTTP status codes to retry. default is 502, 503 and 504.
+	// network errors (e.g. connection reset) are always retried.
+	RetryableStatusCodes []int // optional
+}
+
+// statusCodeError is the non-200 response from the remote service.
+type statusCodeError struct {
+	statusCode int
+}
+
+func (err *statusCodeError) Error() string {
+	return fmt.Sprintf("unexpected response code: %d", err.statusCode)
+}
+
+// networkError is an error while sending the request or receiving the response.
+type networkError struct {
+	err error
+}
+
+func (err *networkError) Error() string {
+	return err.err.Error()
+}
+
+func (err *networkError) Unwrap() error {
+	return err.err
+}
+
+// next returns the backoff before the next attempt. it returns false when the request shouldn't be retried.
+func (p *RetryPolicy) next(ctx context.Context, attempt int, err error) (time.Duration, bool) {
+	if p == nil {
+		return 0, false
+	}
+	maxAttempts := p.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = defaultRetryMaxAttempts
+	}
+	if attempt >= maxAttempts {
+		return 0, false
+	}
+	// NOTE errors caused by the deadline or cancellation of the context are not transient
+	if ctx.Err() != nil {
+		return 0, false
+	}
+	if !p.retryable(err) {
+		return 0, false
+	}
+
+	backoff := p.backoff(attempt)
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+		return 0, false
+	}
+
+	return backoff, true
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	var netErr *networkError
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var statusErr *statusCodeError
+	if errors.As(err, &statusErr) {
+		statusCodes := p.RetryableStatusCodes
+		if len(statusCodes) == 0 {
+			statusCodes = defaultRetryableStatusCodes
+		}
+		for _, statusCode := range statusCodes {
+			if statusCode == statusErr.statusCode {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	initialBackoff := p.InitialBackoff
+	if initialBackoff <= 0 {
+		initialBackoff = defaultRetryInitialBackoff
+	}
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+
+	backoff := maxBackoff
+	if shift := attempt - 1; shift < 32 {
+		if v := initialBackoff << shift; v > 0 && v < maxBackoff {
+			backoff = v
+		}
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// retryExtensions is the retry history of a fetch. attempts includes the first attempt.
+func retryExtensions(attempts int, retries []string) map[string]interface{} {
+	return map[string]interface{}{
+		"attempts": attempts,
+		"retries":  retries,
+	}
+}
@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	testlogr "github.com/go-logr/logr/testing"
+	"github.com/vvakame/fedeway/internal/log"
+	"github.com/vvakame/fedeway/internal/plan"
+)
+
+func TestRemoteDataSourceRetry(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	retry := &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+	}
+
+	tests := []struct {
+		name             string
+		query            string
+		failures         int32
+		failure          func(w http.ResponseWriter)
+		expectedRequests int32
+		expectedErrors   int
+		expectedRetries  []string // substrings of reasons
+		expectedStatus   int      // of the response given to DidReceiveResponse
+	}{
+		{
+			name:     "recovered by retries",
+			query:    `query { __typename }`,
+			failures: 2,
+			failure: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			expectedRequests: 3,
+			expectedRetries:  []string{"unexpected response code: 503", "unexpected response code: 503"},
+			expectedStatus:   http.StatusOK,
+		},
+		{
+			name:     "gave up",
+			query:    `query { __typename }`,
+			failures: 10,
+			failure: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusBadGateway)
+			},
+			expectedRequests: 3,
+			expectedErrors:   1,
+			expectedRetries:  []string{"unexpected response code: 502", "unexpected response code: 502"},
+			expectedStatus:   http.StatusBadGateway,
+		},
+		{
+			name:     "connection reset",
+			query:    `query { __typename }`,
+			failures: 1,
+			failure: func(w http.ResponseWriter) {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					panic(err)
+				}
+				_ = conn.Close()
+			},
+			expectedRequests: 2,
+			expectedRetries:  []string{"EOF"},
+			expectedStatus:   http.StatusOK,
+		},
+		{
+			name:     "not retryable status code",
+			query:    `query { __typename }`,
+			failures: 10,
+			failure: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusBadRequest)
+			},
+			expectedRequests: 1,
+			expectedErrors:   1,
+			expectedStatus:   http.StatusBadRequest,
+		},
+		{
+			name:     "mutation is never retried",
+			query:    `mutation { __typename }`,
+			failures: 10,
+			failure: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			expectedRequests: 1,
+			expectedErrors:   1,
+			expectedStatus:   http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&requests, 1) <= tt.failures {
+					tt.failure(w)
+					return
+				}
+				_, _ = w.Write([]byte(`{"data":{"__typename":"Query"}}`))
+			}))
+			defer s.Close()
+
+			var statuses []int
+			ds := &RemoteDataSource{
+				URL:   s.URL,
+				Retry: retry,
+				DidReceiveResponse: func(ctx context.Context, resp *http.Response, oc *graphql.OperationContext) {
+					statuses = append(statuses, resp.StatusCode)
+				},
+			}
+			oc, gErr := newFetchOperationContext(&plan.FetchNode{Operation: tt.query}, nil, nil)
+			if gErr != nil {
+				t.Fatal(gErr)
+			}
+
+			resp := ds.Process(ctx, oc)
+			if v := atomic.LoadInt32(&requests); v != tt.expectedRequests {
+				t.Errorf("unexpected requests: %d", v)
+			}
+			if !reflect.DeepEqual(statuses, []int{tt.expectedStatus}) {
+				t.Errorf("unexpected responses given to DidReceiveResponse: %v", statuses)
+			}
+			if len(resp.Errors) != tt.expectedErrors {
+				t.Fatalf("unexpected errors: %v", resp.Errors)
+			}
+			extensions := resp.Extensions
+			if tt.expectedErrors == 0 {
+				if v := string(resp.Data); v != `{"__typename":"Query"}` {
+					t.Errorf("unexpected data: %s", v)
+				}
+			} else {
+				extensions = resp.Errors[0].Extensions
+			}
+
+			// NOTE the retry history is recorded even if the fetch succeeded at last
+			if tt.expectedRetries == nil {
+				if extensions != nil {
+					t.Errorf("unexpected extensions: %v", extensions)
+				}
+				return
+			}
+			if v := extensions["attempts"]; v != int(tt.expectedRequests) {
+				t.Errorf("unexpected attempts: %v", v)
+			}
+			retries, _ := extensions["retries"].([]string)
+			if len(retries) != len(tt.expectedRetries) {
+				t.Fatalf("unexpected retries: %#v", retries)
+			}
+			for i, retry := range retries {
+				if !strings.Contains(retry, tt.expectedRetries[i]) {
+					t.Errorf("unexpected retries: %#v", retries)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := &RetryPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+	}
+
+	for attempt, upper := range map[int]time.Duration{
+		1:  10 * time.Millisecond,
+		2:  20 * time.Millisecond,
+		3:  40 * time.Millisecond,
+		4:  50 * time.Millisecond,
+		64: 50 * time.Millisecond,
+	} {
+		for i := 0; i < 100; i++ {
+			if v := p.backoff(attempt); v < 0 || v > upper {
+				t.Errorf("unexpected backoff for attempt %d: %s", attempt, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/gorilla/websocket"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md
+const graphqlTransportWSProtocol = "graphql-transport-ws"
+
+const (
+	wsConnectionInitMsg = "connection_init"
+	wsConnectionAckMsg  = "connection_ack"
+	wsPingMsg           = "ping"
+	wsPongMsg           = "pong"
+	wsSubscribeMsg      = "subscribe"
+	wsNextMsg           = "next"
+	wsErrorMsg          = "error"
+	wsCompleteMsg       = "complete"
+)
+
+// subscriptionID is fixed because a connection is used for only one subscription.
+const wsSubscriptionID = "1"
+
+type wsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Subscribe subscribes to the operation over websocket with graphql-transport-ws protocol.
+func (ds *RemoteDataSource) Subscribe(ctx context.Context, oc *graphql.OperationContext) graphql.ResponseHandler {
+	errorPresenter := ds.errorPresenter()
+	errorResponse := func(err error) graphql.ResponseHandler {
+		return graphql.OneShot(&graphql.Response{
+			Errors: gqlerror.List{errorPresenter(ctx, err)},
+		})
+	}
+
+	wsURL, err := ds.websocketURL()
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	dialer := websocket.DefaultDialer
+	if ds.Dialer != nil {
+		dialer = ds.Dialer
+	}
+	{
+		copied := *dialer
+		copied.Subprotocols = []string{graphqlTransportWSProtocol}
+		dialer = &copied
+	}
+
+	header := make(http.Header)
+	ds.propagator().Inject(ctx, propagation.HeaderCarrier(header))
+	if ds.WillSendRequest != nil {
+		// NOTE the request is used only to collect headers for the handshake
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, wsURL, nil)
+		if err != nil {
+			return errorResponse(err)
+		}
+		req.Header = header
+		ds.WillSendRequest(ctx, req, oc)
+		header = req.Header
+	}
+
+	conn, _, err := dialer.DialContext(ctx, wsURL, header)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var writeLock sync.Mutex
+	write := func(msg *wsMessage) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+
+		return conn.WriteJSON(msg)
+	}
+	go func() {
+		<-ctx.Done()
+		// NOTE best effort. the server may have already closed the connection.
+		_ = write(&wsMessage{ID: wsSubscriptionID, Type: wsCompleteMsg})
+		_ = conn.Close()
+	}()
+
+	err = ds.initWebsocket(conn, write)
+	if err != nil {
+		cancel()
+		return errorResponse(err)
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"query":         oc.RawQuery,
+		"operationName": oc.OperationName,
+		"variables":     oc.Variables,
+	})
+	if err != nil {
+		cancel()
+		return errorResponse(err)
+	}
+	err = write(&wsMessage{ID: wsSubscriptionID, Type: wsSubscribeMsg, Payload: payload})
+	if err != nil {
+		cancel()
+		return errorResponse(err)
+	}
+
+	responses := make(chan *graphql.Response)
+	go func() {
+		defer cancel()
+		defer close(responses)
+
+		send := func(resp *graphql.Response) bool {
+			select {
+			case responses <- resp:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for {
+			msg := &wsMessage{}
+			err := conn.ReadJSON(msg)
+			if err != nil {
+				if ctx.Err() == nil {
+					send(&graphql.Response{Errors: gqlerror.List{errorPresenter(ctx, err)}})
+				}
+				return
+			}
+
+			switch msg.Type {
+			case wsNextMsg:
+				resp := &graphql.Response{}
+				err := json.Unmarshal(msg.Payload, resp)
+				if err != nil {
+					resp = &graphql.Response{Errors: gqlerror.List{errorPresenter(ctx, err)}}
+				}
+				if !send(resp) {
+					return
+				}
+			case wsErrorMsg:
+				var gErrs gqlerror.List
+				err := json.Unmarshal(msg.Payload, &gErrs)
+				if err != nil {
+					gErrs = gqlerror.List{errorPresenter(ctx, err)}
+				}
+				send(&graphql.Response{Errors: gErrs})
+				return
+			case wsCompleteMsg:
+				return
+			case wsPingMsg:
+				_ = write(&wsMessage{Type: wsPongMsg})
+			default:
+				// ignore
+			}
+		}
+	}()
+
+	return func(ctx context.Context) *graphql.Response {
+		select {
+		case resp, ok := <-responses:
+			if !ok {
+				return nil
+			}
+			return resp
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (ds *RemoteDataSource) initWebsocket(conn *websocket.Conn, write func(msg *wsMessage) error) error {
+	err := write(&wsMessage{Type: wsConnectionInitMsg})
+	if err != nil {
+		return err
+	}
+
+	for {
+		msg := &wsMessage{}
+		err = conn.ReadJSON(msg)
+		if err != nil {
+			return err
+		}
+
+		switch msg.Type {
+		case wsConnectionAckMsg:
+			return nil
+		case wsPingMsg:
+			err = write(&wsMessage{Type: wsPongMsg})
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected message type: %s", msg.Type)
+		}
+	}
+}
+
+func (ds *RemoteDataSource) websocketURL() (string, error) {
+	if ds.WebsocketURL != "" {
+		return ds.WebsocketURL, nil
+	}
+
+	u, err := url.Parse(ds.URL)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return "", fmt.Errorf("unsupported url scheme: %s", u.Scheme)
+	}
+
+	return u.String(), nil
+}
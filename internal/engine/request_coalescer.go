@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// RequestCoalescer shares one in-flight response among identical query fetches to the same service.
+// fetches are identical when the service, the operation, variables and headers of the inbound request in the key are same.
+// mutations are never coalesced.
+type RequestCoalescer struct {
+	// keyHeaders are canonical header names. nil means all headers.
+	keyHeaders []string
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	done      chan struct{}
+	followers int
+	response  *graphql.Response
+	// canceled means the response is affected by the context of the leader. e.g. timeout.
+	canceled bool
+}
+
+// NewRequestCoalescer makes a RequestCoalescer.
+// keyHeaders are headers of the inbound request that affect the response. e.g. Authorization.
+// all headers are used for the key when it is nil.
+func NewRequestCoalescer(keyHeaders []string) *RequestCoalescer {
+	c := &RequestCoalescer{
+		calls: make(map[string]*coalescedCall),
+	}
+	if keyHeaders != nil {
+		c.keyHeaders = make([]string, 0, len(keyHeaders))
+		for _, name := range keyHeaders {
+			c.keyHeaders = append(c.keyHeaders, http.CanonicalHeaderKey(name))
+		}
+	}
+
+	return c
+}
+
+func (c *RequestCoalescer) process(ctx context.Context, service DataSource, serviceName string, oc *graphql.OperationContext) *graphql.Response {
+	if oc.Operation == nil || oc.Operation.Operation != ast.Query {
+		return service.Process(ctx, oc)
+	}
+	key, err := c.key(ctx, serviceName, oc)
+	if err != nil {
+		return service.Process(ctx, oc)
+	}
+
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		call.followers++
+		c.mu.Unlock()
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return &graphql.Response{Errors: gqlerror.List{gqlerror.WrapPath(nil, ctx.Err())}}
+		}
+		// NOTE the failure of the leader's context isn't the failure of this fetch
+		if call.canceled {
+			return service.Process(ctx, oc)
+		}
+		return call.response
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	defer func() {
+		if call.response == nil {
+			// panicked
+			call.canceled = true
+		}
+
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+
+	response := service.Process(ctx, oc)
+	call.canceled = ctx.Err() != nil
+	call.response = response
+
+	return response
+}
+
+func (c *RequestCoalescer) key(ctx context.Context, serviceName string, oc *graphql.OperationContext) (string, error) {
+	headers := RequestHeaders(ctx)
+	if c.keyHeaders != nil {
+		selected := make(http.Header, len(c.keyHeaders))
+		for _, name := range c.keyHeaders {
+			selected[name] = headers.Values(name)
+		}
+		headers = selected
+	}
+
+	// NOTE encoding/json sorts map keys, so the same request always has the same key
+	// responses with the trace are not shared with fetches that don't ask it
+	b, err := json.Marshal([]interface{}{serviceName, oc.RawQuery, oc.Variables, headers, shouldIncludeTrace(ctx)})
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
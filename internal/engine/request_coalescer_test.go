@@ -0,0 +1,170 @@
+package engine
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"github.com/vvakame/fedeway/internal/plan"
+)
+
+// blockingDataSource counts Process calls and blocks them until release is closed.
+type blockingDataSource struct {
+	calls   int32
+	release chan struct{}
+}
+
+func (ds *blockingDataSource) Process(ctx context.Context, oc *graphql.OperationContext) *graphql.Response {
+	atomic.AddInt32(&ds.calls, 1)
+	select {
+	case <-ds.release:
+	case <-ctx.Done():
+		return &graphql.Response{Errors: gqlerror.List{gqlerror.WrapPath(nil, ctx.Err())}}
+	}
+	return &graphql.Response{Data: []byte(`{"__typename":"Query"}`)}
+}
+
+func TestRequestCoalescer(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         string
+		keyHeaders    []string
+		headers       []http.Header
+		expectedCalls int32
+	}{
+		{
+			name:          "identical queries",
+			query:         `query { __typename }`,
+			headers:       []http.Header{{"Authorization": {"a"}}, {"Authorization": {"a"}}, {"Authorization": {"a"}}},
+			expectedCalls: 1,
+		},
+		{
+			name:          "different key header",
+			query:         `query { __typename }`,
+			keyHeaders:    []string{"authorization"},
+			headers:       []http.Header{{"Authorization": {"a"}}, {"Authorization": {"b"}}, {"Authorization": {"a"}, "X-Foo": {"c"}}},
+			expectedCalls: 2,
+		},
+		{
+			name:          "different header with all headers",
+			query:         `query { __typename }`,
+			headers:       []http.Header{{"Authorization": {"a"}}, {"Authorization": {"a"}, "X-Foo": {"c"}}},
+			expectedCalls: 2,
+		},
+		{
+			name:          "mutation is never coalesced",
+			query:         `mutation { __typename }`,
+			headers:       []http.Header{nil, nil, nil},
+			expectedCalls: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewRequestCoalescer(tt.keyHeaders)
+			ds := &blockingDataSource{release: make(chan struct{})}
+
+			var wg sync.WaitGroup
+			responses := make([]*graphql.Response, len(tt.headers))
+			for idx, header := range tt.headers {
+				oc, gErr := newFetchOperationContext(&plan.FetchNode{Operation: tt.query}, nil, nil)
+				if gErr != nil {
+					t.Fatal(gErr)
+				}
+				ctx := withRequestContext(context.Background(), &graphql.OperationContext{Headers: header})
+
+				wg.Add(1)
+				go func(idx int) {
+					defer wg.Done()
+					responses[idx] = c.process(ctx, ds, "service", oc)
+				}(idx)
+			}
+
+			// NOTE wait until all fetches reach the coalescer
+			waitFor(t, func() bool {
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				var followers int32
+				for _, call := range c.calls {
+					followers += int32(call.followers)
+				}
+				return atomic.LoadInt32(&ds.calls)+followers == int32(len(tt.headers))
+			})
+			close(ds.release)
+			wg.Wait()
+
+			if v := atomic.LoadInt32(&ds.calls); v != tt.expectedCalls {
+				t.Errorf("unexpected calls: %d", v)
+			}
+			for _, resp := range responses {
+				if v := string(resp.Data); v != `{"__typename":"Query"}` {
+					t.Errorf("unexpected data: %s", v)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestCoalescerLeaderCanceled(t *testing.T) {
+	c := NewRequestCoalescer(nil)
+	ds := &blockingDataSource{release: make(chan struct{})}
+
+	oc, gErr := newFetchOperationContext(&plan.FetchNode{Operation: `query { __typename }`}, nil, nil)
+	if gErr != nil {
+		t.Fatal(gErr)
+	}
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan *graphql.Response, 1)
+	go func() {
+		leaderDone <- c.process(leaderCtx, ds, "service", oc)
+	}()
+	waitFor(t, func() bool {
+		return atomic.LoadInt32(&ds.calls) == 1
+	})
+
+	followerDone := make(chan *graphql.Response, 1)
+	go func() {
+		followerDone <- c.process(context.Background(), ds, "service", oc)
+	}()
+	waitFor(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, call := range c.calls {
+			return call.followers == 1
+		}
+		return false
+	})
+
+	cancel()
+	<-leaderDone
+	// the follower retries by itself
+	waitFor(t, func() bool {
+		return atomic.LoadInt32(&ds.calls) == 2
+	})
+	close(ds.release)
+
+	resp := <-followerDone
+	if len(resp.Errors) != 0 {
+		t.Fatalf("unexpected errors: %v", resp.Errors)
+	}
+	if v := string(resp.Data); v != `{"__typename":"Query"}` {
+		t.Errorf("unexpected data: %s", v)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,54 @@
+package engine
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vvakame/fedeway/internal/plan"
+)
+
+type requestContextKey struct{}
+
+// withRequestContext keeps the OperationContext of the inbound request.
+// data sources may replace graphql.OperationContext in the context by their own one.
+func withRequestContext(ctx context.Context, requestContext *graphql.OperationContext) context.Context {
+	return context.WithValue(ctx, requestContextKey{}, requestContext)
+}
+
+// GetRequestContext returns the OperationContext of the inbound request to the gateway.
+// it returns nil when the context isn't derived from the query plan execution. e.g. fetching SDLs.
+func GetRequestContext(ctx context.Context) *graphql.OperationContext {
+	requestContext, _ := ctx.Value(requestContextKey{}).(*graphql.OperationContext)
+	return requestContext
+}
+
+// RequestHeaders returns the headers of the inbound request to the gateway.
+// it returns nil when the transport doesn't provide headers. e.g. websocket.
+func RequestHeaders(ctx context.Context) http.Header {
+	requestContext := GetRequestContext(ctx)
+	if requestContext == nil {
+		return nil
+	}
+
+	return requestContext.Headers
+}
+
+type plannedFetchKey struct{}
+
+// withPlannedFetch tells data sources that OperationDocument of the fetch is made by the planner.
+// it is valid and shared by all executions of the plan.
+func withPlannedFetch(ctx context.Context, fetch *plan.FetchNode) context.Context {
+	return context.WithValue(ctx, plannedFetchKey{}, fetch)
+}
+
+// plannedFetch returns the fetch when doc is its OperationDocument.
+func plannedFetch(ctx context.Context, doc *ast.QueryDocument) *plan.FetchNode {
+	fetch, _ := ctx.Value(plannedFetchKey{}).(*plan.FetchNode)
+	if fetch == nil || fetch.OperationDocument != doc {
+		return nil
+	}
+
+	return fetch
+}
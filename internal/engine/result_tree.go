@@ -0,0 +1,111 @@
+package engine
+
+// the result tree keeps the data received from services while the plan is executed.
+// objects are keyed by the response name. leaves are json.Number, string, bool or nil like decodeResponseData makes.
+
+// resultObject is an object in the result tree.
+type resultObject map[string]interface{}
+
+// resultList is a list in the result tree.
+type resultList []interface{}
+
+// toResultTree converts the decoded data to the result tree in place.
+func toResultTree(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for k, v := range value {
+			switch v.(type) {
+			case map[string]interface{}, []interface{}:
+				value[k] = toResultTree(v)
+			}
+		}
+		return resultObject(value)
+	case []interface{}:
+		for i, v := range value {
+			value[i] = toResultTree(v)
+		}
+		return resultList(value)
+	default:
+		return value
+	}
+}
+
+// fromResultTree converts the result tree to maps and slices in place.
+func fromResultTree(value interface{}) interface{} {
+	switch value := value.(type) {
+	case resultObject:
+		for k, v := range value {
+			switch v.(type) {
+			case resultObject, resultList:
+				value[k] = fromResultTree(v)
+			}
+		}
+		return map[string]interface{}(value)
+	case resultList:
+		for i, v := range value {
+			value[i] = fromResultTree(v)
+		}
+		return []interface{}(value)
+	default:
+		return value
+	}
+}
+
+// mergeResult merges source into target. source must not be used after that because they share values.
+// lists that have the same length are merged by each element, and the other values are overwritten.
+func mergeResult(target, source resultObject) {
+	for key, sourceValue := range source {
+		if sourceValue == nil {
+			continue
+		}
+
+		targetValue, ok := target[key]
+		if !ok {
+			target[key] = sourceValue
+			continue
+		}
+
+		switch sourceValue := sourceValue.(type) {
+		case resultObject:
+			if targetValue, ok := targetValue.(resultObject); ok {
+				mergeResult(targetValue, sourceValue)
+				continue
+			}
+		case resultList:
+			if targetValue, ok := targetValue.(resultList); ok && len(targetValue) == len(sourceValue) {
+				for i := range sourceValue {
+					targetElem, okTarget := targetValue[i].(resultObject)
+					sourceElem, okSource := sourceValue[i].(resultObject)
+					if okTarget && okSource {
+						mergeResult(targetElem, sourceElem)
+					} else {
+						targetValue[i] = sourceValue[i]
+					}
+				}
+				continue
+			}
+		}
+
+		target[key] = sourceValue
+	}
+}
+
+// copyResult copies objects and lists recursively. leaves are immutable and shared.
+func copyResult(value interface{}) interface{} {
+	switch value := value.(type) {
+	case resultObject:
+		copied := make(resultObject, len(value))
+		for k, v := range value {
+			copied[k] = copyResult(v)
+		}
+		return copied
+	case resultList:
+		copied := make(resultList, len(value))
+		for i, v := range value {
+			copied[i] = copyResult(v)
+		}
+		return copied
+	default:
+		return value
+	}
+}
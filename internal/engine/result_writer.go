@@ -0,0 +1,358 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"github.com/vvakame/fedeway/internal/utils"
+)
+
+// resultWriter writes the result tree as the response data shaped by the operation.
+// it does what execute.Execute does with the default resolvers, without reflection and goroutines.
+//
+// null propagation follows the spec. a field error nulls the nearest nullable field or list item,
+// and errors of the nulled subtree are kept.
+type resultWriter struct {
+	schema *ast.Schema
+	oc     *graphql.OperationContext
+
+	buf    bytes.Buffer
+	errors gqlerror.List
+
+	collectedFields map[collectedFieldsKey][]graphql.CollectedField
+}
+
+type collectedFieldsKey struct {
+	selection *ast.Selection // the first selection of the selection set
+	typeName  string
+}
+
+// resultPath is the path to the value being written. it becomes ast.Path only when an error is reported.
+type resultPath struct {
+	parent *resultPath
+	name   string
+	index  int
+}
+
+func (p *resultPath) astPath() ast.Path {
+	var depth int
+	for c := p; c != nil; c = c.parent {
+		depth++
+	}
+	path := make(ast.Path, depth)
+	for c := p; c != nil; c = c.parent {
+		depth--
+		if c.name != "" {
+			path[depth] = ast.PathName(c.name)
+		} else {
+			path[depth] = ast.PathIndex(c.index)
+		}
+	}
+
+	return path
+}
+
+func newResultWriter(schema *ast.Schema, oc *graphql.OperationContext) *resultWriter {
+	return &resultWriter{
+		schema:          schema,
+		oc:              oc,
+		collectedFields: make(map[collectedFieldsKey][]graphql.CollectedField),
+	}
+}
+
+func (w *resultWriter) addErrorf(path *resultPath, format string, args ...interface{}) {
+	w.errors = append(w.errors, gqlerror.ErrorPathf(path.astPath(), format, args...))
+}
+
+func (w *resultWriter) addError(path *resultPath, err error) {
+	w.errors = append(w.errors, gqlerror.WrapPath(path.astPath(), err))
+}
+
+// rootType returns the root type of the operation. it reports an error when the schema doesn't have it.
+func (w *resultWriter) rootType(operation *ast.OperationDefinition) *ast.Definition {
+	var typ *ast.Definition
+	switch operation.Operation {
+	case ast.Query:
+		typ = w.schema.Query
+		if typ == nil {
+			w.errors = append(w.errors, gqlerror.ErrorPosf(operation.Position, "schema does not define the required query root type"))
+		}
+	case ast.Mutation:
+		typ = w.schema.Mutation
+		if typ == nil {
+			w.errors = append(w.errors, gqlerror.ErrorPosf(operation.Position, "schema is not configured for mutations"))
+		}
+	case ast.Subscription:
+		typ = w.schema.Subscription
+		if typ == nil {
+			w.errors = append(w.errors, gqlerror.ErrorPosf(operation.Position, "schema is not configured for subscriptions"))
+		}
+	default:
+		w.errors = append(w.errors, gqlerror.ErrorPosf(operation.Position, "can only have query, mutation and subscription operations"))
+	}
+
+	return typ
+}
+
+// writeOperation writes the data of the response. it is null when a field error reaches the root.
+func (w *resultWriter) writeOperation(operation *ast.OperationDefinition, data resultObject) {
+	typ := w.rootType(operation)
+	if typ == nil || !w.writeObject(typ, operation.SelectionSet, data, nil) {
+		w.buf.Reset()
+		w.buf.WriteString("null")
+	}
+}
+
+// collectFields collects fields of the selection set for the type. the result is reused by the same selection set and type.
+func (w *resultWriter) collectFields(selectionSet ast.SelectionSet, typ *ast.Definition) []graphql.CollectedField {
+	var key collectedFieldsKey
+	if len(selectionSet) != 0 {
+		key = collectedFieldsKey{selection: &selectionSet[0], typeName: typ.Name}
+		if fields, ok := w.collectedFields[key]; ok {
+			return fields
+		}
+	}
+
+	implementDefs := w.schema.GetImplements(typ)
+	satisfies := make([]string, 0, len(implementDefs)+1)
+	satisfies = append(satisfies, typ.Name)
+	for _, implementDef := range implementDefs {
+		satisfies = append(satisfies, implementDef.Name)
+	}
+
+	// NOTE fields that aren't defined in the schema (e.g. @inaccessible fields) are omitted
+	collected := graphql.CollectFields(w.oc, selectionSet, satisfies)
+	fields := collected[:0]
+	for _, field := range collected {
+		if len(field.Name) >= 2 && field.Name[:2] == "__" || typ.Fields.ForName(field.Name) != nil {
+			fields = append(fields, field)
+		}
+	}
+
+	if key.selection != nil {
+		w.collectedFields[key] = fields
+	}
+
+	return fields
+}
+
+// writeObject returns false when a field error must be propagated to the parent.
+// the caller must discard what is written in that case.
+func (w *resultWriter) writeObject(typ *ast.Definition, selectionSet ast.SelectionSet, obj resultObject, path *resultPath) bool {
+	fields := w.collectFields(selectionSet, typ)
+
+	valid := true
+	w.buf.WriteByte('{')
+	for i, field := range fields {
+		if i != 0 {
+			w.buf.WriteByte(',')
+		}
+		writeQuotedString(&w.buf, field.Alias)
+		w.buf.WriteByte(':')
+
+		fieldPath := &resultPath{parent: path, name: field.Alias}
+		if field.Definition == nil {
+			w.addErrorf(fieldPath, "fieldDef is nil")
+			valid = false
+			continue
+		}
+		// NOTE siblings are written even if the object is nulled, to report all errors
+		if !w.writeValue(field.Definition.Type, field, obj[field.Alias], fieldPath) {
+			valid = false
+		}
+	}
+	w.buf.WriteByte('}')
+
+	return valid
+}
+
+// writeValue writes the value of the type. nullable types absorb field errors of their values.
+func (w *resultWriter) writeValue(typ *ast.Type, field graphql.CollectedField, value interface{}, path *resultPath) bool {
+	if typ.NonNull {
+		if value == nil {
+			w.addErrorf(path, "cannot return null for non-nullable field %s.%s", field.ObjectDefinition.Name, field.Name)
+			return false
+		}
+		return w.writeNonNullValue(typ, field, value, path)
+	}
+
+	if value == nil {
+		w.buf.WriteString("null")
+		return true
+	}
+
+	start := w.buf.Len()
+	if !w.writeNonNullValue(typ, field, value, path) {
+		w.buf.Truncate(start)
+		w.buf.WriteString("null")
+	}
+
+	return true
+}
+
+func (w *resultWriter) writeNonNullValue(typ *ast.Type, field graphql.CollectedField, value interface{}, path *resultPath) bool {
+	if typ.Elem != nil {
+		list, ok := value.(resultList)
+		if !ok {
+			w.addErrorf(path, `expected slice or array, but did not find one for field "%s.%s"`, field.ObjectDefinition.Name, field.Name)
+			return false
+		}
+
+		valid := true
+		w.buf.WriteByte('[')
+		for i, item := range list {
+			if i != 0 {
+				w.buf.WriteByte(',')
+			}
+			if !w.writeValue(typ.Elem, field, item, &resultPath{parent: path, index: i}) {
+				valid = false
+			}
+		}
+		w.buf.WriteByte(']')
+
+		return valid
+	}
+
+	def := w.schema.Types[typ.NamedType]
+	if def == nil {
+		w.addErrorf(path, "cannot complete value of unexpected output type: %s", typ.String())
+		return false
+	}
+
+	switch {
+	case utils.IsLeafType(def):
+		return w.writeLeaf(typ, value, path)
+	case utils.IsAbstractType(def):
+		runtimeType := w.resolveRuntimeType(typ, field, value, path)
+		if runtimeType == nil {
+			return false
+		}
+		return w.writeObjectValue(runtimeType, field, value, path)
+	case utils.IsObjectType(def):
+		return w.writeObjectValue(def, field, value, path)
+	default:
+		w.addErrorf(path, "cannot complete value of unexpected output type: %s", typ.String())
+		return false
+	}
+}
+
+func (w *resultWriter) writeObjectValue(typ *ast.Definition, field graphql.CollectedField, value interface{}, path *resultPath) bool {
+	obj, ok := value.(resultObject)
+	if !ok {
+		w.addErrorf(path, `expected object, but did not find one for field "%s.%s"`, field.ObjectDefinition.Name, field.Name)
+		return false
+	}
+
+	return w.writeObject(typ, field.SelectionSet, obj, path)
+}
+
+// resolveRuntimeType resolves the runtime type by `__typename` like apiSchemaTypeResolver.
+func (w *resultWriter) resolveRuntimeType(typ *ast.Type, field graphql.CollectedField, value interface{}, path *resultPath) *ast.Definition {
+	var runtimeTypeName string
+	if obj, ok := value.(resultObject); ok {
+		if typename, ok := obj["__typename"].(string); ok && w.schema.Types[typename] != nil {
+			runtimeTypeName = typename
+		}
+	}
+
+	if runtimeTypeName == "" {
+		w.addErrorf(path, `abstract type "%s" must resolve to an Object type at runtime for field "%s.%s"`, typ.Name(), field.ObjectDefinition.Name, field.Name)
+		return nil
+	}
+
+	runtimeType := w.schema.Types[runtimeTypeName]
+	if runtimeType.Kind != ast.Object {
+		w.addErrorf(path, `abstract type "%s" was resolved to a non-object type "%s"`, typ.Name(), runtimeTypeName)
+		return nil
+	}
+	if !utils.IsTypeDefSubTypeOf(w.schema, runtimeType, w.schema.Types[typ.Name()]) {
+		w.addErrorf(path, `runtime Object type "%s" is not a possible type for "%s"`, runtimeType.Name, typ.Name())
+		return nil
+	}
+
+	return runtimeType
+}
+
+// writeLeaf serializes the scalar or enum value like gqlgen's marshalers do.
+func (w *resultWriter) writeLeaf(typ *ast.Type, value interface{}, path *resultPath) bool {
+	switch value := value.(type) {
+	case bool:
+		w.buf.WriteString(strconv.FormatBool(value))
+	case string:
+		writeQuotedString(&w.buf, value)
+	case json.Number:
+		switch typ.NamedType {
+		case "Int":
+			v, err := value.Int64()
+			if err != nil {
+				w.addError(path, err)
+				return false
+			}
+			w.buf.WriteString(strconv.FormatInt(v, 10))
+		case "Float":
+			v, err := value.Float64()
+			if err != nil {
+				w.addError(path, err)
+				return false
+			}
+			// NOTE same as fmt.Sprintf("%g", v) of graphql.MarshalFloat
+			w.buf.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+		default:
+			// for custom scalar
+			if v, err := value.Int64(); err == nil {
+				w.buf.WriteString(strconv.FormatInt(v, 10))
+			} else if v, err := value.Float64(); err == nil {
+				w.buf.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+			} else {
+				w.addErrorf(path, "unsupported return type for json.Number: %s", typ.NamedType)
+				return false
+			}
+		}
+	default:
+		w.addError(path, fmt.Errorf("unsupported leaf type: %T", value))
+		return false
+	}
+
+	return true
+}
+
+const encodeHex = "0123456789ABCDEF"
+
+// writeQuotedString is the same as the one of gqlgen.
+func writeQuotedString(buf *bytes.Buffer, s string) {
+	start := 0
+	buf.WriteByte('"')
+
+	for i, c := range s {
+		if c < 0x20 || c == '\\' || c == '"' {
+			buf.WriteString(s[start:i])
+
+			switch c {
+			case '\t':
+				buf.WriteString(`\t`)
+			case '\r':
+				buf.WriteString(`\r`)
+			case '\n':
+				buf.WriteString(`\n`)
+			case '\\':
+				buf.WriteString(`\\`)
+			case '"':
+				buf.WriteString(`\"`)
+			default:
+				buf.WriteString(`\u00`)
+				buf.WriteByte(encodeHex[c>>4])
+				buf.WriteByte(encodeHex[c&0xf])
+			}
+
+			start = i + 1
+		}
+	}
+
+	buf.WriteString(s[start:])
+	buf.WriteByte('"')
+}
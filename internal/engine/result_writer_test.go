@@ -0,0 +1,135 @@
+package engine
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+func TestResultWriter(t *testing.T) {
+	schema := gqlparser.MustLoadSchema(&ast.Source{Input: `
+		type Query {
+			user: User
+			users: [User]
+			strictUsers: [User!]
+			node: Node
+			count: Int
+		}
+		interface Node {
+			id: ID!
+		}
+		type User implements Node {
+			id: ID!
+			name: String!
+			age: Int
+			score: Float
+		}
+	`})
+
+	tests := []struct {
+		name           string
+		query          string
+		data           string
+		expectedData   string
+		expectedErrors []string
+	}{
+		{
+			name:         "aliases and fragments",
+			query:        `{ me: user { ...F name } count @skip(if: true) } fragment F on User { id }`,
+			data:         `{"me":{"id":"1","name":"a"},"count":1}`,
+			expectedData: `{"me":{"id":"1","name":"a"}}`,
+		},
+		{
+			name:         "numbers are kept",
+			query:        `{ user { age score } count }`,
+			data:         `{"user":{"age":9007199254740993,"score":1.5e300},"count":-1}`,
+			expectedData: `{"user":{"age":9007199254740993,"score":1.5e+300},"count":-1}`,
+		},
+		{
+			name:           "null propagates to the nullable field",
+			query:          `{ user { id name } count }`,
+			data:           `{"user":{"id":"1","name":null},"count":1}`,
+			expectedData:   `{"user":null,"count":1}`,
+			expectedErrors: []string{"user.name: cannot return null for non-nullable field User.name"},
+		},
+		{
+			name:           "null propagates to the nullable list item",
+			query:          `{ users { name } }`,
+			data:           `{"users":[{"name":"a"},{"name":null},null]}`,
+			expectedData:   `{"users":[{"name":"a"},null,null]}`,
+			expectedErrors: []string{"users[1].name: cannot return null for non-nullable field User.name"},
+		},
+		{
+			name:           "null propagates to the nullable list",
+			query:          `{ strictUsers { name } }`,
+			data:           `{"strictUsers":[{"name":"a"},null]}`,
+			expectedData:   `{"strictUsers":null}`,
+			expectedErrors: []string{"strictUsers[1]: cannot return null for non-nullable field Query.strictUsers"},
+		},
+		{
+			name:           "all errors of the nulled object are reported",
+			query:          `{ user { name id } }`,
+			data:           `{"user":{"name":null,"id":null}}`,
+			expectedData:   `{"user":null}`,
+			expectedErrors: []string{"user.name: cannot return null for non-nullable field User.name", "user.id: cannot return null for non-nullable field User.id"},
+		},
+		{
+			name:           "invalid number",
+			query:          `{ user { age } count }`,
+			data:           `{"user":{"age":1.5},"count":1}`,
+			expectedData:   `{"user":{"age":null},"count":1}`,
+			expectedErrors: []string{`user.age: strconv.ParseInt: parsing "1.5": invalid syntax`},
+		},
+		{
+			name:         "abstract type",
+			query:        `{ node { __typename id ... on User { name } } }`,
+			data:         `{"node":{"__typename":"User","id":"1","name":"a"}}`,
+			expectedData: `{"node":{"__typename":"User","id":"1","name":"a"}}`,
+		},
+		{
+			name:           "unknown runtime type",
+			query:          `{ node { id } }`,
+			data:           `{"node":{"__typename":"Secret","id":"1"}}`,
+			expectedData:   `{"node":null}`,
+			expectedErrors: []string{`node: abstract type "Node" must resolve to an Object type at runtime for field "Query.node"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, gErrs := gqlparser.LoadQuery(schema, tt.query)
+			if len(gErrs) != 0 {
+				t.Fatal(gErrs)
+			}
+			data, gErr := decodeResponseData([]byte(tt.data))
+			if gErr != nil {
+				t.Fatal(gErr)
+			}
+
+			oc := &graphql.OperationContext{Doc: doc, Operation: doc.Operations.ForName("")}
+			w := newResultWriter(schema, oc)
+			w.writeOperation(oc.Operation, toResultTree(data).(resultObject))
+
+			if v := w.buf.String(); v != tt.expectedData {
+				t.Errorf("unexpected data: %s", v)
+			}
+			var errs []string
+			for _, gErr := range w.errors {
+				errs = append(errs, gErr.Path.String()+": "+gErr.Message)
+			}
+			if len(errs) != len(tt.expectedErrors) {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			for i := range errs {
+				if errs[i] != tt.expectedErrors[i] {
+					t.Errorf("unexpected error: %s", errs[i])
+				}
+			}
+			if !json.Valid(w.buf.Bytes()) {
+				t.Errorf("invalid JSON: %s", w.buf.String())
+			}
+		})
+	}
+}
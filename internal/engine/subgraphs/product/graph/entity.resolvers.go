@@ -17,7 +17,9 @@ func (r *entityResolver) FindBookByIsbn(ctx context.Context, isbn string) (*mode
 		switch product := product.(type) {
 		case *model.Book:
 			if product.Isbn == isbn {
-				return product, nil
+				// NOTE generated code sets @external fields to the returned entity. concurrent requests must not share it.
+				copied := *product
+				return &copied, nil
 			}
 		}
 	}
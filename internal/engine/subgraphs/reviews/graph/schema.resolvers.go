@@ -150,6 +150,28 @@ func (r *reviewResolver) Author(ctx context.Context, obj *model.Review) (*model.
 	}, nil
 }
 
+// ReviewAdded is the resolver for the reviewAdded field.
+func (r *subscriptionResolver) ReviewAdded(ctx context.Context, first *int) (<-chan *model.Review, error) {
+	reviews := r.reviews
+	if first != nil && *first < len(reviews) {
+		reviews = reviews[:*first]
+	}
+
+	ch := make(chan *model.Review)
+	go func() {
+		defer close(ch)
+		for _, review := range reviews {
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- review:
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
 // Username is the resolver for the username field.
 func (r *userResolver) Username(ctx context.Context, obj *model.User) (*string, error) {
 	for _, username := range r.usernames {
@@ -218,6 +240,9 @@ func (r *Resolver) Query() generated.QueryResolver { return &queryResolver{r} }
 // Review returns generated.ReviewResolver implementation.
 func (r *Resolver) Review() generated.ReviewResolver { return &reviewResolver{r} }
 
+// Subscription returns generated.SubscriptionResolver implementation.
+func (r *Resolver) Subscription() generated.SubscriptionResolver { return &subscriptionResolver{r} }
+
 // User returns generated.UserResolver implementation.
 func (r *Resolver) User() generated.UserResolver { return &userResolver{r} }
 
@@ -230,5 +255,6 @@ type furnitureResolver struct{ *Resolver }
 type mutationResolver struct{ *Resolver }
 type queryResolver struct{ *Resolver }
 type reviewResolver struct{ *Resolver }
+type subscriptionResolver struct{ *Resolver }
 type userResolver struct{ *Resolver }
 type vanResolver struct{ *Resolver }
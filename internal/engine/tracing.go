@@ -0,0 +1,66 @@
+package engine
+
+import (
+	"context"
+
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vvakame/fedeway/internal/plan"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the instrumentation name of spans made by fedeway.
+// span names are the same as Apollo Gateway's ones. e.g. gateway.fetch.
+const TracerName = "github.com/vvakame/fedeway"
+
+// attributes of spans.
+const (
+	AttributeServiceName = attribute.Key("fedeway.service.name")
+	AttributePath        = attribute.Key("fedeway.path")
+	AttributeEntityCount = attribute.Key("fedeway.entity.count")
+)
+
+// NewTracer returns the tracer of fedeway. the global TracerProvider is used when tp is nil.
+func NewTracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+
+	return tp.Tracer(TracerName)
+}
+
+// startNodeSpan starts the span of the plan node.
+func (ec *executionContext) startNodeSpan(ctx context.Context, node plan.PlanNode, path ast.Path) (context.Context, trace.Span) {
+	var name string
+	attrs := make([]attribute.KeyValue, 0, 2)
+	switch node := node.(type) {
+	case *plan.SequenceNode:
+		name = "gateway.sequence"
+	case *plan.ParallelNode:
+		name = "gateway.parallel"
+	case *plan.FlattenNode:
+		name = "gateway.flatten"
+		path = append(path[:len(path):len(path)], node.Path...)
+	case *plan.FetchNode:
+		name = "gateway.fetch"
+		attrs = append(attrs, AttributeServiceName.String(node.ServiceName))
+	default:
+		name = "gateway.unknown"
+	}
+	if len(path) != 0 {
+		attrs = append(attrs, AttributePath.String(path.String()))
+	}
+
+	return ec.Tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// setSpanError marks the current span as failed.
+func setSpanError(ctx context.Context, description string) {
+	trace.SpanFromContext(ctx).SetStatus(codes.Error, description)
+}
+
+// defaultPropagator sends the trace context by W3C Trace Context headers. e.g. traceparent.
+var defaultPropagator propagation.TextMapPropagator = propagation.TraceContext{}
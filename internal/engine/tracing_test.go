@@ -0,0 +1,138 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/MakeNowJust/heredoc/v2"
+	testlogr "github.com/go-logr/logr/testing"
+	"github.com/vvakame/fedeway/internal/log"
+	"github.com/vvakame/fedeway/internal/plan"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanTree formats ended spans as an indented tree. siblings are sorted to be stable over parallel executions.
+func spanTree(spans []sdktrace.ReadOnlySpan) string {
+	children := make(map[trace.SpanID][]sdktrace.ReadOnlySpan)
+	ids := make(map[trace.SpanID]bool)
+	for _, span := range spans {
+		ids[span.SpanContext().SpanID()] = true
+	}
+	var roots []sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		if parent := span.Parent().SpanID(); ids[parent] {
+			children[parent] = append(children[parent], span)
+		} else {
+			roots = append(roots, span)
+		}
+	}
+
+	describe := func(span sdktrace.ReadOnlySpan) string {
+		attrs := make([]string, 0, len(span.Attributes()))
+		for _, attr := range span.Attributes() {
+			attrs = append(attrs, fmt.Sprintf("%s=%s", attr.Key, attr.Value.Emit()))
+		}
+		sort.Strings(attrs)
+		if len(attrs) == 0 {
+			return span.Name()
+		}
+		return fmt.Sprintf("%s(%s)", span.Name(), strings.Join(attrs, ", "))
+	}
+
+	var buf strings.Builder
+	var write func(spans []sdktrace.ReadOnlySpan, depth int)
+	write = func(spans []sdktrace.ReadOnlySpan, depth int) {
+		sort.SliceStable(spans, func(i, j int) bool {
+			return describe(spans[i]) < describe(spans[j])
+		})
+		for _, span := range spans {
+			buf.WriteString(strings.Repeat("\t", depth))
+			buf.WriteString(describe(span))
+			buf.WriteString("\n")
+			write(children[span.SpanContext().SpanID()], depth+1)
+		}
+	}
+	write(roots, 0)
+
+	return buf.String()
+}
+
+func TestExecuteQueryPlanSpans(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	const query = `
+		query {
+			topReviews(first: 2) {
+				body
+				author {
+					name {
+						first
+					}
+				}
+			}
+		}
+	`
+
+	composedSchema, serviceMap, qp, oc := planQuery(ctx, t, query)
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	resp := ExecuteQueryPlan(ctx, qp, serviceMap, composedSchema, oc, WithTracerProvider(tp))
+	if len(resp.Errors) != 0 {
+		t.Fatal(resp.Errors)
+	}
+
+	expected := heredoc.Doc(`
+		gateway.execute
+			gateway.postprocessing
+			gateway.sequence
+				gateway.fetch(fedeway.service.name=reviews)
+				gateway.flatten(fedeway.path=topReviews.@.author)
+					gateway.fetch(fedeway.entity.count=1, fedeway.path=topReviews.@.author, fedeway.service.name=accounts)
+	`)
+	if v := spanTree(recorder.Ended()); v != expected {
+		var buf strings.Builder
+		plan.NewFormatter(&buf).FormatQueryPlan(qp)
+		t.Errorf("unexpected spans:\n%s\nquery plan:\n%s", v, buf.String())
+	}
+}
+
+func TestRemoteDataSourceTraceContext(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	traceparents := make(chan string, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("Traceparent")
+		_, _ = w.Write([]byte(`{"data":{"__typename":"Query"}}`))
+	}))
+	defer s.Close()
+
+	tp := sdktrace.NewTracerProvider()
+	ctx, span := tp.Tracer("test").Start(ctx, "test")
+	defer span.End()
+
+	oc, gErr := newFetchOperationContext(&plan.FetchNode{Operation: `query { __typename }`}, nil, nil)
+	if gErr != nil {
+		t.Fatal(gErr)
+	}
+	ds := &RemoteDataSource{URL: s.URL}
+	resp := ds.Process(ctx, oc)
+	if len(resp.Errors) != 0 {
+		t.Fatal(resp.Errors)
+	}
+
+	traceparent := <-traceparents
+	expected := fmt.Sprintf("00-%s-%s-01", span.SpanContext().TraceID(), span.SpanContext().SpanID())
+	if traceparent != expected {
+		t.Errorf("unexpected traceparent: %s, expected: %s", traceparent, expected)
+	}
+}
@@ -34,11 +34,13 @@ type ExecutionArgs struct {
 	Schema         *ast.Schema
 	RawQuery       string
 	Document       *ast.QueryDocument
-	RootValue      interface{}            // optional
-	VariableValues map[string]interface{} // optional
-	OperationName  string                 // optional
-	FieldResolver  FieldResolver          // optional
-	TypeResolver   TypeResolver           // optional
+	RootValue      interface{}                // optional
+	VariableValues map[string]interface{}     // optional
+	OperationName  string                     // optional
+	FieldResolver  FieldResolver              // optional
+	TypeResolver   TypeResolver               // optional
+	ErrorPresenter graphql.ErrorPresenterFunc // optional
+	RecoverFunc    graphql.RecoverFunc        // optional
 }
 
 var _ FieldResolver = defaultFieldResolver
@@ -64,13 +66,21 @@ func Execute(ctx context.Context, args *ExecutionArgs) *graphql.Response {
 	operationName := args.OperationName
 	fieldResolver := args.FieldResolver
 	typeResolver := args.TypeResolver
+	errorPresenter := args.ErrorPresenter
+	if errorPresenter == nil {
+		errorPresenter = graphql.DefaultErrorPresenter
+	}
+	recoverFunc := args.RecoverFunc
+	if recoverFunc == nil {
+		recoverFunc = graphql.DefaultRecover
+	}
 
 	oc := &graphql.OperationContext{
 		RawQuery:           rawQuery,
 		Variables:          variableValues,
 		Doc:                document,
 		Operation:          document.Operations.ForName(operationName),
-		RecoverFunc:        nil, // TODO
+		RecoverFunc:        recoverFunc,
 		ResolverMiddleware: nil, // TODO
 	}
 	var err error
@@ -85,8 +95,7 @@ func Execute(ctx context.Context, args *ExecutionArgs) *graphql.Response {
 		}
 	}
 	ctx = graphql.WithOperationContext(ctx, oc)
-	// TODO default 使うのをやめる
-	ctx = graphql.WithResponseContext(ctx, graphql.DefaultErrorPresenter, graphql.DefaultRecover)
+	ctx = graphql.WithResponseContext(ctx, errorPresenter, recoverFunc)
 
 	// If a valid execution context cannot be created due to incorrect arguments,
 	// a "Response" with only errors is returned.
@@ -95,9 +104,16 @@ func Execute(ctx context.Context, args *ExecutionArgs) *graphql.Response {
 	return execute(ctx, exeContext)
 }
 
-func execute(ctx context.Context, exeContext *ExecutionContext) *graphql.Response {
+func execute(ctx context.Context, exeContext *ExecutionContext) (resp *graphql.Response) {
 	oc := graphql.GetOperationContext(ctx)
 
+	defer func() {
+		if r := recover(); r != nil {
+			graphql.AddError(ctx, graphql.Recover(ctx, r))
+			resp = buildResponse(ctx, graphql.Null)
+		}
+	}()
+
 	// Return a Promise that will eventually resolve to the data described by
 	// The "Response" section of the GraphQL specification.
 	//
@@ -211,6 +227,7 @@ func executeOperation(ctx context.Context, exeContext *ExecutionContext, operati
 // for fields that must be executed serially.
 func executeFieldsSerially(ctx context.Context, exeContext *ExecutionContext, parentType *ast.Definition, sourceValue interface{}, fields []graphql.CollectedField) graphql.Marshaler {
 	oc := graphql.GetOperationContext(ctx)
+	fields = filterFieldsDefinedOn(parentType, fields)
 
 	out := graphql.NewFieldSet(fields)
 	var invalids uint32
@@ -232,7 +249,8 @@ func executeFieldsSerially(ctx context.Context, exeContext *ExecutionContext, pa
 			field,
 		)
 
-		if len(graphql.GetFieldErrors(ctx, fc)) != 0 {
+		// NOTE only null of the non-null field is propagated to the parent
+		if data == graphql.Null && field.Definition.Type.NonNull {
 			invalids++
 		}
 
@@ -254,12 +272,13 @@ func executeFieldsSerially(ctx context.Context, exeContext *ExecutionContext, pa
 // for fields that may be executed in parallel.
 func executeFields(ctx context.Context, exeContext *ExecutionContext, parentType *ast.Definition, sourceValue interface{}, fields []graphql.CollectedField) graphql.Marshaler {
 	oc := graphql.GetOperationContext(ctx)
+	fields = filterFieldsDefinedOn(parentType, fields)
 
 	out := graphql.NewFieldSet(fields)
 	var invalids uint32
 	for i, field := range fields {
 		field := field
-		out.Concurrently(i, func(ctx context.Context) graphql.Marshaler {
+		out.Concurrently(i, func(ctx context.Context) (ret graphql.Marshaler) {
 			fc := &graphql.FieldContext{
 				Object: field.ObjectDefinition.Name,
 				Field:  field,
@@ -269,6 +288,14 @@ func executeFields(ctx context.Context, exeContext *ExecutionContext, parentType
 			// TODO rawArgs から args への変換処理必要？ Unmarshal しない前提ならいらないはずだが
 			fc.Args = rawArgs
 
+			defer func() {
+				if r := recover(); r != nil {
+					graphql.AddError(ctx, graphql.Recover(ctx, r))
+					atomic.AddUint32(&invalids, 1)
+					ret = graphql.Null
+				}
+			}()
+
 			data := executeField(
 				ctx,
 				exeContext,
@@ -277,7 +304,8 @@ func executeFields(ctx context.Context, exeContext *ExecutionContext, parentType
 				field,
 			)
 
-			if len(graphql.GetFieldErrors(ctx, fc)) != 0 {
+			// NOTE only null of the non-null field is propagated to the parent
+			if data == graphql.Null && field.Definition.Type.NonNull {
 				atomic.AddUint32(&invalids, 1)
 			}
 
@@ -296,6 +324,19 @@ func executeFields(ctx context.Context, exeContext *ExecutionContext, parentType
 	return result
 }
 
+// NOTE original では getFieldDef が undefined を返す field は結果に含まれない
+// document が別の schema で validate されている場合(e.g. API schema に存在しない @inaccessible な field) に必要
+func filterFieldsDefinedOn(parentType *ast.Definition, fields []graphql.CollectedField) []graphql.CollectedField {
+	newFields := make([]graphql.CollectedField, 0, len(fields))
+	for _, field := range fields {
+		if strings.HasPrefix(field.Name, "__") || parentType.Fields.ForName(field.Name) != nil {
+			newFields = append(newFields, field)
+		}
+	}
+
+	return newFields
+}
+
 // Implements the "Executing field" section of the spec
 // In particular, this function figures out the value that the field returns by
 // calling its resolve function, then calls completeValue to complete promises,
@@ -374,11 +415,11 @@ func completeValue(ctx context.Context, exeContext *ExecutionContext, returnType
 			fieldNode,
 			result,
 		)
-		if len(graphql.GetFieldErrors(ctx, fc)) != 0 {
-			return graphql.Null
-		}
 		if completed == graphql.Null {
-			graphql.AddErrorf(ctx, "cannot return null for non-nullable field %s.%s", fieldNode.ObjectDefinition.Name, fieldNode.Name)
+			// NOTE the error is already reported when the null comes from it
+			if len(graphql.GetFieldErrors(ctx, fc)) == 0 {
+				graphql.AddErrorf(ctx, "cannot return null for non-nullable field %s.%s", fieldNode.ObjectDefinition.Name, fieldNode.Name)
+			}
 			return graphql.Null
 		}
 		return completed
@@ -446,15 +487,6 @@ func completeListValue(ctx context.Context, exeContext *ExecutionContext, return
 		return graphql.Null
 	}
 
-	// TODO goroutine内でのpanicをrecoverする必要がある
-	// 以下はgqlgenでの対応パターン
-	//defer func() {
-	//	if r := recover(); r != nil {
-	//		ec.Error(ctx, ec.Recover(ctx, r))
-	//		ret = graphql.Null
-	//	}
-	//}()
-
 	// This is specified as a simple map, however we're optimizing the path
 	// where the list contains no Promises by avoiding creating another Promise.
 	itemType := returnType.Elem
@@ -467,12 +499,22 @@ func completeListValue(ctx context.Context, exeContext *ExecutionContext, return
 		item := resultRV.Index(index).Interface()
 
 		go func() {
+			defer wg.Done()
+
 			fc := &graphql.FieldContext{
 				Index:  &index,
 				Result: item,
 			}
 			ctx := graphql.WithFieldContext(ctx, fc)
 
+			// NOTE gqlgen の生成コードと同様に panic は RecoverFunc で error に変換する
+			defer func() {
+				if r := recover(); r != nil {
+					graphql.AddError(ctx, graphql.Recover(ctx, r))
+					ret[index] = graphql.Null
+				}
+			}()
+
 			ret[index] = completeValue(
 				ctx,
 				exeContext,
@@ -480,8 +522,6 @@ func completeListValue(ctx context.Context, exeContext *ExecutionContext, return
 				fieldNode,
 				item,
 			)
-
-			wg.Done()
 		}()
 	}
 
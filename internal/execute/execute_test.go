@@ -3,6 +3,7 @@ package execute
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	testlogr "github.com/go-logr/logr/testing"
 	"github.com/vvakame/fedeway/internal/log"
 	"github.com/vvakame/fedeway/internal/testutils"
@@ -11,7 +12,10 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2"
 	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
 	"github.com/vektah/gqlparser/v2/parser"
 	"github.com/vektah/gqlparser/v2/validator"
 )
@@ -131,3 +135,62 @@ func TestExecute(t *testing.T) {
 		})
 	}
 }
+
+func TestExecuteRecoverPanic(t *testing.T) {
+	ctx := context.Background()
+	ctx = log.WithLogger(ctx, testlogr.NewTestLogger(t))
+
+	schema, gErr := gqlparser.LoadSchema(&ast.Source{
+		Input: `
+			type Query { items: [Item] }
+			interface Item { name: String }
+			type Foo implements Item { name: String }
+		`,
+	})
+	if gErr != nil {
+		t.Fatal(gErr)
+	}
+	document, gErrs := gqlparser.LoadQuery(schema, `{ items { name } }`)
+	if len(gErrs) != 0 {
+		t.Fatal(gErrs)
+	}
+
+	response := Execute(ctx, &ExecutionArgs{
+		Schema:   schema,
+		Document: document,
+		RootValue: map[string]interface{}{
+			"items": []interface{}{
+				map[string]interface{}{"__typename": "Foo", "name": "foo"},
+				map[string]interface{}{"__typename": "Bar", "name": "bar"},
+			},
+		},
+		TypeResolver: func(ctx context.Context, value interface{}, schema *ast.Schema, abstractType *ast.Type) string {
+			typename := value.(map[string]interface{})["__typename"].(string)
+			if typename == "Bar" {
+				panic("unknown typename")
+			}
+			return typename
+		},
+		ErrorPresenter: func(ctx context.Context, err error) *gqlerror.Error {
+			gErr := graphql.DefaultErrorPresenter(ctx, err)
+			gErr.Extensions = map[string]interface{}{"code": "INTERNAL_SERVER_ERROR"}
+			return gErr
+		},
+		RecoverFunc: func(ctx context.Context, err interface{}) error {
+			return fmt.Errorf("recovered: %v", err)
+		},
+	})
+
+	if len(response.Errors) != 1 {
+		t.Fatalf("unexpected errors: %v", response.Errors)
+	}
+	if v := response.Errors[0].Message; v != "recovered: unknown typename" {
+		t.Errorf("unexpected message: %s", v)
+	}
+	if v := response.Errors[0].Path.String(); v != "items[1]" {
+		t.Errorf("unexpected path: %s", v)
+	}
+	if v := response.Errors[0].Extensions["code"]; v != "INTERNAL_SERVER_ERROR" {
+		t.Errorf("unexpected code: %v", v)
+	}
+}
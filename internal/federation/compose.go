@@ -32,6 +32,16 @@ func emptyMutationDefinition() *TypeDefinitionEntity {
 	}
 }
 
+func emptySubscriptionDefinition() *TypeDefinitionEntity {
+	return &TypeDefinitionEntity{
+		ServiceName: "",
+		Definition: &ast.Definition{
+			Kind: ast.Object,
+			Name: "Subscription",
+		},
+	}
+}
+
 // Map of all type definitions to eventually be passed to extendSchema
 type TypeDefinitionsMap map[string][]*TypeDefinitionEntity
 type TypeDefinitionEntity struct {
@@ -289,7 +299,7 @@ func buildMapsFromServiceList(ctx context.Context, serviceList []*ServiceDefinit
 	// list. Without a Query/Mutation definition, we can't _extend_ the type.
 	// extendSchema will complain about this. We can't add an empty
 	// GraphQLObjectType to the schema constructor, so we add an empty definition
-	// here. We only add mutation if there is a mutation extension though.
+	// here. We only add mutation (and subscription) if there is a mutation (subscription) extension though.
 	{
 		_, ok := typeDefinitionsMap["Query"]
 		if !ok {
@@ -303,6 +313,13 @@ func buildMapsFromServiceList(ctx context.Context, serviceList []*ServiceDefinit
 			typeDefinitionsMap["Mutation"] = []*TypeDefinitionEntity{emptyMutationDefinition()}
 		}
 	}
+	{
+		_, extOK := typeExtensionsMap["Subscription"]
+		_, defOK := typeDefinitionsMap["Subscription"]
+		if extOK && !defOK {
+			typeDefinitionsMap["Subscription"] = []*TypeDefinitionEntity{emptySubscriptionDefinition()}
+		}
+	}
 
 	return &buildMaps{
 		typeToServiceMap:        typeToServiceMap,
@@ -320,7 +337,7 @@ func buildSchemaFromDefinitionsAndExtensions(ctx context.Context, typeDefinition
 	var errors []error
 
 	// We only want to include the definitions of other known Apollo directives
-	// (currently just @tag) if there are usages.
+	// (currently @tag and @inaccessible) if there are usages.
 	var otherKnownDirectiveDefinitionsToInclude ast.DirectiveDefinitionList
 	for _, directive := range otherKnownDirectiveDefinitions {
 		if directiveMetadata.HasUsage(directive.Name) {
@@ -95,6 +95,17 @@ var tagDirective = &ast.DirectiveDefinition{
 	Position:     blankPos,
 }
 
+var inaccessibleDirective = &ast.DirectiveDefinition{
+	Name: "inaccessible",
+	Locations: []ast.DirectiveLocation{
+		ast.LocationFieldDefinition,
+		ast.LocationObject,
+		ast.LocationInterface,
+		ast.LocationUnion,
+	},
+	Position: blankPos,
+}
+
 var federationDirectives = ast.DirectiveDefinitionList{
 	keyDirective,
 	extendsDirective,
@@ -105,6 +116,7 @@ var federationDirectives = ast.DirectiveDefinitionList{
 
 var otherKnownDirectiveDefinitions = ast.DirectiveDefinitionList{
 	tagDirective,
+	inaccessibleDirective,
 }
 
 var apolloTypeSystemDirectives = func() ast.DirectiveDefinitionList {
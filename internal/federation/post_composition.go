@@ -752,7 +752,7 @@ func providesFieldsMissingExternal(schema *ast.Schema, metadata *FederationMetad
 			}
 
 			fieldType := schema.Types[field.Type.Name()]
-			if fieldType.Kind != ast.Object {
+			if fieldType == nil || fieldType.Kind != ast.Object {
 				continue
 			}
 
@@ -837,7 +837,7 @@ func providesFieldsSelectInvalidType(schema *ast.Schema, metadata *FederationMet
 			}
 
 			fieldType := schema.Types[field.Type.Name()]
-			if fieldType.Kind != ast.Object {
+			if fieldType == nil || fieldType.Kind != ast.Object {
 				continue
 			}
 
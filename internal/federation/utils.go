@@ -69,7 +69,7 @@ func stripTypeSystemDirectivesFromTypeDefs(typeDefs *ast.SchemaDocument) *ast.Sc
 		case "deprecated", "specifiedBy":
 			// The `deprecated` directive is an exceptional case that we want to leave in
 			return true
-		case "key", "extends", "external", "requires", "provides", "tag":
+		case "key", "extends", "external", "requires", "provides", "tag", "inaccessible":
 			// apolloTypeSystemDirectives
 			return true
 		default:
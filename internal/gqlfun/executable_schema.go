@@ -45,14 +45,44 @@ func CreateOperationContext(ctx context.Context, schema *ast.Schema, query strin
 	return oc, nil
 }
 
-func Execute(ctx context.Context, es graphql.ExecutableSchema, query string, vairables map[string]interface{}) *graphql.Response {
+type executeConfig struct {
+	errorPresenter graphql.ErrorPresenterFunc
+	recoverFunc    graphql.RecoverFunc
+}
+
+type ExecuteOption func(cfg *executeConfig)
+
+func WithErrorPresenter(errorPresenter graphql.ErrorPresenterFunc) ExecuteOption {
+	return func(cfg *executeConfig) {
+		cfg.errorPresenter = errorPresenter
+	}
+}
+
+func WithRecoverFunc(recoverFunc graphql.RecoverFunc) ExecuteOption {
+	return func(cfg *executeConfig) {
+		cfg.recoverFunc = recoverFunc
+	}
+}
+
+func Execute(ctx context.Context, es graphql.ExecutableSchema, query string, vairables map[string]interface{}, opts ...ExecuteOption) *graphql.Response {
+	cfg := &executeConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.errorPresenter == nil {
+		cfg.errorPresenter = graphql.DefaultErrorPresenter
+	}
+	if cfg.recoverFunc == nil {
+		cfg.recoverFunc = graphql.DefaultRecover
+	}
+
 	oc, gErrs := CreateOperationContext(ctx, es.Schema(), query, vairables)
 	if len(gErrs) != 0 {
 		return &graphql.Response{Errors: gErrs}
 	}
+	oc.RecoverFunc = cfg.recoverFunc
 	ctx = graphql.WithOperationContext(ctx, oc)
-	// TODO make configurable
-	ctx = graphql.WithResponseContext(ctx, graphql.DefaultErrorPresenter, graphql.DefaultRecover)
+	ctx = graphql.WithResponseContext(ctx, cfg.errorPresenter, cfg.recoverFunc)
 
 	rh := es.Exec(ctx)
 	resp := rh(ctx)
@@ -168,6 +168,32 @@ func (f *formatter) FormatPlanNode(node PlanNode) {
 		f.WriteNewline()
 		f.WriteWord("Parallel")
 		nodes = node.Nodes
+	case *SubscriptionNode:
+		f.WriteNewline()
+		f.WriteWord("Subscription").WriteWord("{")
+		f.IncrementIndent()
+
+		f.WriteNewline()
+		f.WriteWord("Primary:").WriteWord("{")
+		f.IncrementIndent()
+		f.FormatPlanNode(node.Primary)
+		f.DecrementIndent()
+		f.WriteNewline()
+		f.WriteString("},")
+
+		if node.Rest != nil {
+			f.WriteNewline()
+			f.WriteWord("Rest:").WriteWord("{")
+			f.IncrementIndent()
+			f.FormatPlanNode(node.Rest)
+			f.DecrementIndent()
+			f.WriteNewline()
+			f.WriteString("},")
+		}
+
+		f.DecrementIndent()
+		f.WriteNewline()
+		f.WriteString("}")
 	}
 
 	if len(nodes) != 0 {
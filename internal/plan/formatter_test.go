@@ -128,6 +128,58 @@ func TestFormatter(t *testing.T) {
 				}
 			`),
 		},
+		{
+			name: "with subscription node",
+			node: &QueryPlan{
+				Node: &SubscriptionNode{
+					Primary: &FetchNode{
+						ServiceName:    "reviews",
+						VariableUsages: []string{},
+						Operation:      "subscription { reviewAdded { author { __typename id } } }",
+					},
+					Rest: &FlattenNode{
+						Path: ast.Path{
+							ast.PathName("reviewAdded"),
+							ast.PathName("author"),
+						},
+						Node: &FetchNode{
+							ServiceName:    "users",
+							VariableUsages: []string{},
+							Operation:      "{ me { id } }",
+						},
+					},
+				},
+			},
+			want: heredoc.Doc(`
+				QueryPlan {
+					Subscription {
+						Primary: {
+							Fetch(service: "reviews") {
+								subscription {
+									reviewAdded {
+										author {
+											__typename
+											id
+										}
+									}
+								}
+							}
+						},
+						Rest: {
+							Flatten(path: "reviewAdded.author") {
+								Fetch(service: "users") {
+									query {
+										me {
+											id
+										}
+									}
+								},
+							}
+						},
+					},
+				}
+			`),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,326 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/parser"
+)
+
+// JSON encoding of the query plan. the shape is compatible with the query plan of Apollo Gateway.
+// e.g. {"kind":"QueryPlan","node":{"kind":"Fetch","serviceName":"accounts","variableUsages":[],"operation":"{me{id}}"}}
+
+var _ json.Marshaler = (*QueryPlan)(nil)
+var _ json.Unmarshaler = (*QueryPlan)(nil)
+var _ json.Marshaler = (*SequenceNode)(nil)
+var _ json.Marshaler = (*ParallelNode)(nil)
+var _ json.Marshaler = (*FetchNode)(nil)
+var _ json.Unmarshaler = (*FetchNode)(nil)
+var _ json.Marshaler = (*FlattenNode)(nil)
+var _ json.Marshaler = (*SubscriptionNode)(nil)
+var _ json.Marshaler = (*QueryPlanFieldNode)(nil)
+var _ json.Marshaler = (*QueryPlanInlineFragmentNode)(nil)
+
+func (qp *QueryPlan) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Kind string   `json:"kind"`
+		Node PlanNode `json:"node,omitempty"`
+	}{
+		Kind: "QueryPlan",
+		Node: qp.Node,
+	})
+}
+
+func (qp *QueryPlan) UnmarshalJSON(b []byte) error {
+	var v struct {
+		Kind string          `json:"kind"`
+		Node json.RawMessage `json:"node"`
+	}
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+	if v.Kind != "QueryPlan" {
+		return fmt.Errorf(`unexpected kind "%s", expected "QueryPlan"`, v.Kind)
+	}
+
+	qp.Node, err = unmarshalPlanNode(v.Node)
+	return err
+}
+
+func (n *SequenceNode) MarshalJSON() ([]byte, error) {
+	nodes := n.Nodes
+	if nodes == nil {
+		nodes = []PlanNode{}
+	}
+	return json.Marshal(&struct {
+		Kind  string     `json:"kind"`
+		Nodes []PlanNode `json:"nodes"`
+	}{
+		Kind:  "Sequence",
+		Nodes: nodes,
+	})
+}
+
+func (n *ParallelNode) MarshalJSON() ([]byte, error) {
+	nodes := n.Nodes
+	if nodes == nil {
+		nodes = []PlanNode{}
+	}
+	return json.Marshal(&struct {
+		Kind  string     `json:"kind"`
+		Nodes []PlanNode `json:"nodes"`
+	}{
+		Kind:  "Parallel",
+		Nodes: nodes,
+	})
+}
+
+func (n *FetchNode) MarshalJSON() ([]byte, error) {
+	// NOTE Apollo Gateway always has variableUsages
+	variableUsages := n.VariableUsages
+	if variableUsages == nil {
+		variableUsages = []string{}
+	}
+	return json.Marshal(&struct {
+		Kind           string                   `json:"kind"`
+		ServiceName    string                   `json:"serviceName"`
+		VariableUsages []string                 `json:"variableUsages"`
+		Requires       []QueryPlanSelectionNode `json:"requires,omitempty"`
+		Operation      string                   `json:"operation"`
+	}{
+		Kind:           "Fetch",
+		ServiceName:    n.ServiceName,
+		VariableUsages: variableUsages,
+		Requires:       n.Requires,
+		Operation:      n.Operation,
+	})
+}
+
+// UnmarshalJSON also parses the operation like the planner does.
+func (n *FetchNode) UnmarshalJSON(b []byte) error {
+	var v struct {
+		Kind           string            `json:"kind"`
+		ServiceName    string            `json:"serviceName"`
+		VariableUsages []string          `json:"variableUsages"`
+		Requires       []json.RawMessage `json:"requires"`
+		Operation      string            `json:"operation"`
+	}
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+	if v.Kind != "Fetch" {
+		return fmt.Errorf(`unexpected kind "%s", expected "Fetch"`, v.Kind)
+	}
+
+	requires, err := unmarshalSelectionNodes(v.Requires)
+	if err != nil {
+		return err
+	}
+	operationDocument, err := parser.ParseQuery(&ast.Source{Input: v.Operation})
+	if err != nil {
+		return fmt.Errorf(`invalid operation for service "%s": %w`, v.ServiceName, err)
+	}
+
+	if v.VariableUsages == nil {
+		v.VariableUsages = []string{}
+	}
+
+	*n = FetchNode{
+		ServiceName:         v.ServiceName,
+		VariableUsages:      v.VariableUsages,
+		Requires:            requires,
+		Operation:           v.Operation,
+		OperationDocument:   operationDocument,
+		OperationDefinition: operationDocument.Operations.ForName(""),
+	}
+
+	return nil
+}
+
+func (n *FlattenNode) MarshalJSON() ([]byte, error) {
+	path := n.Path
+	if path == nil {
+		path = ast.Path{}
+	}
+	return json.Marshal(&struct {
+		Kind string   `json:"kind"`
+		Path ast.Path `json:"path"`
+		Node PlanNode `json:"node"`
+	}{
+		Kind: "Flatten",
+		Path: path,
+		Node: n.Node,
+	})
+}
+
+func (n *SubscriptionNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Kind    string     `json:"kind"`
+		Primary *FetchNode `json:"primary"`
+		Rest    PlanNode   `json:"rest,omitempty"`
+	}{
+		Kind:    "Subscription",
+		Primary: n.Primary,
+		Rest:    n.Rest,
+	})
+}
+
+func (n *QueryPlanFieldNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Kind       string                   `json:"kind"`
+		Alias      string                   `json:"alias,omitempty"`
+		Name       string                   `json:"name"`
+		Selections []QueryPlanSelectionNode `json:"selections,omitempty"`
+	}{
+		Kind:       "Field",
+		Alias:      n.Alias,
+		Name:       n.Name,
+		Selections: n.Selections,
+	})
+}
+
+func (n *QueryPlanInlineFragmentNode) MarshalJSON() ([]byte, error) {
+	selections := n.Selections
+	if selections == nil {
+		selections = []QueryPlanSelectionNode{}
+	}
+	return json.Marshal(&struct {
+		Kind          string                   `json:"kind"`
+		TypeCondition string                   `json:"typeCondition,omitempty"`
+		Selections    []QueryPlanSelectionNode `json:"selections"`
+	}{
+		Kind:          "InlineFragment",
+		TypeCondition: n.TypeCondition,
+		Selections:    selections,
+	})
+}
+
+// unmarshalPlanNode decodes the node by its kind. it returns nil for null.
+func unmarshalPlanNode(b json.RawMessage) (PlanNode, error) {
+	if len(b) == 0 || string(b) == "null" {
+		return nil, nil
+	}
+
+	var v struct {
+		Kind    string            `json:"kind"`
+		Nodes   []json.RawMessage `json:"nodes"`
+		Path    ast.Path          `json:"path"`
+		Node    json.RawMessage   `json:"node"`
+		Primary json.RawMessage   `json:"primary"`
+		Rest    json.RawMessage   `json:"rest"`
+	}
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v.Kind {
+	case "Sequence":
+		nodes, err := unmarshalPlanNodes(v.Nodes)
+		if err != nil {
+			return nil, err
+		}
+		return &SequenceNode{Nodes: nodes}, nil
+	case "Parallel":
+		nodes, err := unmarshalPlanNodes(v.Nodes)
+		if err != nil {
+			return nil, err
+		}
+		return &ParallelNode{Nodes: nodes}, nil
+	case "Fetch":
+		node := &FetchNode{}
+		err := json.Unmarshal(b, node)
+		if err != nil {
+			return nil, err
+		}
+		return node, nil
+	case "Flatten":
+		node, err := unmarshalPlanNode(v.Node)
+		if err != nil {
+			return nil, err
+		}
+		if node == nil {
+			return nil, fmt.Errorf("node of Flatten is required")
+		}
+		return &FlattenNode{Path: v.Path, Node: node}, nil
+	case "Subscription":
+		if len(v.Primary) == 0 || string(v.Primary) == "null" {
+			return nil, fmt.Errorf("primary of Subscription is required")
+		}
+		primary := &FetchNode{}
+		err := json.Unmarshal(v.Primary, primary)
+		if err != nil {
+			return nil, err
+		}
+		rest, err := unmarshalPlanNode(v.Rest)
+		if err != nil {
+			return nil, err
+		}
+		return &SubscriptionNode{Primary: primary, Rest: rest}, nil
+	default:
+		return nil, fmt.Errorf(`unknown plan node kind "%s"`, v.Kind)
+	}
+}
+
+func unmarshalPlanNodes(bs []json.RawMessage) ([]PlanNode, error) {
+	nodes := make([]PlanNode, 0, len(bs))
+	for _, b := range bs {
+		node, err := unmarshalPlanNode(b)
+		if err != nil {
+			return nil, err
+		}
+		if node == nil {
+			return nil, fmt.Errorf("plan node must not be null")
+		}
+		nodes = append(nodes, node)
+	}
+
+	return nodes, nil
+}
+
+func unmarshalSelectionNodes(bs []json.RawMessage) ([]QueryPlanSelectionNode, error) {
+	if bs == nil {
+		return nil, nil
+	}
+
+	selections := make([]QueryPlanSelectionNode, 0, len(bs))
+	for _, b := range bs {
+		var v struct {
+			Kind          string            `json:"kind"`
+			Alias         string            `json:"alias"`
+			Name          string            `json:"name"`
+			TypeCondition string            `json:"typeCondition"`
+			Selections    []json.RawMessage `json:"selections"`
+		}
+		err := json.Unmarshal(b, &v)
+		if err != nil {
+			return nil, err
+		}
+
+		subSelections, err := unmarshalSelectionNodes(v.Selections)
+		if err != nil {
+			return nil, err
+		}
+
+		switch v.Kind {
+		case "Field":
+			selections = append(selections, &QueryPlanFieldNode{
+				Alias:      v.Alias,
+				Name:       v.Name,
+				Selections: subSelections,
+			})
+		case "InlineFragment":
+			selections = append(selections, &QueryPlanInlineFragmentNode{
+				TypeCondition: v.TypeCondition,
+				Selections:    subSelections,
+			})
+		default:
+			return nil, fmt.Errorf(`unknown selection node kind "%s"`, v.Kind)
+		}
+	}
+
+	return selections, nil
+}
@@ -0,0 +1,125 @@
+package plan
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestQueryPlanJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{
+			name: "blank",
+			json: `{"kind":"QueryPlan"}`,
+		},
+		{
+			name: "sequence with flatten and requires",
+			json: `{
+				"kind": "QueryPlan",
+				"node": {
+					"kind": "Sequence",
+					"nodes": [
+						{"kind": "Fetch", "serviceName": "accounts", "variableUsages": ["first"], "operation": "query($first:Int){me{__typename id}}"},
+						{
+							"kind": "Flatten",
+							"path": ["me", "@", "reviews"],
+							"node": {
+								"kind": "Fetch",
+								"serviceName": "reviews",
+								"variableUsages": [],
+								"requires": [
+									{"kind": "InlineFragment", "typeCondition": "User", "selections": [
+										{"kind": "Field", "name": "__typename"},
+										{"kind": "Field", "alias": "userId", "name": "id"}
+									]}
+								],
+								"operation": "query($representations:[_Any!]!){_entities(representations:$representations){...on User{reviews{body}}}}"
+							}
+						}
+					]
+				}
+			}`,
+		},
+		{
+			name: "parallel",
+			json: `{
+				"kind": "QueryPlan",
+				"node": {
+					"kind": "Parallel",
+					"nodes": [
+						{"kind": "Fetch", "serviceName": "accounts", "variableUsages": [], "operation": "{me{id}}"},
+						{"kind": "Fetch", "serviceName": "product", "variableUsages": [], "operation": "{topProducts{upc}}"}
+					]
+				}
+			}`,
+		},
+		{
+			name: "subscription",
+			json: `{
+				"kind": "QueryPlan",
+				"node": {
+					"kind": "Subscription",
+					"primary": {"kind": "Fetch", "serviceName": "reviews", "variableUsages": [], "operation": "subscription{reviewAdded{id}}"},
+					"rest": {
+						"kind": "Flatten",
+						"path": ["reviewAdded"],
+						"node": {"kind": "Fetch", "serviceName": "accounts", "variableUsages": [], "operation": "{__typename}"}
+					}
+				}
+			}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qp := &QueryPlan{}
+			err := json.Unmarshal([]byte(tt.json), qp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := json.Marshal(qp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var want bytes.Buffer
+			err = json.Compact(&want, []byte(tt.json))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v := string(b); v != want.String() {
+				t.Errorf("unexpected json: %s", v)
+			}
+		})
+	}
+}
+
+func TestFetchNodeUnmarshalJSON(t *testing.T) {
+	node := &FetchNode{}
+	err := json.Unmarshal([]byte(`{"kind":"Fetch","serviceName":"accounts","operation":"{me{id}}"}`), node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if node.VariableUsages == nil {
+		t.Error("variableUsages must not be nil")
+	}
+	if node.OperationDocument == nil || node.OperationDefinition == nil {
+		t.Fatal("operation must be parsed")
+	}
+	if v := node.OperationDefinition.SelectionSet; len(v) != 1 {
+		t.Errorf("unexpected selection set: %v", v)
+	}
+
+	err = json.Unmarshal([]byte(`{"kind":"Fetch","serviceName":"accounts","operation":"{me{"}`), &FetchNode{})
+	if err == nil {
+		t.Error("invalid operation must be an error")
+	}
+	err = json.Unmarshal([]byte(`{"kind":"QueryPlan","node":{"kind":"Unknown"}}`), &QueryPlan{})
+	if err == nil {
+		t.Error("unknown kind must be an error")
+	}
+}
@@ -2,8 +2,10 @@ package plan
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
 )
 
 type QueryPlan struct {
@@ -18,6 +20,7 @@ var _ PlanNode = (*SequenceNode)(nil)
 var _ PlanNode = (*ParallelNode)(nil)
 var _ PlanNode = (*FetchNode)(nil)
 var _ PlanNode = (*FlattenNode)(nil)
+var _ PlanNode = (*SubscriptionNode)(nil)
 
 type SequenceNode struct {
 	Nodes []PlanNode
@@ -36,10 +39,33 @@ type FetchNode struct {
 	VariableUsages []string
 	Requires       []QueryPlanSelectionNode // optional
 	Operation      string
+
+	// OperationDocument and OperationDefinition are parsed Operation by the planner.
+	// they are shared by all executions of the plan. don't modify them.
+	OperationDocument   *ast.QueryDocument       // optional
+	OperationDefinition *ast.OperationDefinition // optional
+
+	validation documentValidation
 }
 
 func (n *FetchNode) isPlanNode() {}
 
+// documentValidation keeps the result of the validation of OperationDocument. it lives as long as the plan.
+type documentValidation struct {
+	once sync.Once
+	errs gqlerror.List
+}
+
+// ValidateOnce validates OperationDocument by validate at the first call and returns the same result after that.
+// the validation may annotate the document, it must be done before the document is shared by executions.
+func (n *FetchNode) ValidateOnce(validate func(doc *ast.QueryDocument) gqlerror.List) gqlerror.List {
+	n.validation.once.Do(func() {
+		n.validation.errs = validate(n.OperationDocument)
+	})
+
+	return n.validation.errs
+}
+
 type FlattenNode struct {
 	Path ast.Path
 	Node PlanNode
@@ -47,6 +73,15 @@ type FlattenNode struct {
 
 func (n *FlattenNode) isPlanNode() {}
 
+// SubscriptionNode is the root node of a subscription operation.
+// Primary subscribes to the service that owns the root field, Rest is executed for each event.
+type SubscriptionNode struct {
+	Primary *FetchNode
+	Rest    PlanNode // optional
+}
+
+func (n *SubscriptionNode) isPlanNode() {}
+
 type QueryPlanSelectionNode interface {
 	isQueryPlanSelectionNode()
 }
@@ -277,5 +277,11 @@ func BuildComposedSchema(ctx context.Context, document *ast.SchemaDocument) (*Co
 		}
 	}
 
+	apiSchema, err := removeInaccessibleElements(schema)
+	if err != nil {
+		return nil, err
+	}
+	cs.APISchema = apiSchema
+
 	return cs, nil
 }
@@ -11,6 +11,7 @@ import (
 	"github.com/vektah/gqlparser/v2/ast"
 	"github.com/vektah/gqlparser/v2/formatter"
 	"github.com/vektah/gqlparser/v2/gqlerror"
+	"github.com/vektah/gqlparser/v2/parser"
 	"github.com/vvakame/fedeway/internal/graphql"
 	"github.com/vvakame/fedeway/internal/log"
 	"github.com/vvakame/fedeway/internal/plan"
@@ -50,10 +51,6 @@ func BuildQueryPlan(ctx context.Context, operationContext *OperationContext, opt
 		return nil, err
 	}
 
-	if qpctx.operation.Operation == ast.Subscription {
-		return nil, gqlerror.Errorf("subscription is not supported")
-	}
-
 	rootType, err := getOperationRootType(ctx, qpctx.schema, qpctx.operation)
 	if err != nil {
 		return nil, err
@@ -95,6 +92,15 @@ func BuildQueryPlan(ctx context.Context, operationContext *OperationContext, opt
 		return nil, err
 	}
 
+	if qpctx.operation.Operation == ast.Subscription {
+		node, err := subscriptionNodeForGroups(ctx, qpctx, groups, rootType)
+		if err != nil {
+			return nil, err
+		}
+
+		return &plan.QueryPlan{Node: node}, nil
+	}
+
 	var nodes []plan.PlanNode
 	for _, group := range groups {
 		node, err := executionNodeForGroup(ctx, qpctx, group, rootType)
@@ -392,11 +398,19 @@ func executionNodeForGroup(ctx context.Context, qpctx *queryPlanningContext, fet
 	var buf bytes.Buffer
 	formatter.NewFormatter(&buf).FormatQueryDocument(operation)
 
+	// NOTE parse the operation here once. the plan is cached and executed many times.
+	operationDocument, err := parser.ParseQuery(&ast.Source{Input: buf.String()})
+	if err != nil {
+		return nil, err
+	}
+
 	fetchNode := &plan.FetchNode{
-		ServiceName:    serviceName,
-		VariableUsages: variableUsageNames,
-		Requires:       plan.TrimSelectionNodes(requires),
-		Operation:      buf.String(),
+		ServiceName:         serviceName,
+		VariableUsages:      variableUsageNames,
+		Requires:            plan.TrimSelectionNodes(requires),
+		Operation:           buf.String(),
+		OperationDocument:   operationDocument,
+		OperationDefinition: operationDocument.Operations.ForName(""),
 	}
 
 	var node plan.PlanNode
@@ -429,6 +443,37 @@ func executionNodeForGroup(ctx context.Context, qpctx *queryPlanningContext, fet
 	return node, nil
 }
 
+// subscriptionNodeForGroups splits the plan of the subscription root field into
+// the primary fetch (subscribe to the owning service) and the rest (executed for each event).
+func subscriptionNodeForGroups(ctx context.Context, qpctx *queryPlanningContext, groups []*FetchGroup, rootType *ast.Definition) (*plan.SubscriptionNode, error) {
+	// subscription operations must have exactly one root field. it is checked by validation.
+	if len(groups) != 1 {
+		return nil, gqlerror.Errorf("subscription root fields must be resolved by a single service, got %d services", len(groups))
+	}
+
+	node, err := executionNodeForGroup(ctx, qpctx, groups[0], rootType)
+	if err != nil {
+		return nil, err
+	}
+
+	switch node := node.(type) {
+	case *plan.FetchNode:
+		return &plan.SubscriptionNode{Primary: node}, nil
+	case *plan.SequenceNode:
+		primary, ok := node.Nodes[0].(*plan.FetchNode)
+		if !ok {
+			return nil, fmt.Errorf("unexpected primary node type: %T", node.Nodes[0])
+		}
+		rest, err := flatWrapSequence(ctx, node.Nodes[1:])
+		if err != nil {
+			return nil, err
+		}
+		return &plan.SubscriptionNode{Primary: primary, Rest: rest}, nil
+	default:
+		return nil, fmt.Errorf("unexpected subscription node type: %T", node)
+	}
+}
+
 func operationForRootFetch(selectionSet ast.SelectionSet, variableUsages ast.VariableDefinitionList, internalFragments ast.FragmentDefinitionList, operation ast.Operation) (*ast.QueryDocument, error) {
 	if operation == "" {
 		operation = ast.Query
@@ -3,6 +3,7 @@ package planner
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"io/ioutil"
 	"path"
 	"strings"
@@ -113,6 +114,22 @@ func TestBuildQueryPlan(t *testing.T) {
 			plan.NewFormatter(&buf).FormatQueryPlan(qp)
 
 			testutils.CheckGoldenFile(t, buf.Bytes(), path.Join(expectFileDir, file.Name()+".txt"))
+
+			// the plan must survive JSON encoding
+			planJSON, err := json.Marshal(qp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := &plan.QueryPlan{}
+			err = json.Unmarshal(planJSON, decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf2 bytes.Buffer
+			plan.NewFormatter(&buf2).FormatQueryPlan(decoded)
+			if buf.String() != buf2.String() {
+				t.Errorf("query plan is changed by JSON encoding: %s", buf2.String())
+			}
 		})
 	}
 }
@@ -31,6 +31,7 @@ var _ yaml.InterfaceMarshaler = (*ComposedSchema)(nil)
 
 type ComposedSchema struct {
 	Schema         *ast.Schema `yaml:"-"`
+	APISchema      *ast.Schema `yaml:"-"` // Schema without @inaccessible elements. it is same as Schema when there are no @inaccessible.
 	SchemaMetadata *FederationSchemaMetadata
 	TypeMetadata   map[*ast.Definition]*FederationTypeMetadata
 	FieldMetadata  map[*ast.FieldDefinition]*FederationFieldMetadata
@@ -6,7 +6,6 @@ import (
 
 	"github.com/vektah/gqlparser/v2/ast"
 	"github.com/vektah/gqlparser/v2/gqlerror"
-	"github.com/vektah/gqlparser/v2/validator"
 	"github.com/vvakame/fedeway/internal/graphql"
 )
 
@@ -297,31 +296,66 @@ func (qpctx *queryPlanningContext) getPossibleTypes(typ *ast.Definition) []*ast.
 func (qpctx *queryPlanningContext) getVariableUsages(selectionSet ast.SelectionSet, fragments ast.FragmentDefinitionList) ast.VariableDefinitionList {
 	var usages ast.VariableDefinitionList
 
-	// Construct a document of the selection set and fragment definitions so we
-	// can visit them, adding all variable usages to the `usages` object.
-	document := &ast.QueryDocument{
-		Operations: ast.OperationList{
-			&ast.OperationDefinition{
-				Operation:    ast.Query,
-				SelectionSet: selectionSet,
-			},
-		},
-		Fragments: fragments,
+	// NOTE don't use validator.Walk here. it overwrites definitions of the visited fields,
+	// and they are shared with the operation of the client. e.g. subscription root fields became nil by walking them as query.
+	// visit them in the same order as validator.Walk does.
+	var walkValue func(value *ast.Value)
+	walkValue = func(value *ast.Value) {
+		if value == nil {
+			return
+		}
+		for _, child := range value.Children {
+			walkValue(child.Value)
+		}
+		if value.Kind != ast.Variable || usages.ForName(value.Raw) != nil {
+			return
+		}
+		varDef := qpctx.variableDefinitions[value.Raw]
+		if varDef == nil {
+			panic(fmt.Sprintf("variable %s definition not found", value.Raw))
+		}
+		usages = append(usages, varDef)
+	}
+	walkDirectives := func(directives ast.DirectiveList) {
+		for _, directive := range directives {
+			for _, arg := range directive.Arguments {
+				walkValue(arg.Value)
+			}
+		}
 	}
 
-	observers := &validator.Events{}
-	observers.OnValue(func(walker *validator.Walker, value *ast.Value) {
-		if value.Kind == ast.Variable {
-			if usages.ForName(value.Raw) == nil {
-				varDef := qpctx.variableDefinitions[value.Raw]
-				if varDef == nil {
-					panic(fmt.Sprintf("variable %s definition not found", value.Raw))
+	visitedFragments := make(map[string]bool)
+	var walkSelectionSet func(selectionSet ast.SelectionSet)
+	walkSelectionSet = func(selectionSet ast.SelectionSet) {
+		for _, selection := range selectionSet {
+			switch selection := selection.(type) {
+			case *ast.Field:
+				for _, arg := range selection.Arguments {
+					walkValue(arg.Value)
+				}
+				walkDirectives(selection.Directives)
+				walkSelectionSet(selection.SelectionSet)
+			case *ast.InlineFragment:
+				walkDirectives(selection.Directives)
+				walkSelectionSet(selection.SelectionSet)
+			case *ast.FragmentSpread:
+				walkDirectives(selection.Directives)
+				fragment := fragments.ForName(selection.Name)
+				if fragment != nil && !visitedFragments[fragment.Name] {
+					visitedFragments[fragment.Name] = true
+					walkSelectionSet(fragment.SelectionSet)
 				}
-				usages = append(usages, varDef)
+			default:
+				panic(fmt.Sprintf("unexpected selection type: %T", selection))
 			}
 		}
-	})
-	validator.Walk(qpctx.schema, document, observers)
+	}
+
+	walkSelectionSet(selectionSet)
+	for _, fragment := range fragments {
+		walkDirectives(fragment.Directives)
+		walkSelectionSet(fragment.SelectionSet)
+	}
 
 	return usages
 }
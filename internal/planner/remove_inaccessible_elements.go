@@ -0,0 +1,121 @@
+package planner
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/validator"
+)
+
+const inaccessibleDirectiveName = "inaccessible"
+
+// removeInaccessibleElements builds the API schema that clients can see.
+// types and fields that have @inaccessible are removed, the supergraph schema is kept as is for query planning.
+func removeInaccessibleElements(schema *ast.Schema) (*ast.Schema, error) {
+	if schema.Directives[inaccessibleDirectiveName] == nil {
+		return schema, nil
+	}
+
+	typeNames := make([]string, 0, len(schema.Types))
+	for typeName := range schema.Types {
+		typeNames = append(typeNames, typeName)
+	}
+	sort.Strings(typeNames)
+
+	// We need to compute the types to remove beforehand, because we also need
+	// to remove any fields that return a removed type. Otherwise, the removed
+	// type would be referenced from the API schema.
+	typesToRemove := make(map[string]bool)
+	for _, typeName := range typeNames {
+		if schema.Types[typeName].Directives.ForName(inaccessibleDirectiveName) != nil {
+			typesToRemove[typeName] = true
+		}
+	}
+
+	apiDocument := &ast.SchemaDocument{}
+
+	schemaDef := &ast.SchemaDefinition{}
+	for operation, def := range map[ast.Operation]*ast.Definition{
+		ast.Query:        schema.Query,
+		ast.Mutation:     schema.Mutation,
+		ast.Subscription: schema.Subscription,
+	} {
+		if def == nil {
+			continue
+		}
+		schemaDef.OperationTypes = append(schemaDef.OperationTypes, &ast.OperationTypeDefinition{
+			Operation: operation,
+			Type:      def.Name,
+		})
+	}
+	sort.Slice(schemaDef.OperationTypes, func(i, j int) bool {
+		return schemaDef.OperationTypes[i].Operation < schemaDef.OperationTypes[j].Operation
+	})
+	apiDocument.Schema = ast.SchemaDefinitionList{schemaDef}
+
+	directiveNames := make([]string, 0, len(schema.Directives))
+	for directiveName := range schema.Directives {
+		directiveNames = append(directiveNames, directiveName)
+	}
+	sort.Strings(directiveNames)
+	for _, directiveName := range directiveNames {
+		apiDocument.Directives = append(apiDocument.Directives, schema.Directives[directiveName])
+	}
+
+	for _, typeName := range typeNames {
+		def := schema.Types[typeName]
+		if typesToRemove[typeName] {
+			continue
+		}
+
+		copied := *def
+
+		copied.Fields = make(ast.FieldList, 0, len(def.Fields))
+		for _, fieldDef := range def.Fields {
+			if strings.HasPrefix(fieldDef.Name, "__") {
+				// __schema and __type will be added again by validator
+				continue
+			}
+			if fieldDef.Directives.ForName(inaccessibleDirectiveName) != nil {
+				continue
+			}
+			if typesToRemove[fieldDef.Type.Name()] {
+				return nil, fmt.Errorf(
+					"field %s.%s returns an @inaccessible type without being marked @inaccessible itself",
+					def.Name, fieldDef.Name,
+				)
+			}
+			copied.Fields = append(copied.Fields, fieldDef)
+		}
+
+		copied.Interfaces = filterTypeNames(def.Interfaces, typesToRemove)
+		copied.Types = filterTypeNames(def.Types, typesToRemove)
+
+		apiDocument.Definitions = append(apiDocument.Definitions, &copied)
+	}
+
+	apiSchema, gErr := validator.ValidateSchemaDocument(apiDocument)
+	if gErr != nil {
+		return nil, gErr
+	}
+
+	return apiSchema, nil
+}
+
+func filterTypeNames(typeNames []string, typesToRemove map[string]bool) []string {
+	if typeNames == nil {
+		return nil
+	}
+
+	newTypeNames := make([]string, 0, len(typeNames))
+	for _, typeName := range typeNames {
+		if typesToRemove[typeName] {
+			continue
+		}
+		newTypeNames = append(newTypeNames, typeName)
+	}
+
+	return newTypeNames
+}